@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// NewAccessHandler answers 403 to clients the route's access rules keep
+// out: any in c.Deny, and with c.Allow set any not in it. Each refusal is
+// logged with the rule that caused it.
+func NewAccessHandler(route string, c *AccessConfig, trusted CIDRList, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		client := clientIP(r, trusted)
+		ip := net.ParseIP(client)
+		var rule string
+		if network := c.Deny.Match(ip); network != nil {
+			rule = "deny " + network.String()
+		} else if len(c.Allow) > 0 && c.Allow.Match(ip) == nil {
+			rule = "not allowed"
+		}
+		if rule != "" {
+			log.WithFields(log.Fields{
+				"route":  route,
+				"client": client,
+				"rule":   rule,
+			}).Warn("client refused by access rules")
+			WriteError(rw, r, http.StatusForbidden, "forbidden")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// NewAdminRouter builds the router for the admin listener. Admin endpoints
+// are only ever served there, never on the public listeners, so binding the
+// admin listener to a private address is what protects them, optionally
+// narrowed further with allow_from. metrics is nil unless metrics are on.
+func NewAdminRouter(config *Config, inFlight *InFlightTracker, metrics *Metrics, reloader *ConfigReloader) http.Handler {
+	root := mux.NewRouter().StrictSlash(true)
+	r := root
+	if config.BasePath != "" {
+		r = root.PathPrefix(config.BasePath).Subrouter()
+	}
+
+	r.Handle("/admin/inflight", inFlight).Methods(http.MethodGet)
+	r.Handle("/admin/routes", adminRoutesHandler(config, reloader)).Methods(http.MethodGet)
+	r.Handle("/admin/upstreams", adminUpstreamsHandler(reloader)).Methods(http.MethodGet)
+	r.Handle("/admin/cache", adminCacheHandler(reloader)).Methods(http.MethodGet)
+	if metrics != nil {
+		r.Handle("/admin/metrics", adminMetricsHandler(metrics)).Methods(http.MethodGet)
+	}
+	r.Handle("/admin/routes/{route}/upstreams/{upstream}/drain", adminDrainHandler(reloader)).Methods(http.MethodPost, http.MethodDelete)
+	r.Handle("/admin/reload", adminReloadHandler(reloader)).Methods(http.MethodPost)
+	r.Handle("/admin/log_level", adminLogLevelHandler()).Methods(http.MethodGet, http.MethodPut)
+	if config.Admin.Pprof {
+		// The pprof handlers expect to live at /debug/pprof/.
+		r.PathPrefix("/admin/debug/pprof/").Handler(http.StripPrefix(config.BasePath+"/admin", newPprofMux()))
+	}
+
+	if len(config.Admin.AllowFrom) > 0 {
+		return NewAllowFromHandler(config.Admin.AllowFrom, root)
+	}
+	return root
+}
+
+func writeAdminJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(v)
+}
+
+// adminRoutesHandler lists the routes being served, in matching order.
+func adminRoutesHandler(config *Config, reloader *ConfigReloader) http.Handler {
+	type routeJSON struct {
+		Name      string            `json:"name"`
+		Match     string            `json:"match"`
+		Path      string            `json:"path"`
+		Host      string            `json:"host,omitempty"`
+		Queries   map[string]string `json:"queries,omitempty"`
+		Type      string            `json:"type"`
+		Upstreams []string          `json:"upstreams,omitempty"`
+		Disabled  bool              `json:"disabled,omitempty"`
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		routes, _ := reloader.Current()
+		current := &Config{Routes: routes}
+		list := make([]routeJSON, 0, len(routes))
+		for _, name := range current.orderedRouteNames() {
+			route := routes[name]
+			match, path := route.Match, config.BasePath+"/"
+			switch match {
+			case "exact", "regex":
+				path = route.Path
+			default:
+				match = "prefix"
+				if route.Prefix != "" {
+					path += route.Prefix + "/"
+				}
+			}
+			typ := route.Type
+			if typ == "" {
+				typ = "proxy"
+			}
+			list = append(list, routeJSON{
+				Name:      name,
+				Match:     match,
+				Path:      path,
+				Host:      route.Host,
+				Queries:   route.Queries,
+				Type:      typ,
+				Upstreams: route.upstreamURLs(),
+				Disabled:  !route.IsEnabled(),
+			})
+		}
+		writeAdminJSON(rw, list)
+	})
+}
+
+// adminUpstreamsHandler reports the state of every route's upstreams.
+func adminUpstreamsHandler(reloader *ConfigReloader) http.Handler {
+	type upstreamJSON struct {
+		Upstream string `json:"upstream"`
+		Version  string `json:"version,omitempty"`
+		Backup   bool   `json:"backup,omitempty"`
+		Healthy  bool   `json:"healthy"`
+		Circuit  string `json:"circuit,omitempty"`
+		Draining bool   `json:"draining"`
+		Active   int64  `json:"active"`
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, router := reloader.Current()
+		routes := make(map[string][]upstreamJSON, len(router.balancers))
+		for name, balancer := range router.balancers {
+			for _, backend := range balancer.Backends() {
+				upstream := upstreamJSON{
+					Upstream: backend.URL.String(),
+					Version:  backend.version,
+					Backup:   backend.backup,
+					Healthy:  backend.Healthy(),
+					Draining: backend.Draining(),
+					Active:   atomic.LoadInt64(&backend.active),
+				}
+				if backend.breaker != nil {
+					upstream.Circuit = backend.breaker.State().String()
+				}
+				routes[name] = append(routes[name], upstream)
+			}
+		}
+		writeAdminJSON(rw, routes)
+	})
+}
+
+// adminCacheHandler reports on the response caches and single-flight
+// coalescing of the routes that have them.
+func adminCacheHandler(reloader *ConfigReloader) http.Handler {
+	type cacheJSON struct {
+		Cache        *CacheStats        `json:"cache,omitempty"`
+		SingleFlight *SingleFlightStats `json:"single_flight,omitempty"`
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, router := reloader.Current()
+		routes := make(map[string]cacheJSON, len(router.caches))
+		for name, caches := range router.caches {
+			var stats cacheJSON
+			if caches.Response != nil {
+				cache := caches.Response.Stats()
+				stats.Cache = &cache
+			}
+			if caches.SingleFlight != nil {
+				singleFlight := caches.SingleFlight.Stats()
+				stats.SingleFlight = &singleFlight
+			}
+			routes[name] = stats
+		}
+		writeAdminJSON(rw, routes)
+	})
+}
+
+// adminMetricsHandler reports how many series each labeled metric exports
+// and how many samples its max_series has turned away.
+func adminMetricsHandler(metrics *Metrics) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(rw, metrics.SeriesStats())
+	})
+}
+
+// adminDrainHandler drains an upstream on POST and puts it back in rotation
+// on DELETE. The upstream is given as host:port.
+func adminDrainHandler(reloader *ConfigReloader) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		_, router := reloader.Current()
+		balancer, ok := router.balancers[vars["route"]]
+		if !ok {
+			WriteError(rw, r, http.StatusNotFound, "no proxy route "+vars["route"])
+			return
+		}
+		if _, ok := balancer.Backend(vars["upstream"]); !ok {
+			WriteError(rw, r, http.StatusNotFound, "route "+vars["route"]+" has no upstream "+vars["upstream"])
+			return
+		}
+		drain := r.Method == http.MethodPost
+		if err := balancer.Drain(vars["upstream"], drain); err != nil {
+			WriteError(rw, r, http.StatusConflict, err.Error())
+			return
+		}
+		entry := log.WithFields(log.Fields{"route": vars["route"], "upstream": vars["upstream"]})
+		if drain {
+			entry.Info("upstream drained through the admin API")
+		} else {
+			entry.Info("upstream back in rotation through the admin API")
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// adminReloadHandler reloads the routes like SIGHUP does and reports what
+// changed.
+func adminReloadHandler(reloader *ConfigReloader) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		changes, err := reloader.Reload()
+		if err != nil {
+			WriteError(rw, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeAdminJSON(rw, changes)
+	})
+}
+
+// adminLogLevelHandler reports the log level, or on PUT sets it from the
+// level parameter until the next restart. Routes with a log_level of their
+// own keep it.
+func adminLogLevelHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			level, err := log.ParseLevel(r.FormValue("level"))
+			if err != nil {
+				WriteError(rw, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			log.SetLevel(level)
+			log.WithField("log_level", level.String()).Info("log level changed through the admin API")
+		}
+		writeAdminJSON(rw, struct {
+			Level string `json:"level"`
+		}{log.GetLevel().String()})
+	})
+}
+
+func newPprofMux() *http.ServeMux {
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return m
+}
+
+// NewAllowFromHandler answers 403 to connections from outside allowed. It
+// looks at the connecting address only; forwarding headers are ignored.
+func NewAllowFromHandler(allowed CIDRList, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !allowed.Contains(remoteIP(r)) {
+			WriteError(rw, r, http.StatusForbidden, "forbidden")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+)
+
+// affinity keeps a client on the same backend of a route, either with a
+// cookie naming the backend or by hashing something of the request onto
+// the backends.
+type affinity struct {
+	cookie       string // proxy-managed cookie naming the client's backend
+	cookieMaxAge int    // seconds; 0 for a session cookie
+	hashOn       string // client_ip, header or cookie
+	hashKey      string // header or cookie name
+	trusted      CIDRList
+}
+
+// SetAffinity makes the balancer keep clients on one backend as c says.
+// Clients whose backend drops out of rotation move to another one, and
+// with a cookie stay on that from then on.
+func (b *Balancer) SetAffinity(c *AffinityConfig, trusted CIDRList) error {
+	if b.canary != nil {
+		return errors.New("affinity can't be combined with canary; use canary sticky instead")
+	}
+	a := &affinity{trusted: trusted}
+	switch c.Type {
+	case "cookie":
+		a.cookie = c.Cookie
+		if a.cookie == "" {
+			a.cookie = "backend_" + b.route
+		}
+		if c.CookieMaxAge < 0 {
+			return errors.New("affinity cookie_max_age can't be negative")
+		}
+		// Rounded up so a short max age doesn't become a session cookie.
+		a.cookieMaxAge = int((c.CookieMaxAge + time.Second - 1) / time.Second)
+	case "hash":
+		a.hashOn = c.HashOn
+		switch a.hashOn {
+		case "":
+			a.hashOn = "client_ip"
+		case "client_ip":
+		case "header":
+			a.hashKey = c.Header
+		case "cookie":
+			a.hashKey = c.Cookie
+		default:
+			return fmt.Errorf("unknown affinity hash_on %q (valid: client_ip, header, cookie)", c.HashOn)
+		}
+		if a.hashOn != "client_ip" && a.hashKey == "" {
+			return fmt.Errorf("affinity hash_on %s needs the %s to hash", a.hashOn, a.hashOn)
+		}
+	default:
+		return fmt.Errorf("unknown affinity type %q (valid: cookie, hash)", c.Type)
+	}
+	b.affinity = a
+	return nil
+}
+
+// pinned returns r's backend by affinity, or nil when the balancer should
+// choose as it would without: r has no backend yet, or its backend is out
+// of rotation.
+func (b *Balancer) pinned(r *http.Request) *Backend {
+	candidates := inRotation(b.Backends())
+	if b.affinity.cookie != "" {
+		cookie, err := r.Cookie(b.affinity.cookie)
+		if err != nil {
+			return nil
+		}
+		for _, backend := range candidates {
+			if backend.id == cookie.Value {
+				return backend
+			}
+		}
+		return nil
+	}
+
+	var key string
+	switch b.affinity.hashOn {
+	case "client_ip":
+		key = clientIP(r, b.affinity.trusted)
+	case "header":
+		key = r.Header.Get(b.affinity.hashKey)
+	case "cookie":
+		if cookie, err := r.Cookie(b.affinity.hashKey); err == nil {
+			key = cookie.Value
+		}
+	}
+	if key == "" {
+		return nil
+	}
+	// Rendezvous hashing: each key goes to the backend scoring highest for
+	// it, so a backend leaving moves only its own keys, and they come back
+	// once it returns.
+	var best *Backend
+	var bestScore uint64
+	for _, backend := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(backend.id))
+		h.Write([]byte(key))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = backend, score
+		}
+	}
+	return best
+}
+
+// NewAffinityCookieModifier pins clients to the backend that answered them:
+// responses from a backend the client's affinity cookie doesn't name set it
+// to that backend.
+func NewAffinityCookieModifier(b *Balancer) ResponseModifier {
+	return func(res *http.Response) error {
+		backend, ok := b.Backend(res.Request.URL.Host)
+		if !ok {
+			return nil
+		}
+		if cookie, err := res.Request.Cookie(b.affinity.cookie); err == nil && cookie.Value == backend.id {
+			return nil
+		}
+		res.Header.Add("Set-Cookie", (&http.Cookie{
+			Name:     b.affinity.cookie,
+			Value:    backend.id,
+			Path:     "/",
+			MaxAge:   b.affinity.cookieMaxAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}).String())
+		return nil
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Defaults and limits for authentication.
+const (
+	defaultAuthLeeway     = time.Minute
+	defaultSessionCookie  = "frontend_session"
+	authHTTPTimeout       = 10 * time.Second
+	jwksMinRefresh        = 30 * time.Second // between fetches for unknown key IDs
+	jwksMaxAge            = time.Hour
+	oidcLoginCookieMaxAge = 10 * time.Minute
+)
+
+// Asymmetric algorithms only: with a JWKS there is no shared secret, and
+// accepting HS* would let a public key be used as one.
+var jwtSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+var defaultOIDCScopes = []string{"openid", "profile", "email"}
+
+// errAuthUnavailable marks failures to check a token because the keys
+// couldn't be fetched, as opposed to the token being bad.
+var errAuthUnavailable = errors.New("auth backend unavailable")
+
+// validateAuthConfig checks a route's auth section when the config is
+// loaded, since the middleware itself is built without a chance to fail.
+func validateAuthConfig(c *AuthConfig) error {
+	if c.JWKSURL == "" && c.Issuer == "" {
+		return errors.New("set jwks_url, or issuer to discover it")
+	}
+	if c.OIDC == nil {
+		return nil
+	}
+	if c.Issuer == "" || c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "" {
+		return errors.New("oidc needs issuer, client_id and redirect_url")
+	}
+	redirect, err := url.Parse(c.OIDC.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		return fmt.Errorf("oidc redirect_url %q must be an absolute URL", c.OIDC.RedirectURL)
+	}
+	return nil
+}
+
+// An Authenticator requires requests to carry a valid JWT, signed by a key
+// from the JWKS and, if set, issued by issuer for one of audience. Tokens
+// come as a Bearer Authorization header or, with oidc, in the session
+// cookie the login flow sets. Requests without a valid token get a 401 (or,
+// from browsers on oidc routes, a redirect to log in), and tokens lacking
+// the required claims a 403. Selected claims are passed upstream as
+// headers; whatever the client sent under those names is dropped.
+//
+// When the keys can't be fetched, tokens are rejected, or with failOpen let
+// through unchecked.
+type Authenticator struct {
+	route         string
+	config        *AuthConfig
+	failOpen      bool
+	trusted       CIDRList
+	leeway        time.Duration
+	cookieName    string
+	callbackPath  string
+	client        *http.Client
+	forwardHeader map[string]string
+
+	mu          sync.Mutex
+	keys        *jwksCache
+	provider    *oidcProvider
+	failingOpen bool
+}
+
+// oidcProvider is the part of the issuer's discovery document we use.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewAuthenticator(route string, c *AuthConfig, failMode string, trusted CIDRList) *Authenticator {
+	a := &Authenticator{
+		route:         route,
+		config:        c,
+		failOpen:      failMode == "open",
+		trusted:       trusted,
+		leeway:        c.Leeway,
+		cookieName:    defaultSessionCookie,
+		client:        &http.Client{Timeout: authHTTPTimeout},
+		forwardHeader: make(map[string]string),
+	}
+	if a.leeway <= 0 {
+		a.leeway = defaultAuthLeeway
+	}
+	for claim, header := range c.ForwardClaims {
+		a.forwardHeader[claim] = http.CanonicalHeaderKey(header)
+	}
+	if c.JWKSURL != "" {
+		a.keys = newJWKSCache(c.JWKSURL, a.client)
+	}
+	if c.OIDC != nil {
+		if c.OIDC.CookieName != "" {
+			a.cookieName = c.OIDC.CookieName
+		}
+		if redirect, err := url.Parse(c.OIDC.RedirectURL); err == nil {
+			a.callbackPath = redirect.Path
+		}
+	}
+	return a
+}
+
+func (a *Authenticator) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		for _, header := range a.forwardHeader {
+			r.Header.Del(header)
+		}
+		if a.config.OIDC != nil && r.URL.Path == a.callbackPath {
+			a.serveCallback(rw, r)
+			return
+		}
+
+		raw, fromCookie := a.token(r)
+		if raw == "" {
+			a.unauthorized(rw, r, "")
+			return
+		}
+		audience := a.config.Audience
+		if fromCookie {
+			// The session holds an ID token, which is for us.
+			audience = []string{a.config.OIDC.ClientID}
+		}
+		claims, err := a.verify(r, raw, audience, "")
+		if a.failOpen && errors.Is(err, errAuthUnavailable) {
+			a.noteFailingOpen(true, err)
+			handler.ServeHTTP(rw, r)
+			return
+		}
+		if a.failOpen && err == nil {
+			a.noteFailingOpen(false, nil)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"route": a.route, "error": err}).Debug("rejecting token")
+			if fromCookie {
+				a.clearCookie(rw, r, a.cookieName)
+			}
+			a.unauthorized(rw, r, "invalid_token")
+			return
+		}
+		for claim, want := range a.config.RequiredClaims {
+			if !claimHas(claims[claim], want) {
+				rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, error="insufficient_scope"`, a.route))
+				WriteError(rw, r, http.StatusForbidden, "token lacks required claim "+claim)
+				return
+			}
+		}
+
+		for claim, header := range a.forwardHeader {
+			if value, ok := claims[claim]; ok {
+				r.Header.Set(header, claimString(value))
+			}
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// noteFailingOpen logs when the route starts letting requests through
+// unchecked, and when it stops.
+func (a *Authenticator) noteFailingOpen(failing bool, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case failing && !a.failingOpen:
+		log.WithFields(log.Fields{"route": a.route, "error": err}).Error("AUTH FAILING OPEN: can't fetch signing keys, letting requests through unauthenticated")
+	case !failing && a.failingOpen:
+		log.WithField("route", a.route).Warn("auth backend reachable again, no longer failing open")
+	}
+	a.failingOpen = failing
+}
+
+// token finds the request's JWT, reporting whether it came from the
+// session cookie.
+func (a *Authenticator) token(r *http.Request) (string, bool) {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token), false
+	}
+	if a.config.OIDC != nil {
+		if cookie, err := r.Cookie(a.cookieName); err == nil && cookie.Value != "" {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
+
+// unauthorized sends browsers on oidc routes off to log in and tells
+// everyone else to come back with a token.
+func (a *Authenticator) unauthorized(rw http.ResponseWriter, r *http.Request, tokenError string) {
+	if a.config.OIDC != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		a.startLogin(rw, r)
+		return
+	}
+	challenge := fmt.Sprintf("Bearer realm=%q", a.route)
+	if tokenError != "" {
+		challenge += fmt.Sprintf(", error=%q", tokenError)
+	}
+	rw.Header().Set("WWW-Authenticate", challenge)
+	WriteError(rw, r, http.StatusUnauthorized, "authentication required")
+}
+
+func (a *Authenticator) verify(r *http.Request, raw string, audience []string, nonce string) (jwt.MapClaims, error) {
+	keys, err := a.jwks(r)
+	if err != nil {
+		return nil, err
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtSigningMethods),
+		jwt.WithLeeway(a.leeway),
+		jwt.WithExpirationRequired(),
+	}
+	if a.config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.config.Issuer))
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return keys.key(kid)
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+	if len(audience) > 0 {
+		accepted, _ := claims.GetAudience()
+		if !anyOf(accepted, audience) {
+			return nil, errors.New("token is not for an accepted audience")
+		}
+	}
+	if nonce != "" {
+		if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+			return nil, errors.New("ID token nonce doesn't match")
+		}
+	}
+	return claims, nil
+}
+
+// jwks returns the key set, discovering where it lives from the issuer the
+// first time if jwks_url isn't set.
+func (a *Authenticator) jwks(r *http.Request) (*jwksCache, error) {
+	a.mu.Lock()
+	keys := a.keys
+	a.mu.Unlock()
+	if keys != nil {
+		return keys, nil
+	}
+	provider, err := a.discover(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	if provider.JWKSURI == "" {
+		return nil, errors.New("issuer publishes no jwks_uri")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.keys == nil {
+		a.keys = newJWKSCache(provider.JWKSURI, a.client)
+	}
+	return a.keys, nil
+}
+
+// discover fetches the issuer's OpenID configuration once it succeeds.
+func (a *Authenticator) discover(r *http.Request) (*oidcProvider, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.provider != nil {
+		return a.provider, nil
+	}
+	target := strings.TrimSuffix(a.config.Issuer, "/") + "/.well-known/openid-configuration"
+	var provider oidcProvider
+	if err := getJSON(r, a.client, target, &provider); err != nil {
+		return nil, fmt.Errorf("discovering %s: %v", a.config.Issuer, err)
+	}
+	if provider.Issuer != a.config.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", provider.Issuer)
+	}
+	a.provider = &provider
+	return a.provider, nil
+}
+
+// startLogin redirects to the provider's login page, remembering in a short
+// lived cookie where to come back to and the values that tie the callback
+// to this browser.
+func (a *Authenticator) startLogin(rw http.ResponseWriter, r *http.Request) {
+	provider, err := a.discover(r)
+	if err != nil {
+		log.WithFields(log.Fields{"route": a.route, "error": err}).Error("can't start login")
+		WriteError(rw, r, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+	state, nonce := randomToken(), randomToken()
+	returnTo := base64.RawURLEncoding.EncodeToString([]byte(r.URL.RequestURI()))
+	http.SetCookie(rw, &http.Cookie{
+		Name:     a.cookieName + "_login",
+		Value:    state + "." + nonce + "." + returnTo,
+		Path:     "/",
+		MaxAge:   int(oidcLoginCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecure(r, a.trusted),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	scopes := a.config.OIDC.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultOIDCScopes
+	}
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.config.OIDC.ClientID},
+		"redirect_uri":  {a.config.OIDC.RedirectURL},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	target := provider.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	http.Redirect(rw, r, target, http.StatusFound)
+}
+
+// serveCallback finishes a login: it checks the state against the login
+// cookie, trades the code for an ID token and keeps that in the session
+// cookie.
+func (a *Authenticator) serveCallback(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		WriteError(rw, r, http.StatusUnauthorized, "login failed: "+query.Get("error"))
+		return
+	}
+	login, err := r.Cookie(a.cookieName + "_login")
+	if err != nil {
+		WriteError(rw, r, http.StatusBadRequest, "login expired, try again")
+		return
+	}
+	parts := strings.SplitN(login.Value, ".", 3)
+	if len(parts) != 3 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(query.Get("state"))) != 1 {
+		WriteError(rw, r, http.StatusBadRequest, "login state doesn't match")
+		return
+	}
+	a.clearCookie(rw, r, a.cookieName+"_login")
+
+	idToken, err := a.exchange(r, query.Get("code"))
+	if err != nil {
+		log.WithFields(log.Fields{"route": a.route, "error": err}).Error("exchanging login code failed")
+		WriteError(rw, r, http.StatusBadGateway, "login failed")
+		return
+	}
+	claims, err := a.verify(r, idToken, []string{a.config.OIDC.ClientID}, parts[1])
+	if err != nil {
+		log.WithFields(log.Fields{"route": a.route, "error": err}).Warn("rejecting ID token from login")
+		WriteError(rw, r, http.StatusUnauthorized, "login failed")
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     a.cookieName,
+		Value:    idToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isSecure(r, a.trusted),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		cookie.Expires = exp.Time
+	}
+	http.SetCookie(rw, cookie)
+
+	returnTo := "/"
+	if decoded, err := base64.RawURLEncoding.DecodeString(parts[2]); err == nil && isLocalPath(string(decoded)) {
+		returnTo = string(decoded)
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	http.Redirect(rw, r, returnTo, http.StatusFound)
+}
+
+// exchange redeems an authorization code at the provider's token endpoint.
+func (a *Authenticator) exchange(r *http.Request, code string) (string, error) {
+	provider, err := a.discover(r)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {a.config.OIDC.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.config.OIDC.ClientID), url.QueryEscape(a.config.OIDC.ClientSecret))
+	res, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("token endpoint answered %d: %v", res.StatusCode, err)
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return token.IDToken, nil
+}
+
+func (a *Authenticator) clearCookie(rw http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(rw, &http.Cookie{Name: name, Path: "/", MaxAge: -1, HttpOnly: true, Secure: isSecure(r, a.trusted)})
+}
+
+// jwksCache holds the keys from a JWKS URL, fetching them again when a
+// token names a key it doesn't know (at most every jwksMinRefresh) or when
+// they are older than jwksMaxAge.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+	err     error // from the last failed fetch
+}
+
+func newJWKSCache(url string, client *http.Client) *jwksCache {
+	return &jwksCache{url: url, client: client}
+}
+
+func (c *jwksCache) key(kid string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[kid]
+	stale := time.Since(c.fetched) > jwksMaxAge
+	if (!ok || stale) && time.Since(c.fetched) > jwksMinRefresh {
+		if err := c.fetch(); err != nil {
+			c.err = err
+			if c.keys != nil {
+				log.WithFields(log.Fields{"jwks": c.url, "error": err}).Warn("refreshing JWKS failed, keeping the keys we have")
+			}
+		}
+		key, ok = c.keys[kid]
+	}
+	if c.keys == nil {
+		// Never fetched, so there's no telling whether the token is good.
+		return nil, fmt.Errorf("%w: fetching JWKS: %v", errAuthUnavailable, c.err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetch loads the key set. c.mu must be held.
+func (c *jwksCache) fetch() error {
+	c.fetched = time.Now()
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(nil, c.client, c.url, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.WithFields(log.Fields{"jwks": c.url, "kid": jwk.Kid, "error": err}).Warn("skipping JWKS key")
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	c.keys = keys
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// getJSON fetches target into v, on behalf of r if there is one.
+func getJSON(r *http.Request, client *http.Client, target string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		req = req.WithContext(r.Context())
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", target, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// claimHas reports whether a claim has the wanted value, or contains it if
+// the claim is a list.
+func claimHas(claim interface{}, want string) bool {
+	if list, ok := claim.([]interface{}); ok {
+		for _, item := range list {
+			if claimString(item) == want {
+				return true
+			}
+		}
+		return false
+	}
+	return claim != nil && claimString(claim) == want
+}
+
+// claimString formats a claim for a header: lists comma separated, objects
+// as JSON.
+func claimString(claim interface{}) string {
+	switch value := claim.(type) {
+	case string:
+		return value
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = claimString(item)
+		}
+		return strings.Join(items, ",")
+	case map[string]interface{}:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+	return fmt.Sprint(claim)
+}
+
+func anyOf(have, want []string) bool {
+	for _, h := range have {
+		for _, w := range want {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isLocalPath reports whether target stays on this site, so that redirects
+// after login can't be pointed elsewhere.
+func isLocalPath(target string) bool {
+	return strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.HasPrefix(target, "/\\")
+}
+
+func randomToken() string {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(data)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestJWKS serves key's public half as the JWKS key k1.
+func newTestJWKS(t *testing.T, key *rsa.PrivateKey) *httptest.Server {
+	t.Helper()
+	n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	jwks := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, `{"keys": [{"kty": "RSA", "kid": "k1", "use": "sig", "n": %q, "e": %q}]}`, n, e)
+	}))
+	t.Cleanup(jwks.Close)
+	return jwks
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestAuthenticator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := newTestJWKS(t, key)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, r.Header.Get("X-User-Id"))
+	}))
+	defer upstream.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    auth:\n"+
+		"      jwks_url: "+jwks.URL+"\n      audience: [api]\n"+
+		"      required_claims: {group: staff}\n      forward_claims: {sub: X-User-Id}\n")
+
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{"sub": "alice", "aud": "api", "group": []string{"staff", "ops"}, "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		token  string
+		header string // sent as X-User-Id by the client
+		status int
+		body   string
+	}{
+		{"valid", signTestToken(t, key, claims(nil)), "", http.StatusOK, "alice"},
+		{"no token", "", "", http.StatusUnauthorized, ""},
+		{"bad signature", signTestToken(t, otherKey, claims(nil)), "", http.StatusUnauthorized, ""},
+		{"expired", signTestToken(t, key, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})), "", http.StatusUnauthorized, ""},
+		{"no expiry", signTestToken(t, key, claims(jwt.MapClaims{"exp": nil})), "", http.StatusUnauthorized, ""},
+		{"other audience", signTestToken(t, key, claims(jwt.MapClaims{"aud": "web"})), "", http.StatusUnauthorized, ""},
+		{"missing required claim", signTestToken(t, key, claims(jwt.MapClaims{"group": []string{"ops"}})), "", http.StatusForbidden, ""},
+		{"client claim header stripped", signTestToken(t, key, claims(jwt.MapClaims{"sub": nil})), "mallory", http.StatusOK, ""},
+		{"client claim header replaced", signTestToken(t, key, claims(nil)), "mallory", http.StatusOK, "alice"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/app/", nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			if test.header != "" {
+				req.Header.Set("X-User-Id", test.header)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("status = %d, want %d", rec.Code, test.status)
+			}
+			if test.status == http.StatusOK && rec.Body.String() != test.body {
+				t.Errorf("upstream saw X-User-Id %q, want %q", rec.Body.String(), test.body)
+			}
+			if test.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAuthFailMode(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	// The JWKS can't be fetched.
+	jwks := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "down", http.StatusInternalServerError)
+	}))
+	defer jwks.Close()
+	token := signTestToken(t, key, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		mode   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"closed", http.StatusUnauthorized},
+		{"open", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run("mode "+test.mode, func(t *testing.T) {
+			config := "routes:\n  app:\n    upstream: " + upstream.URL + "\n    auth: {jwks_url: " + jwks.URL + "}\n"
+			if test.mode != "" {
+				config += "    auth_fail_mode: " + test.mode + "\n"
+			}
+			router := newTestRouter(t, config)
+			req := httptest.NewRequest("GET", "/app/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestAuthLetsOptionsThrough(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := newTestJWKS(t, key)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    handle_options: true\n    auth: {jwks_url: "+jwks.URL+"}\n")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/app/", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("OPTIONS without a token: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET without a token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A backend that fails this many requests in a row, by refusing the
+// connection or answering with a failure status, is taken out of rotation
+// for backendEjectionPeriod, after which it gets another chance.
+const (
+	backendEjectAfterFailures = 3
+	backendEjectionPeriod     = 10 * time.Second
+)
+
+// A Backend is one of a route's upstreams.
+type Backend struct {
+	URL *url.URL
+
+	active        int64 // requests in progress, for least_connections
+	failures      int32 // consecutive failed connection attempts
+	ejectedUntil  int64 // UnixNano; zero while in rotation
+	unhealthy     int32 // set while failing active health checks
+	draining      int32 // set while drained through the admin API
+	breaker       *circuitBreaker
+	version       string        // canary version name
+	weight        int           // traffic weight, for canaries and weighted
+	currentWeight int           // smooth weighted round robin score, under weightMu
+	id            string        // names the backend in affinity cookies
+	removed       chan struct{} // closed once discovery drops the backend
+	backup        bool          // only used while no other backend is available
+}
+
+func newBackend(target *url.URL) *Backend {
+	sum := sha256.Sum256([]byte(target.Host))
+	return &Backend{URL: target, weight: 1, id: hex.EncodeToString(sum[:8]), removed: make(chan struct{})}
+}
+
+func (b *Backend) available(now time.Time) bool {
+	if b.Draining() {
+		return false
+	}
+	if b.breaker != nil && !b.breaker.ready(now) {
+		return false
+	}
+	return atomic.LoadInt64(&b.ejectedUntil) <= now.UnixNano()
+}
+
+// Healthy reports whether the backend is passing its health checks. Without
+// health checks every backend is healthy.
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.unhealthy) == 0
+}
+
+// Draining reports whether the backend has been drained: it finishes the
+// requests it has but gets no new ones while other backends can take them.
+func (b *Backend) Draining() bool {
+	return atomic.LoadInt32(&b.draining) != 0
+}
+
+// Drain takes upstream, a backend's host:port, out of rotation, or with
+// drain false puts it back. It refuses to drain a route's last backend in
+// rotation. Drained backends are back in rotation after a reload.
+func (b *Balancer) Drain(upstream string, drain bool) error {
+	backend, ok := b.Backend(upstream)
+	if !ok {
+		return fmt.Errorf("route %s has no upstream %s", b.route, upstream)
+	}
+	if !drain {
+		atomic.StoreInt32(&backend.draining, 0)
+		return nil
+	}
+	for _, other := range b.Backends() {
+		if other != backend && !other.Draining() {
+			atomic.StoreInt32(&backend.draining, 1)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is the last upstream of route %s in rotation", upstream, b.route)
+}
+
+// A Balancer spreads a route's requests over its backends: "round_robin"
+// (the default), "least_connections", "random" or "weighted". Backends the upstream
+// connection keeps failing for are ejected for a while; if every backend is
+// ejected, all of them are tried rather than none. Backends failing active
+// health checks are never tried: with none healthy, requests get the route's
+// no_healthy_status, 503 by default. Backup backends only get requests while
+// none of the others can take them.
+type Balancer struct {
+	route    string
+	strategy string
+	next     uint64
+	stop     chan struct{}
+
+	// Replaced as a whole, never modified, when discovery changes the
+	// backends.
+	mu       sync.RWMutex
+	backends []*Backend
+	byHost   map[string]*Backend
+
+	// For backends discovery adds later.
+	breakerConfig    *CircuitBreakerConfig
+	metrics          *Metrics
+	startHealthCheck func(*Backend)
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	weightMu sync.Mutex
+
+	canary        *CanaryConfig
+	versionCookie string
+
+	affinity *affinity
+
+	// Statuses that count as failures besides 5xx.
+	errorStatuses map[int]bool
+
+	// Set while requests are going to backup backends.
+	failedOver int32
+}
+
+func NewBalancer(route string, upstreams []string, strategy string) (*Balancer, error) {
+	switch strategy {
+	case "":
+		strategy = "round_robin"
+	case "round_robin", "least_connections", "random", "weighted":
+	default:
+		return nil, fmt.Errorf("unknown balance %q (valid: round_robin, least_connections, random, weighted)", strategy)
+	}
+	b := &Balancer{
+		route:    route,
+		strategy: strategy,
+		byHost:   make(map[string]*Backend),
+		stop:     make(chan struct{}),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, upstream := range upstreams {
+		target, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		backend := newBackend(target)
+		b.backends = append(b.backends, backend)
+		b.byHost[target.Host] = backend
+	}
+	return b, nil
+}
+
+// Pick chooses the backend for the next request. When no backend is
+// healthy it returns an unhealthy one, which the balancer's transport
+// refuses to send to. It returns nil while discovery hasn't found any.
+func (b *Balancer) Pick() *Backend {
+	backends := b.Backends()
+	if len(backends) == 0 {
+		return nil
+	}
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	candidates := inRotation(backends)
+	if len(candidates) == 0 {
+		return backends[0]
+	}
+
+	switch b.strategy {
+	case "least_connections":
+		// Start the scan at a rotating offset so ties don't all land on
+		// the first backend.
+		offset := int(atomic.AddUint64(&b.next, 1) % uint64(len(candidates)))
+		best := candidates[offset]
+		for i := 1; i < len(candidates); i++ {
+			candidate := candidates[(offset+i)%len(candidates)]
+			if atomic.LoadInt64(&candidate.active) < atomic.LoadInt64(&best.active) {
+				best = candidate
+			}
+		}
+		return best
+	case "random":
+		b.randMu.Lock()
+		defer b.randMu.Unlock()
+		return candidates[b.rand.Intn(len(candidates))]
+	case "weighted":
+		var weighted []*Backend
+		for _, candidate := range candidates {
+			if candidate.weight > 0 {
+				weighted = append(weighted, candidate)
+			}
+		}
+		if len(weighted) == 0 {
+			return candidates[0]
+		}
+		return b.pickWeighted(weighted)
+	default:
+		return candidates[atomic.AddUint64(&b.next, 1)%uint64(len(candidates))]
+	}
+}
+
+// pickWeighted chooses one of candidates, which all have a positive weight,
+// by smooth weighted round robin as nginx does: each pick adds every
+// candidate's weight to its running score and takes the highest, which then
+// drops by the total. Over a cycle each gets its share, spread out rather
+// than in bursts.
+func (b *Balancer) pickWeighted(candidates []*Backend) *Backend {
+	b.weightMu.Lock()
+	defer b.weightMu.Unlock()
+	var best *Backend
+	total := 0
+	for _, backend := range candidates {
+		backend.currentWeight += backend.weight
+		total += backend.weight
+		if best == nil || backend.currentWeight > best.currentWeight {
+			best = backend
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// AddBackups adds backends at upstreams that are only used while every
+// other backend is unhealthy or out of rotation.
+func (b *Balancer) AddBackups(upstreams []string) error {
+	for _, upstream := range upstreams {
+		target, err := url.Parse(upstream)
+		if err != nil {
+			return err
+		}
+		if _, ok := b.byHost[target.Host]; ok {
+			return fmt.Errorf("backup %s is already an upstream", upstream)
+		}
+		backend := newBackend(target)
+		backend.backup = true
+		b.backends = append(b.backends, backend)
+		b.byHost[target.Host] = backend
+	}
+	return nil
+}
+
+// noteFailover logs when requests start going to backup backends, since
+// every primary one is down, and when they stop.
+func (b *Balancer) noteFailover(backend *Backend) {
+	entry := log.WithFields(log.Fields{"route": b.route, "upstream": backend.URL.Host})
+	switch {
+	case backend.backup && atomic.CompareAndSwapInt32(&b.failedOver, 0, 1):
+		entry.Error("FAILING OVER TO BACKUP: no primary upstream is available")
+	case !backend.backup && atomic.CompareAndSwapInt32(&b.failedOver, 1, 0):
+		entry.Warn("primary upstreams available again, leaving backup")
+	}
+}
+
+// SetWeights gives the backends at the listed upstreams their weights for
+// the weighted strategy.
+func (b *Balancer) SetWeights(weights map[string]int) error {
+	total := 0
+	for _, backend := range b.backends {
+		if weight, ok := weights[backend.URL.String()]; ok {
+			backend.weight = weight
+		}
+		total += backend.weight
+	}
+	for upstream, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("weight for %s can't be negative", upstream)
+		}
+		listed := false
+		for _, backend := range b.backends {
+			listed = listed || backend.URL.String() == upstream
+		}
+		if !listed {
+			return fmt.Errorf("weights: %s isn't one of the upstreams", upstream)
+		}
+	}
+	if total <= 0 {
+		return errors.New("weights add up to zero")
+	}
+	return nil
+}
+
+// inRotation returns the backends requests can go to: the healthy ones
+// that aren't ejected, drained or behind an open circuit, or if there are
+// none, all the healthy ones. Backups only come in where no primary backend
+// would do, ahead of primaries that are healthy but out of rotation.
+func inRotation(backends []*Backend) []*Backend {
+	now := time.Now()
+	var healthy, candidates, healthyBackups, backups []*Backend
+	for _, backend := range backends {
+		if !backend.Healthy() {
+			continue
+		}
+		if backend.backup {
+			healthyBackups = append(healthyBackups, backend)
+			if backend.available(now) {
+				backups = append(backups, backend)
+			}
+			continue
+		}
+		healthy = append(healthy, backend)
+		if backend.available(now) {
+			candidates = append(candidates, backend)
+		}
+	}
+	switch {
+	case len(candidates) > 0:
+		return candidates
+	case len(backups) > 0:
+		return backups
+	case len(healthy) > 0:
+		return healthy
+	}
+	return healthyBackups
+}
+
+// Backends returns the balancer's backends, in config order.
+func (b *Balancer) Backends() []*Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.backends
+}
+
+// Backend returns the backend at upstream, a host:port.
+func (b *Balancer) Backend(upstream string) (*Backend, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	backend, ok := b.byHost[upstream]
+	return backend, ok
+}
+
+// CountAsErrors has responses with statuses count as failures, as 5xx do,
+// for circuit breakers, retries and ejecting the backend.
+func (b *Balancer) CountAsErrors(statuses []int) {
+	b.errorStatuses = make(map[int]bool, len(statuses))
+	for _, status := range statuses {
+		b.errorStatuses[status] = true
+	}
+}
+
+// failedStatus reports whether a response with status counts as a failure.
+func (b *Balancer) failedStatus(status int) bool {
+	return status >= 500 || (b != nil && b.errorStatuses[status])
+}
+
+// ExportMetrics has the balancer export its state to metrics, if set:
+// whether the route has no healthy upstream, and with circuit breakers their
+// states.
+func (b *Balancer) ExportMetrics(metrics *Metrics) {
+	b.mu.Lock()
+	b.metrics = metrics
+	b.mu.Unlock()
+	b.exportHealth()
+}
+
+// exportHealth exports whether any backend is healthy.
+func (b *Balancer) exportHealth() {
+	b.mu.RLock()
+	metrics := b.metrics
+	b.mu.RUnlock()
+	if metrics == nil {
+		return
+	}
+	healthy := false
+	for _, backend := range b.Backends() {
+		healthy = healthy || backend.Healthy()
+	}
+	metrics.SetNoHealthyUpstreams(b.route, !healthy)
+}
+
+// SetBackends replaces the balancer's backends with upstreams. Backends
+// already present keep their state; new ones get the balancer's circuit
+// breakers and health checks.
+func (b *Balancer) SetBackends(upstreams []string) error {
+	if len(upstreams) == 0 {
+		return errors.New("no upstream")
+	}
+	var targets []*url.URL
+	for _, upstream := range upstreams {
+		target, err := url.Parse(upstream)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target)
+	}
+
+	b.mu.Lock()
+	previous := b.byHost
+	backends := make([]*Backend, 0, len(targets))
+	byHost := make(map[string]*Backend, len(targets))
+	var added []*Backend
+	for _, target := range targets {
+		if _, ok := byHost[target.Host]; ok {
+			continue
+		}
+		backend, ok := previous[target.Host]
+		if !ok {
+			backend = newBackend(target)
+			if b.breakerConfig != nil {
+				b.addBreaker(backend)
+			}
+			added = append(added, backend)
+		}
+		backends = append(backends, backend)
+		byHost[target.Host] = backend
+	}
+	b.backends, b.byHost = backends, byHost
+	startHealthCheck := b.startHealthCheck
+	b.mu.Unlock()
+
+	entry := log.WithField("route", b.route)
+	for _, backend := range added {
+		entry.WithField("upstream", backend.URL.Host).Info("upstream discovered")
+		if startHealthCheck != nil {
+			startHealthCheck(backend)
+		}
+	}
+	for host, backend := range previous {
+		if _, ok := byHost[host]; !ok {
+			entry.WithField("upstream", host).Info("upstream gone from discovery")
+			close(backend.removed)
+		}
+	}
+	b.exportHealth()
+	return nil
+}
+
+func (b *Balancer) recordFailure(backend *Backend) {
+	if atomic.AddInt32(&backend.failures, 1) < backendEjectAfterFailures || len(b.Backends()) == 1 {
+		return
+	}
+	atomic.StoreInt32(&backend.failures, 0)
+	atomic.StoreInt64(&backend.ejectedUntil, time.Now().Add(backendEjectionPeriod).UnixNano())
+	log.WithFields(log.Fields{
+		"route":    b.route,
+		"upstream": backend.URL.Host,
+		"ejected":  backendEjectionPeriod,
+	}).Warn("upstream keeps failing, taking it out of rotation")
+}
+
+func (b *Balancer) recordSuccess(backend *Backend) {
+	atomic.StoreInt32(&backend.failures, 0)
+}
+
+// Transport wraps transport to count requests in progress per backend and
+// to eject backends whose connections fail or that keep answering with
+// failures. With retryDials, a request
+// whose connection can't be made is sent to another backend in rotation,
+// up to dialAttempts backends in all.
+func (b *Balancer) Transport(transport http.RoundTripper, retryDials bool) http.RoundTripper {
+	return &balancerTransport{RoundTripper: transport, balancer: b, retryDials: retryDials}
+}
+
+// Backends a request is tried on when connecting to them fails.
+const dialAttempts = 3
+
+type balancerTransport struct {
+	http.RoundTripper
+	balancer   *Balancer
+	retryDials bool
+}
+
+// errNoHealthyUpstream fails requests for a route whose upstreams are all
+// failing their health checks.
+var errNoHealthyUpstream = errors.New("no healthy upstream")
+
+// errCircuitOpen fails requests to an upstream whose circuit breaker is
+// open.
+var errCircuitOpen = errors.New("upstream circuit open")
+
+// RoundTrip sends req to the backend it is addressed to. Nothing has been
+// sent when a dial fails, so moving on to another backend is safe for any
+// request, POST included. It papers over a backend restarting and refusing
+// connections.
+func (t *balancerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backend, ok := t.balancer.Backend(req.URL.Host)
+	if !ok {
+		if len(t.balancer.Backends()) == 0 {
+			// Discovery hasn't found any yet.
+			return nil, errNoHealthyUpstream
+		}
+		return t.RoundTripper.RoundTrip(req)
+	}
+	if !t.retryDials {
+		return t.send(req, backend)
+	}
+	// The transport closes the body when the dial fails, unread; keep it
+	// open for the next backend.
+	body := req.Body
+	if body != nil && body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(body)
+	}
+	tried := []*Backend{backend}
+	for {
+		res, err := t.send(req, backend)
+		if err == nil || !isDialError(err) || len(tried) == dialAttempts || req.Context().Err() != nil {
+			if err != nil && body != nil {
+				body.Close()
+			}
+			return res, err
+		}
+		next := t.balancer.pickUntried(tried)
+		if next == nil {
+			if body != nil {
+				body.Close()
+			}
+			return nil, err
+		}
+		log.WithFields(log.Fields{
+			"route":    t.balancer.route,
+			"upstream": backend.URL.Host,
+			"next":     next.URL.Host,
+		}).WithError(err).Debug("upstream dial failed, trying another")
+		if info := RequestInfoFromContext(req.Context()); info != nil {
+			info.AddDialRetry()
+		}
+		req = req.Clone(req.Context())
+		retarget(req, next.URL)
+		backend = next
+		tried = append(tried, backend)
+	}
+}
+
+// pickUntried chooses a backend in rotation that isn't one of tried, or nil
+// if they all are.
+func (b *Balancer) pickUntried(tried []*Backend) *Backend {
+	var untried []*Backend
+	for _, backend := range b.Backends() {
+		ok := true
+		for _, t := range tried {
+			ok = ok && t != backend
+		}
+		if ok {
+			untried = append(untried, backend)
+		}
+	}
+	candidates := inRotation(untried)
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[atomic.AddUint64(&b.next, 1)%uint64(len(candidates))]
+}
+
+// retarget points req, about to be sent again, at target.
+func retarget(req *http.Request, target *url.URL) {
+	previous := req.URL.Host
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	if req.Host == previous {
+		// upstream_host_header: keep it naming the upstream it goes to.
+		req.Host = target.Host
+	}
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		info.SetUpstream(target.Host)
+	}
+}
+
+// isDialError reports whether err is a failure to connect, before any of
+// the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// send makes one attempt at backend.
+func (t *balancerTransport) send(req *http.Request, backend *Backend) (*http.Response, error) {
+	if !backend.Healthy() {
+		return nil, errNoHealthyUpstream
+	}
+	t.balancer.noteFailover(backend)
+	if backend.breaker != nil && !backend.breaker.Allow() {
+		return nil, errCircuitOpen
+	}
+	atomic.AddInt64(&backend.active, 1)
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&backend.active, -1)
+		if isDialError(err) {
+			t.balancer.recordFailure(backend)
+		}
+		if backend.breaker != nil {
+			if clientDisconnected(req) {
+				backend.breaker.Release()
+			} else {
+				backend.breaker.Record(true)
+			}
+		}
+		return nil, err
+	}
+	failed := t.balancer.failedStatus(res.StatusCode)
+	if failed {
+		t.balancer.recordFailure(backend)
+	} else {
+		t.balancer.recordSuccess(backend)
+	}
+	if backend.breaker != nil {
+		backend.breaker.Record(failed)
+	}
+	// The request counts as in progress until its body is done with.
+	done := func() { atomic.AddInt64(&backend.active, -1) }
+	if body, ok := res.Body.(io.ReadWriteCloser); ok && res.StatusCode == http.StatusSwitchingProtocols {
+		// The proxy needs the upgraded connection to stay writable.
+		res.Body = &countedReadWriteCloser{ReadWriteCloser: body, done: done}
+	} else {
+		res.Body = &countedBody{ReadCloser: res.Body, done: done}
+	}
+	return res, nil
+}
+
+type countedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (c *countedBody) Close() error {
+	c.once.Do(c.done)
+	return c.ReadCloser.Close()
+}
+
+type countedReadWriteCloser struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done func()
+}
+
+func (c *countedReadWriteCloser) Close() error {
+	c.once.Do(c.done)
+	return c.ReadWriteCloser.Close()
+}
+
+// Defaults for health_check settings left unset.
+const (
+	defaultHealthCheckPath     = "/"
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+)
+
+// StartHealthChecks probes every backend in the background until Close.
+// A backend is marked unhealthy after c.UnhealthyThreshold failed probes in
+// a row and healthy again after c.HealthyThreshold good ones; a probe is
+// good when it gets a 2xx or 3xx (or one of c.ExpectedStatus) within the
+// timeout, containing c.ExpectedBody if set. Backends start out healthy.
+func (b *Balancer) StartHealthChecks(c *HealthCheck, transport http.RoundTripper) {
+	path := c.Path
+	if path == "" {
+		path = defaultHealthCheckPath
+	}
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	healthyThreshold := c.HealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = defaultHealthyThreshold
+	}
+	unhealthyThreshold := c.UnhealthyThreshold
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	probe := &healthProbe{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		method:       c.Method,
+		expectedBody: c.ExpectedBody,
+	}
+	if probe.method == "" {
+		probe.method = http.MethodGet
+	}
+	if len(c.ExpectedStatus) > 0 {
+		probe.expectedStatus = make(map[int]bool, len(c.ExpectedStatus))
+		for _, status := range c.ExpectedStatus {
+			probe.expectedStatus[status] = true
+		}
+	}
+
+	b.mu.Lock()
+	b.startHealthCheck = func(backend *Backend) {
+		target := *backend.URL
+		target.Path = path
+		target.RawQuery = ""
+		go b.checkHealth(backend, probe, target.String(), interval, c.Jitter, healthyThreshold, unhealthyThreshold)
+	}
+	backends := b.backends
+	b.mu.Unlock()
+	for _, backend := range backends {
+		b.startHealthCheck(backend)
+	}
+}
+
+func (b *Balancer) checkHealth(backend *Backend, probe *healthProbe, target string, interval time.Duration, jitter string, healthyThreshold, unhealthyThreshold int) {
+	timer := time.NewTimer(withJitter(interval, jitter))
+	defer timer.Stop()
+	entry := log.WithFields(log.Fields{"route": b.route, "upstream": backend.URL.Host})
+
+	var passed, failed int
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-backend.removed:
+			return
+		case <-timer.C:
+		}
+		timer.Reset(withJitter(interval, jitter))
+
+		err := probe.check(target)
+		if err == nil {
+			passed, failed = passed+1, 0
+		} else {
+			passed, failed = 0, failed+1
+		}
+		switch {
+		case err != nil && failed == unhealthyThreshold && backend.Healthy():
+			atomic.StoreInt32(&backend.unhealthy, 1)
+			entry.WithError(err).Error("upstream failed health checks, taking it out of rotation")
+			b.exportHealth()
+		case err == nil && passed == healthyThreshold && !backend.Healthy():
+			atomic.StoreInt32(&backend.unhealthy, 0)
+			entry.Info("upstream passing health checks again")
+			b.exportHealth()
+		}
+	}
+}
+
+// A healthProbe is one health check request and what makes it pass.
+type healthProbe struct {
+	client         *http.Client
+	method         string
+	expectedStatus map[int]bool // nil for any 2xx or 3xx
+	expectedBody   string
+}
+
+// healthCheckMaxBody bounds how much of a probe's answer is read.
+const healthCheckMaxBody = 64 << 10
+
+func (p *healthProbe) check(target string) error {
+	req, err := http.NewRequest(p.method, target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, healthCheckMaxBody))
+	res.Body.Close()
+	switch {
+	case p.expectedStatus != nil && !p.expectedStatus[res.StatusCode]:
+		return fmt.Errorf("health check answered %d", res.StatusCode)
+	case p.expectedStatus == nil && res.StatusCode >= 400:
+		return fmt.Errorf("health check answered %d", res.StatusCode)
+	case p.expectedBody == "":
+		return nil
+	case err != nil:
+		return err
+	case !strings.Contains(string(body), p.expectedBody):
+		return fmt.Errorf("health check answer doesn't contain %q", p.expectedBody)
+	}
+	return nil
+}
+
+// Close stops the balancer's health checks.
+func (b *Balancer) Close() {
+	select {
+	case <-b.stop:
+	default:
+		close(b.stop)
+	}
+}
+
+// NewHealthzHandler reports the health of every route's upstreams as JSON.
+// It answers 503 while any route has no healthy upstream.
+func NewHealthzHandler(balancers map[string]*Balancer) http.Handler {
+	type upstreamHealth struct {
+		Upstream string `json:"upstream"`
+		Healthy  bool   `json:"healthy"`
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		routes := make(map[string][]upstreamHealth, len(balancers))
+		healthy := true
+		for name, balancer := range balancers {
+			routeHealthy := false
+			for _, backend := range balancer.Backends() {
+				routes[name] = append(routes[name], upstreamHealth{backend.URL.String(), backend.Healthy()})
+				routeHealthy = routeHealthy || backend.Healthy()
+			}
+			healthy = healthy && routeHealthy
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-store")
+		if !healthy {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(rw).Encode(struct {
+			Healthy bool                        `json:"healthy"`
+			Routes  map[string][]upstreamHealth `json:"routes"`
+		}{healthy, routes})
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDialRetryMovesToAnotherBackend(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(rw, r.Body)
+	}))
+	defer upstream.Close()
+	// An address nothing listens on, so connections to it are refused.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name   string
+		config string
+		failed bool
+	}{
+		{"retried", "", false},
+		{"disable_dial_retry", "    disable_dial_retry: true\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter(t, "routes:\n  app:\n    upstreams: ["+refused+", "+upstream.URL+"]\n"+test.config)
+			failed := false
+			// Round robin sends every other request to the refusing
+			// backend first.
+			for i := 0; i < 4; i++ {
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest("POST", "/app/echo", strings.NewReader("payload")))
+				if rec.Code != http.StatusOK {
+					failed = true
+					continue
+				}
+				if got := rec.Body.String(); got != "payload" {
+					t.Errorf("body = %q, want payload", got)
+				}
+			}
+			if failed != test.failed {
+				t.Errorf("some requests failed = %v, want %v", failed, test.failed)
+			}
+		})
+	}
+}
+
+func TestBackupUpstream(t *testing.T) {
+	// The primary fails only its health checks, so it is taken out by them
+	// rather than ejected for the 5xx of proxied requests.
+	var primaryDown int32
+	primary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(&primaryDown) != 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(rw, "primary")
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "backup")
+	}))
+	defer backup.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+primary.URL+"\n    backup: ["+backup.URL+"]\n"+
+		"    health_check: {path: /healthz, interval: 20ms, healthy_threshold: 1, unhealthy_threshold: 1}\n")
+
+	// waitFor polls until the route answers from want.
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/", nil))
+			if rec.Body.String() == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("route answered %d %q, want %s", rec.Code, rec.Body.String(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/", nil))
+		if got := rec.Body.String(); got != "primary" {
+			t.Fatalf("answered by %q while the primary is healthy", got)
+		}
+	}
+	atomic.StoreInt32(&primaryDown, 1)
+	waitFor("backup")
+	atomic.StoreInt32(&primaryDown, 0)
+	waitFor("primary")
+}
+
+func TestFailingStatusesEject(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		config string
+	}{
+		{"5xx", http.StatusInternalServerError, ""},
+		{"error_status_codes", http.StatusTooManyRequests, "    error_status_codes: [429]\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.WriteHeader(test.status)
+			}))
+			defer failing.Close()
+			healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+			defer healthy.Close()
+			router := newTestRouter(t, "routes:\n  app:\n    upstreams: ["+failing.URL+", "+healthy.URL+"]\n"+test.config)
+
+			// Round robin reaches the failing backend on every other
+			// request until it is ejected.
+			for i := 0; i < 2*backendEjectAfterFailures; i++ {
+				router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/app/", nil))
+			}
+			for i := 0; i < 4; i++ {
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/", nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status %d after the failing backend should be ejected", rec.Code)
+				}
+			}
+		})
+	}
+}
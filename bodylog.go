@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults for debug_log_bodies.
+const (
+	defaultBodyLogPerMinute = 10
+	defaultBodyLogMaxBytes  = 4096
+)
+
+// NewBodyLogHandler is a debugging aid: it logs the request and response
+// bodies of up to PerMinute requests a minute, each truncated to MaxBytes,
+// with the values of JSON fields named in Redact masked. Requests over the
+// rate are proxied as usual without being logged. It is meant to be
+// switched on for one route while chasing a problem, not left running.
+func NewBodyLogHandler(route string, c *BodyLogConfig, handler http.Handler) http.Handler {
+	perMinute := c.PerMinute
+	if perMinute <= 0 {
+		perMinute = defaultBodyLogPerMinute
+	}
+	maxBytes := c.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultBodyLogMaxBytes
+	}
+	redact := newRedactor(c.Redact)
+	limiter := &minuteLimiter{limit: perMinute}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !limiter.allow() {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+
+		reqBody := &limitedBuffer{max: maxBytes}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &teeReadCloser{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		capture := &bodyCaptureWriter{ResponseWriter: rw, status: http.StatusOK, body: &limitedBuffer{max: maxBytes}}
+		handler.ServeHTTP(capture, r)
+
+		log.WithFields(log.Fields{
+			"route":              route,
+			"request":            r.RequestURI,
+			"method":             r.Method,
+			"status":             capture.status,
+			"request_id":         r.Header.Get("X-Request-Id"),
+			"request_body":       redact(reqBody.String()),
+			"request_truncated":  reqBody.truncated,
+			"response_body":      redact(capture.body.String()),
+			"response_truncated": capture.body.truncated,
+		}).Warn("debug body log")
+	})
+}
+
+// minuteLimiter allows up to limit events per calendar minute.
+type minuteLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Time
+	count  int
+}
+
+func (l *minuteLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	window := time.Now().Truncate(time.Minute)
+	if !window.Equal(l.window) {
+		l.window = window
+		l.count = 0
+	}
+	if l.count >= l.limit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// newRedactor returns a function masking the values of the named JSON
+// fields. It works on the text rather than parsing it, since truncated
+// bodies are rarely valid JSON.
+func newRedactor(fields []string) func(string) string {
+	if len(fields) == 0 {
+		return func(s string) string { return s }
+	}
+	quoted := make([]string, len(fields))
+	for i, field := range fields {
+		quoted[i] = regexp.QuoteMeta(field)
+	}
+	re := regexp.MustCompile(`("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+	return func(s string) string {
+		return re.ReplaceAllString(s, `$1"[REDACTED]"`)
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it and notes whether
+// anything was dropped.
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.truncated = true
+		b.Buffer.Write(p[:room])
+	} else {
+		b.Buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+type teeReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (t *teeReadCloser) Close() error {
+	return t.closer.Close()
+}
+
+type bodyCaptureWriter struct {
+	http.ResponseWriter
+	status int
+	body   *limitedBuffer
+}
+
+func (w *bodyCaptureWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *bodyCaptureWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *bodyCaptureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
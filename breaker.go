@@ -0,0 +1,231 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults for circuit_breaker settings left unset.
+const (
+	defaultBreakerConsecutiveFailures = 5
+	defaultBreakerWindow              = 10 * time.Second
+	defaultBreakerMinRequests         = 10
+	defaultBreakerCooldown            = 30 * time.Second
+	defaultBreakerHalfOpenProbes      = 1
+)
+
+type breakerState int
+
+// The values double as the frontend_circuit_breaker_state metric.
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// A circuitBreaker stops sending requests to an upstream that keeps
+// failing them. It opens after too many consecutive failures, or too high a
+// share of failures within a window, and then fails requests straight away
+// for the cooldown. After that it lets a few probe requests through: if
+// they all succeed it closes again, if any fails it reopens.
+type circuitBreaker struct {
+	consecutiveFailures int
+	errorRate           float64
+	window              time.Duration
+	minRequests         int
+	cooldown            time.Duration
+	probes              int
+	onChange            func(breakerState)
+
+	mu          sync.Mutex
+	state       breakerState
+	failures    int       // consecutive, while closed
+	windowStart time.Time // start of the error rate window
+	requests    int       // in the current window
+	failed      int       // in the current window
+	openUntil   time.Time
+	probing     int // probe requests in progress
+	passed      int // probe requests that succeeded
+}
+
+func newCircuitBreaker(c *CircuitBreakerConfig, onChange func(breakerState)) *circuitBreaker {
+	cb := &circuitBreaker{
+		consecutiveFailures: c.ConsecutiveFailures,
+		errorRate:           c.ErrorRate,
+		window:              c.Window,
+		minRequests:         c.MinRequests,
+		cooldown:            c.Cooldown,
+		probes:              c.HalfOpenProbes,
+		onChange:            onChange,
+		windowStart:         time.Now(),
+	}
+	if cb.consecutiveFailures <= 0 {
+		cb.consecutiveFailures = defaultBreakerConsecutiveFailures
+	}
+	if cb.window <= 0 {
+		cb.window = defaultBreakerWindow
+	}
+	if cb.minRequests <= 0 {
+		cb.minRequests = defaultBreakerMinRequests
+	}
+	if cb.cooldown <= 0 {
+		cb.cooldown = defaultBreakerCooldown
+	}
+	if cb.probes <= 0 {
+		cb.probes = defaultBreakerHalfOpenProbes
+	}
+	return cb
+}
+
+// State reports where the breaker stands.
+func (cb *circuitBreaker) State() breakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// ready reports whether Allow would let a request through now, without
+// taking a probe slot.
+func (cb *circuitBreaker) ready(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		return !now.Before(cb.openUntil)
+	case breakerHalfOpen:
+		return cb.probing < cb.probes
+	}
+	return true
+}
+
+// Allow reports whether a request may go to the upstream. Every request it
+// allows must be followed by Record or Release.
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerOpen {
+		if time.Now().Before(cb.openUntil) {
+			return false
+		}
+		cb.probing, cb.passed = 0, 0
+		cb.setState(breakerHalfOpen)
+	}
+	if cb.state == breakerHalfOpen {
+		if cb.probing >= cb.probes {
+			return false
+		}
+		cb.probing++
+	}
+	return true
+}
+
+// Record notes how an allowed request went.
+func (cb *circuitBreaker) Record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerHalfOpen:
+		cb.probing--
+		if failed {
+			cb.trip()
+			return
+		}
+		if cb.passed++; cb.passed >= cb.probes {
+			cb.reset()
+			cb.setState(breakerClosed)
+		}
+	case breakerClosed:
+		now := time.Now()
+		if now.Sub(cb.windowStart) >= cb.window {
+			cb.windowStart, cb.requests, cb.failed = now, 0, 0
+		}
+		cb.requests++
+		if !failed {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		cb.failed++
+		if cb.failures >= cb.consecutiveFailures ||
+			cb.errorRate > 0 && cb.requests >= cb.minRequests && float64(cb.failed) >= cb.errorRate*float64(cb.requests) {
+			cb.trip()
+		}
+	}
+}
+
+// Release gives back an allowed request that says nothing about the
+// upstream, such as one the client gave up on.
+func (cb *circuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerHalfOpen {
+		cb.probing--
+	}
+}
+
+func (cb *circuitBreaker) trip() {
+	cb.reset()
+	cb.openUntil = time.Now().Add(cb.cooldown)
+	cb.setState(breakerOpen)
+}
+
+func (cb *circuitBreaker) reset() {
+	cb.failures, cb.requests, cb.failed = 0, 0, 0
+	cb.windowStart = time.Now()
+}
+
+func (cb *circuitBreaker) setState(state breakerState) {
+	cb.state = state
+	if cb.onChange != nil {
+		cb.onChange(state)
+	}
+}
+
+// EnableCircuitBreakers puts a circuit breaker in front of each of the
+// balancer's backends. Its transport fails requests to a backend whose
+// circuit is open, and Pick avoids such backends while others are
+// available. Breaker state changes are logged and, if the balancer exports
+// metrics, exported.
+func (b *Balancer) EnableCircuitBreakers(c *CircuitBreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.breakerConfig = c
+	for _, backend := range b.backends {
+		b.addBreaker(backend)
+	}
+}
+
+// addBreaker gives backend a circuit breaker. b.mu must be held.
+func (b *Balancer) addBreaker(backend *Backend) {
+	entry := log.WithFields(log.Fields{"route": b.route, "upstream": backend.URL.Host})
+	upstream, metrics := backend.URL.Host, b.metrics
+	backend.breaker = newCircuitBreaker(b.breakerConfig, func(state breakerState) {
+		switch state {
+		case breakerOpen:
+			entry.WithField("circuit", state.String()).Warn("upstream circuit open, failing requests to it")
+		case breakerHalfOpen:
+			entry.WithField("circuit", state.String()).Info("upstream circuit half open, probing")
+		default:
+			entry.WithField("circuit", state.String()).Info("upstream circuit closed again")
+		}
+		if metrics != nil {
+			metrics.SetCircuitBreakerState(b.route, upstream, state)
+		}
+	})
+	if metrics != nil {
+		metrics.SetCircuitBreakerState(b.route, upstream, breakerClosed)
+	}
+}
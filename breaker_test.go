@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls, down int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&down) != 0 {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n"+
+		"    circuit_breaker: {consecutive_failures: 2, cooldown: 50ms, half_open_probes: 1}\n")
+	breaker := router.balancers["app"].Backends()[0].breaker
+
+	// get sends a request and reports its status and whether it reached the
+	// upstream.
+	get := func() (int, bool) {
+		before := atomic.LoadInt32(&calls)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/", nil))
+		return rec.Code, atomic.LoadInt32(&calls) != before
+	}
+	expect := func(step string, state breakerState) {
+		t.Helper()
+		if got := breaker.State(); got != state {
+			t.Fatalf("%s: circuit %s, want %s", step, got, state)
+		}
+	}
+
+	if status, _ := get(); status != http.StatusOK {
+		t.Fatalf("status = %d while healthy", status)
+	}
+	expect("healthy", breakerClosed)
+
+	atomic.StoreInt32(&down, 1)
+	get()
+	expect("one failure", breakerClosed)
+	get()
+	expect("two failures", breakerOpen)
+	if status, reached := get(); reached || status < 500 {
+		t.Errorf("open circuit answered %d, reached upstream = %v", status, reached)
+	}
+
+	// A failed probe opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	if _, reached := get(); !reached {
+		t.Error("no probe after the cooldown")
+	}
+	expect("failed probe", breakerOpen)
+
+	// A passing probe closes it.
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	if !breaker.Allow() {
+		t.Fatal("no probe allowed after the cooldown")
+	}
+	expect("probing", breakerHalfOpen)
+	breaker.Release()
+	if status, reached := get(); status != http.StatusOK || !reached {
+		t.Errorf("probe answered %d, reached upstream = %v", status, reached)
+	}
+	expect("passed probe", breakerClosed)
+}
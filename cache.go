@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for cache settings left unset.
+const (
+	defaultCacheTTL            = time.Minute
+	defaultCacheMaxObjectBytes = 1 << 20
+)
+
+// Statuses a response may be cached with, the ones RFC 9111 lets caches
+// store without explicit freshness, less 206 which we don't assemble.
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// A ResponseCache keeps a route's GET responses in memory and serves
+// repeats of a request from there while the response is fresh. Freshness
+// comes from the upstream's Cache-Control s-maxage or max-age, or Expires,
+// or failing those the route's TTL. Responses marked no-store, no-cache or
+// private, setting cookies or varying on everything aren't kept, and
+// requests with credentials (Authorization or cookies, which may carry an
+// auth session), asking for no-store or sending the bypass header skip the
+// cache. Vary is
+// honoured by keeping a variant per combination of varying headers. With
+// max_bytes set, the least recently used responses are evicted to stay
+// under it.
+type ResponseCache struct {
+	route          string
+	ttl            time.Duration
+	maxObjectBytes int64
+	maxBytes       int64
+	bypassHeader   string
+	bypassRefresh  bool
+	metrics        *Metrics
+
+	mu      sync.Mutex
+	entries map[string][]*cacheEntry // by request key, one per variant
+	lru     *list.List               // of *cacheEntry, most recent first
+	size    int64
+
+	hits, misses, bypasses, evictions int64
+}
+
+// CacheStats describe what a route's cache holds and how it has been used.
+type CacheStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes,omitempty"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Bypasses  int64 `json:"bypasses"`
+	Evictions int64 `json:"evictions"`
+}
+
+type cacheEntry struct {
+	key     string
+	vary    []string
+	varied  []string // the request's values for vary
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	element *list.Element
+}
+
+func NewResponseCache(route string, c *CacheConfig, metrics *Metrics) *ResponseCache {
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	maxObjectBytes := c.MaxObjectBytes
+	if maxObjectBytes <= 0 {
+		maxObjectBytes = defaultCacheMaxObjectBytes
+	}
+	return &ResponseCache{
+		route:          route,
+		ttl:            ttl,
+		maxObjectBytes: maxObjectBytes,
+		maxBytes:       c.MaxBytes,
+		bypassHeader:   c.BypassHeader,
+		bypassRefresh:  c.BypassRefresh,
+		metrics:        metrics,
+		entries:        make(map[string][]*cacheEntry),
+		lru:            list.New(),
+	}
+}
+
+// Wrap serves handler's responses from the cache when it can. Responses
+// say how they were served in X-Cache: HIT, MISS, or BYPASS when the
+// request skipped the cache.
+func (c *ResponseCache) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		noStore, noCache := cacheDirectives(r.Header)
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+			r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" || noStore ||
+			isStreamRequest(r) {
+			c.count("bypass", &c.bypasses)
+			rw.Header().Set("X-Cache", "BYPASS")
+			handler.ServeHTTP(rw, r)
+			return
+		}
+
+		key := r.Host + " " + r.URL.RequestURI()
+		bypass := c.bypassed(r)
+		switch {
+		case bypass && !c.bypassRefresh:
+			c.count("bypass", &c.bypasses)
+			rw.Header().Set("X-Cache", "BYPASS")
+			handler.ServeHTTP(rw, r)
+			return
+		case bypass || noCache:
+			// Fetched afresh, and the cached copy replaced.
+			c.count("bypass", &c.bypasses)
+			rw.Header().Set("X-Cache", "BYPASS")
+		default:
+			if entry := c.lookup(key, r); entry != nil {
+				c.count("hit", &c.hits)
+				entry.writeTo(rw, r)
+				return
+			}
+			c.count("miss", &c.misses)
+			rw.Header().Set("X-Cache", "MISS")
+		}
+		if r.Method == http.MethodHead {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+		capture := &cacheCapture{ResponseWriter: rw, limit: c.maxObjectBytes}
+		handler.ServeHTTP(capture, r)
+		if capture.status != 0 && !capture.tooLarge {
+			c.store(key, r, capture.status, rw.Header(), capture.body.Bytes())
+		}
+	})
+}
+
+// bypassed reports whether r asks to skip the cache with the bypass header.
+func (c *ResponseCache) bypassed(r *http.Request) bool {
+	if c.bypassHeader == "" {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get(c.bypassHeader))) {
+	case "", "0", "false":
+		return false
+	}
+	return true
+}
+
+func (c *ResponseCache) count(result string, counter *int64) {
+	atomic.AddInt64(counter, 1)
+	if c.metrics != nil {
+		c.metrics.CacheResult(c.route, result)
+	}
+}
+
+func (c *ResponseCache) lookup(key string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, entry := range c.entries[key] {
+		if !entry.matches(r) {
+			continue
+		}
+		if now.After(entry.expires) {
+			c.remove(entry)
+			c.exportSize()
+			return nil
+		}
+		c.lru.MoveToFront(entry.element)
+		return entry
+	}
+	return nil
+}
+
+func (c *ResponseCache) store(key string, r *http.Request, status int, header http.Header, body []byte) {
+	if !cacheableStatuses[status] || header.Get("Set-Cookie") != "" {
+		return
+	}
+	if noStore, noCache := cacheDirectives(header); noStore || noCache || hasCacheDirective(header, "private") {
+		return
+	}
+	var vary []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+	now := time.Now()
+	lifetime, ok := freshnessLifetime(header, now)
+	if !ok {
+		lifetime = c.ttl
+	}
+	if lifetime <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:     key,
+		vary:    vary,
+		status:  status,
+		header:  header.Clone(),
+		body:    append([]byte(nil), body...),
+		stored:  now,
+		expires: now.Add(lifetime),
+	}
+	entry.header.Del("X-Cache")
+	for _, name := range vary {
+		entry.varied = append(entry.varied, strings.Join(r.Header.Values(name), ","))
+	}
+	size := int64(len(entry.body))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, existing := range c.entries[key] {
+		if existing.matches(r) {
+			c.remove(existing)
+			break
+		}
+	}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[key] = append(c.entries[key], entry)
+	c.size += size
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+		c.evictions++
+		if c.metrics != nil {
+			c.metrics.CacheEviction(c.route)
+		}
+	}
+	c.exportSize()
+}
+
+// Stats reports the cache's current contents and counters.
+func (c *ResponseCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:   c.lru.Len(),
+		Bytes:     c.size,
+		MaxBytes:  c.maxBytes,
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Bypasses:  atomic.LoadInt64(&c.bypasses),
+		Evictions: c.evictions,
+	}
+}
+
+// exportSize updates the cache's size metrics. c.mu must be held.
+func (c *ResponseCache) exportSize() {
+	if c.metrics != nil {
+		c.metrics.SetCacheSize(c.route, c.lru.Len(), c.size)
+	}
+}
+
+// remove drops entry from the cache. c.mu must be held.
+func (c *ResponseCache) remove(entry *cacheEntry) {
+	c.lru.Remove(entry.element)
+	c.size -= int64(len(entry.body))
+	variants := c.entries[entry.key]
+	for i, variant := range variants {
+		if variant == entry {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, entry.key)
+	} else {
+		c.entries[entry.key] = variants
+	}
+}
+
+// matches reports whether r would have got this variant from the upstream.
+func (entry *cacheEntry) matches(r *http.Request) bool {
+	for i, name := range entry.vary {
+		if strings.Join(r.Header.Values(name), ",") != entry.varied[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (entry *cacheEntry) writeTo(rw http.ResponseWriter, r *http.Request) {
+	header := rw.Header()
+	for k, v := range entry.header {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Set("X-Cache", "HIT")
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	rw.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		rw.Write(entry.body)
+	}
+}
+
+// freshnessLifetime is how long the upstream says its response may be
+// served from a shared cache, if it says.
+func freshnessLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	var maxAge, sMaxAge string
+	for _, directive := range cacheControl(header) {
+		name, value, _ := strings.Cut(directive, "=")
+		switch name {
+		case "max-age":
+			maxAge = value
+		case "s-maxage":
+			sMaxAge = value
+		}
+	}
+	for _, value := range []string{sMaxAge, maxAge} {
+		if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			// An invalid Expires means already expired.
+			return 0, true
+		}
+		date := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = d
+		}
+		return at.Sub(date), true
+	}
+	return 0, false
+}
+
+func cacheDirectives(header http.Header) (noStore, noCache bool) {
+	return hasCacheDirective(header, "no-store"), hasCacheDirective(header, "no-cache")
+}
+
+func hasCacheDirective(header http.Header, name string) bool {
+	for _, directive := range cacheControl(header) {
+		if directive == name || strings.HasPrefix(directive, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl splits a Cache-Control header into lowercased directives.
+func cacheControl(header http.Header) []string {
+	var directives []string
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			if directive = strings.ToLower(strings.TrimSpace(directive)); directive != "" {
+				directives = append(directives, directive)
+			}
+		}
+	}
+	return directives
+}
+
+// cacheCapture passes a response through while keeping a copy of it, up to
+// limit bytes, for the cache.
+type cacheCapture struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	limit    int64
+	tooLarge bool
+}
+
+func (w *cacheCapture) WriteHeader(statusCode int) {
+	if w.status == 0 && statusCode >= 200 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *cacheCapture) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.tooLarge {
+		if int64(w.body.Len()+len(data)) > w.limit {
+			w.tooLarge = true
+			w.body.Reset()
+		} else {
+			w.body.Write(data)
+		}
+	}
+	n, err := w.ResponseWriter.Write(data)
+	if err != nil {
+		// The copy is incomplete.
+		w.tooLarge = true
+	}
+	return n, err
+}
+
+func (w *cacheCapture) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
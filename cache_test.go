@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newCacheTestUpstream answers each path with four bytes: the path's last
+// letter repeated, or for /vary/ paths the Accept-Language it varies on.
+func newCacheTestUpstream(t *testing.T, calls *int32) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if strings.HasPrefix(r.URL.Path, "/vary/") {
+			rw.Header().Set("Vary", "Accept-Language")
+			rw.Write([]byte(r.Header.Get("Accept-Language") + "--"))
+			return
+		}
+		rw.Write([]byte(strings.Repeat(r.URL.Path[len(r.URL.Path)-1:], 4)))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestResponseCache(t *testing.T) {
+	var calls int32
+	upstream := newCacheTestUpstream(t, &calls)
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    cache: {bypass_header: X-Cache-Bypass}\n")
+
+	steps := []struct {
+		path   string
+		header map[string]string
+		xCache string
+		body   string
+		called bool
+	}{
+		{"/app/a", nil, "MISS", "aaaa", true},
+		{"/app/a", nil, "HIT", "aaaa", false},
+		{"/app/a", map[string]string{"Authorization": "Bearer x"}, "BYPASS", "aaaa", true},
+		{"/app/a", map[string]string{"Cookie": "session=x"}, "BYPASS", "aaaa", true},
+		{"/app/a", map[string]string{"X-Cache-Bypass": "1"}, "BYPASS", "aaaa", true},
+		{"/app/a", map[string]string{"X-Cache-Bypass": "0"}, "HIT", "aaaa", false},
+		{"/app/vary/x", map[string]string{"Accept-Language": "en"}, "MISS", "en--", true},
+		{"/app/vary/x", map[string]string{"Accept-Language": "de"}, "MISS", "de--", true},
+		{"/app/vary/x", map[string]string{"Accept-Language": "en"}, "HIT", "en--", false},
+		{"/app/vary/x", map[string]string{"Accept-Language": "de"}, "HIT", "de--", false},
+	}
+	for i, step := range steps {
+		before := atomic.LoadInt32(&calls)
+		req := httptest.NewRequest("GET", step.path, nil)
+		for k, v := range step.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-Cache"); got != step.xCache {
+			t.Errorf("step %d: X-Cache = %q, want %s", i, got, step.xCache)
+		}
+		if got := rec.Body.String(); got != step.body {
+			t.Errorf("step %d: body = %q, want %q", i, got, step.body)
+		}
+		if called := atomic.LoadInt32(&calls) != before; called != step.called {
+			t.Errorf("step %d: upstream called = %v, want %v", i, called, step.called)
+		}
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var calls int32
+	upstream := newCacheTestUpstream(t, &calls)
+	// Room for two four-byte bodies.
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    cache: {max_bytes: 10}\n")
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Header().Get("X-Cache")
+	}
+
+	get("/app/a")
+	get("/app/b")
+	get("/app/a") // a is now the most recently used
+	get("/app/c") // evicts b
+	for _, check := range []struct{ path, want string }{{"/app/a", "HIT"}, {"/app/c", "HIT"}, {"/app/b", "MISS"}} {
+		if got := get(check.path); got != check.want {
+			t.Errorf("%s: X-Cache = %s, want %s", check.path, got, check.want)
+		}
+	}
+	if stats := router.caches["app"].Response.Stats(); stats.Evictions == 0 || stats.Bytes > 10 {
+		t.Errorf("stats = %+v, want an eviction and at most 10 bytes", stats)
+	}
+}
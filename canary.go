@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SplitByVersion turns the balancer's backends into the versions of a
+// canary: PickFor sends each request to a version chosen by weight, unless
+// the request names one in c.Header or c.Cookie.
+func (b *Balancer) SplitByVersion(c *CanaryConfig) error {
+	total := 0
+	names := make(map[string]bool)
+	for _, version := range c.Versions {
+		if version.Name == "" || version.Upstream == "" {
+			return errors.New("canary versions need a name and an upstream")
+		}
+		if names[version.Name] {
+			return fmt.Errorf("canary version %s listed twice", version.Name)
+		}
+		names[version.Name] = true
+		if version.Weight < 0 {
+			return fmt.Errorf("canary version %s: weight can't be negative", version.Name)
+		}
+		total += version.Weight
+	}
+	if total == 0 {
+		return errors.New("canary weights add up to zero")
+	}
+	if len(b.byHost) != len(c.Versions) {
+		return errors.New("canary versions need upstreams on different hosts")
+	}
+
+	for i, version := range c.Versions {
+		b.backends[i].version = version.Name
+		b.backends[i].weight = version.Weight
+	}
+	b.canary = c
+	b.versionCookie = c.Cookie
+	if b.versionCookie == "" && c.Sticky {
+		b.versionCookie = "canary_" + b.route
+	}
+	return nil
+}
+
+// PickFor chooses the backend for r. Without a canary or affinity it is
+// Pick.
+func (b *Balancer) PickFor(r *http.Request) *Backend {
+	if b.affinity != nil {
+		if backend := b.pinned(r); backend != nil {
+			return backend
+		}
+	}
+	if b.canary == nil {
+		return b.Pick()
+	}
+	if backend := b.requestedVersion(r); backend != nil {
+		return backend
+	}
+
+	now := time.Now()
+	var candidates []*Backend
+	for _, backend := range b.backends {
+		if backend.Healthy() && backend.available(now) && backend.weight > 0 {
+			candidates = append(candidates, backend)
+		}
+	}
+	if len(candidates) == 0 {
+		return b.Pick()
+	}
+	return b.pickWeighted(candidates)
+}
+
+// requestedVersion returns the backend of the version r asks for by header
+// or cookie, if it names one that exists.
+func (b *Balancer) requestedVersion(r *http.Request) *Backend {
+	if b.canary.Header != "" {
+		if backend := b.version(r.Header.Get(b.canary.Header)); backend != nil {
+			return backend
+		}
+	}
+	if b.versionCookie != "" {
+		if cookie, err := r.Cookie(b.versionCookie); err == nil {
+			return b.version(cookie.Value)
+		}
+	}
+	return nil
+}
+
+func (b *Balancer) version(name string) *Backend {
+	if name == "" {
+		return nil
+	}
+	for _, backend := range b.backends {
+		if backend.version == name {
+			return backend
+		}
+	}
+	return nil
+}
+
+// NewCanaryCookieModifier keeps clients on the version they were assigned:
+// responses from a version the client's cookie doesn't name set it to that
+// version. Requests that picked their version by header are left alone.
+func NewCanaryCookieModifier(b *Balancer) ResponseModifier {
+	return func(res *http.Response) error {
+		backend, ok := b.byHost[res.Request.URL.Host]
+		if !ok || backend.version == "" {
+			return nil
+		}
+		if b.canary.Header != "" && b.version(res.Request.Header.Get(b.canary.Header)) != nil {
+			return nil
+		}
+		if cookie, err := res.Request.Cookie(b.versionCookie); err == nil && cookie.Value == backend.version {
+			return nil
+		}
+		res.Header.Add("Set-Cookie", (&http.Cookie{
+			Name:     b.versionCookie,
+			Value:    backend.version,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}).String())
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newVersionUpstream(t *testing.T, version string) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, version)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestCanary(t *testing.T) {
+	v1, v2, v3 := newVersionUpstream(t, "v1"), newVersionUpstream(t, "v2"), newVersionUpstream(t, "v3")
+	router := newTestRouter(t, "routes:\n  app:\n    canary:\n      header: X-Canary\n      sticky: true\n      versions:\n"+
+		"        - {name: v1, upstream: "+v1.URL+", weight: 3}\n"+
+		"        - {name: v2, upstream: "+v2.URL+", weight: 1}\n"+
+		"        - {name: v3, upstream: "+v3.URL+", weight: 0}\n")
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/app/", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("weights", func(t *testing.T) {
+		counts := make(map[string]int)
+		for i := 0; i < 400; i++ {
+			rec := get(nil)
+			counts[rec.Body.String()]++
+			if want := "canary_app=" + rec.Body.String() + ";"; !strings.HasPrefix(rec.Header().Get("Set-Cookie"), want) {
+				t.Fatalf("Set-Cookie = %q, want %s", rec.Header().Get("Set-Cookie"), want)
+			}
+		}
+		// 3:1, with plenty of slack for the random split.
+		if counts["v1"] < 250 || counts["v2"] < 50 || counts["v3"] != 0 {
+			t.Errorf("split = %v, want about 300 v1, 100 v2 and no v3", counts)
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			rec := get(map[string]string{"X-Canary": "v3"})
+			if got := rec.Body.String(); got != "v3" {
+				t.Fatalf("X-Canary: v3 answered by %s", got)
+			}
+			if got := rec.Header().Get("Set-Cookie"); got != "" {
+				t.Fatalf("version picked by header set cookie %q", got)
+			}
+		}
+	})
+
+	t.Run("sticky", func(t *testing.T) {
+		for _, version := range []string{"v1", "v2", "v3"} {
+			for i := 0; i < 10; i++ {
+				rec := get(map[string]string{"Cookie": "canary_app=" + version})
+				if got := rec.Body.String(); got != version {
+					t.Fatalf("cookie %s answered by %s", version, got)
+				}
+				if got := rec.Header().Get("Set-Cookie"); got != "" {
+					t.Fatalf("cookie %s set again: %q", version, got)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A Middleware wraps a handler with one layer of behavior.
+type Middleware func(http.Handler) http.Handler
+
+// DefaultMiddlewareOrder is the handler chain from outermost to innermost.
+// Some of the ordering matters:
+//
+//   - cors answers preflights itself, so anything after it never sees them
+//     (preflights aren't logged by default).
+//   - error_pages comes after cors, so error pages still carry the CORS
+//     headers and browsers let scripts read them. Rejections cors writes
+//     itself (reject_status) don't get the custom pages.
+//   - tracing comes before request_id so requests without an ID can be
+//     given their trace ID.
+//   - request_id and correlation have to come before logging for generated
+//     IDs to be logged.
+//   - logging attaches the RequestInfo that metrics, inflight and the proxy
+//     use, so it has to come before them.
+//   - cache and single_flight share one response between callers, so checks
+//     that depend on the individual caller (client_cert, auth) belong before
+//     them.
+//   - options comes before auth: like CORS preflights, plain OPTIONS
+//     requests carry no credentials, and the answer says nothing about the
+//     route's content.
+//   - compress comes before cache, so the cache keeps bodies as the
+//     upstream sent them and each client gets one encoded its own way. The
+//     other way round the cache would store compressed bodies, told apart
+//     only by Vary: Accept-Encoding, one copy per header value clients send.
+var DefaultMiddlewareOrder = []string{
+	"cors",
+	"tracing",
+	"request_id",
+	"error_pages",
+	"correlation",
+	"logging",
+	"metrics",
+	"access",
+	"load_shed",
+	"rate_limit",
+	"readiness",
+	"inflight",
+	"max_request_bytes",
+	"body_log",
+	"long_lived",
+	"ws_idle_timeout",
+	"require_tls",
+	"client_cert",
+	"options",
+	"auth",
+	"strict_methods",
+	"compress",
+	"cache",
+	"single_flight",
+	"content_type",
+	"encoded_slashes",
+	"timeout",
+	"head_as_get",
+}
+
+// resolveMiddlewareOrder applies the configured order. Listed middleware run
+// first, in the given order; anything left out keeps its default relative
+// position after them.
+func resolveMiddlewareOrder(configured []string) ([]string, error) {
+	known := make(map[string]bool)
+	for _, name := range DefaultMiddlewareOrder {
+		known[name] = true
+	}
+
+	var order []string
+	seen := make(map[string]bool)
+	for _, name := range configured {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown middleware %q in middleware_order (valid: %s)", name, strings.Join(DefaultMiddlewareOrder, ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("middleware %q listed twice in middleware_order", name)
+		}
+		seen[name] = true
+		order = append(order, name)
+	}
+	for _, name := range DefaultMiddlewareOrder {
+		if !seen[name] {
+			order = append(order, name)
+		}
+	}
+	return order, nil
+}
+
+// MiddlewareSet builds the handler chain for each route from the shared
+// state the middleware need.
+type MiddlewareSet struct {
+	order      []string
+	config     *Config
+	requestID  RequestIDGenerator
+	tracing    *Tracing
+	errorPages *ErrorPages
+	cors       Middleware
+	loadShed   *LoadShedder
+	metrics    *Metrics
+	rateLimit  *RateLimiter
+	// Shared by every route's retries.
+	retryBudget *RetryBudget
+	longLived   *LongLivedTracker
+	inFlight    *InFlightTracker
+}
+
+func NewMiddlewareSet(config *Config, longLived *LongLivedTracker, inFlight *InFlightTracker) (*MiddlewareSet, error) {
+	order, err := resolveMiddlewareOrder(config.MiddlewareOrder)
+	if err != nil {
+		return nil, err
+	}
+	requestIDFormat := config.RequestIDFormat
+	if requestIDFormat == "" && !config.GenerateRequestIDs {
+		requestIDFormat = "none"
+	}
+	requestID, err := NewRequestIDGenerator(requestIDFormat, config.RequestIDPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCORSConfig(config.CORS); err != nil {
+		return nil, fmt.Errorf("cors: %v", err)
+	}
+	var tracing *Tracing
+	if config.Tracing != nil {
+		tracing, err = NewTracing(config.Tracing, config.GenerateRequestIDs && config.RequestIDFormat == "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	errorPages, err := NewErrorPages(config.ErrorPages, nil)
+	if err != nil {
+		return nil, err
+	}
+	var loadShed *LoadShedder
+	if config.LoadShed != nil {
+		loadShed = NewLoadShedder(config.LoadShed)
+	}
+	var rateLimit *RateLimiter
+	if config.RateLimit != nil {
+		if config.RateLimit.Rate <= 0 {
+			return nil, errors.New("rate_limit: rate must be positive")
+		}
+		rateLimit = NewRateLimiter(config.RateLimit, config.TrustedProxies)
+	}
+	var metrics *Metrics
+	if config.Metrics != nil {
+		metrics = NewMetrics(config.Metrics.MaxSeries)
+	}
+	var retryBudget *RetryBudget
+	if config.RetryBudget != nil {
+		if retryBudget, err = NewRetryBudget(config.RetryBudget, metrics); err != nil {
+			return nil, err
+		}
+	}
+	return &MiddlewareSet{
+		order:       order,
+		config:      config,
+		requestID:   requestID,
+		tracing:     tracing,
+		errorPages:  errorPages,
+		cors:        NewCORSMiddleware(config.CORS),
+		loadShed:    loadShed,
+		metrics:     metrics,
+		rateLimit:   rateLimit,
+		retryBudget: retryBudget,
+		longLived:   longLived,
+		inFlight:    inFlight,
+	}, nil
+}
+
+// RouteCaches are a route's response cache and single-flight group, if it
+// has them. They are made per router, so a reload starts them afresh, and
+// kept by the Router for the admin listener to report on.
+type RouteCaches struct {
+	Response     *ResponseCache
+	SingleFlight *SingleFlight
+}
+
+// NewRouteCaches makes the caches route is configured with, or returns nil
+// if it has none.
+func (m *MiddlewareSet) NewRouteCaches(name string, route *Route) *RouteCaches {
+	if route.Cache == nil && !route.SingleFlight {
+		return nil
+	}
+	caches := &RouteCaches{}
+	if route.Cache != nil {
+		caches.Response = NewResponseCache(name, route.Cache, m.metrics)
+	}
+	if route.SingleFlight {
+		caches.SingleFlight = NewSingleFlight(name, m.metrics)
+	}
+	return caches
+}
+
+// Chain wraps handler with every middleware enabled for the route. caches
+// are the route's from NewRouteCaches.
+func (m *MiddlewareSet) Chain(name string, route *Route, caches *RouteCaches, handler http.Handler) http.Handler {
+	for i := len(m.order) - 1; i >= 0; i-- {
+		if mw := m.forRoute(m.order[i], name, route, caches); mw != nil {
+			handler = mw(handler)
+		}
+	}
+	return handler
+}
+
+// forRoute returns the named middleware, or nil if the route doesn't use it.
+func (m *MiddlewareSet) forRoute(middleware, name string, route *Route, caches *RouteCaches) Middleware {
+	switch middleware {
+	case "cors":
+		if route.CORS != nil {
+			return NewCORSMiddleware(mergeCORSConfig(m.config.CORS, route.CORS))
+		}
+		return m.cors
+	case "tracing":
+		if m.tracing != nil {
+			return func(h http.Handler) http.Handler {
+				return m.tracing.Wrap(name, h)
+			}
+		}
+	case "request_id":
+		if m.requestID != nil {
+			return func(h http.Handler) http.Handler {
+				return NewRequestIDHandler(m.requestID, m.config.RequestIDTrailer, h)
+			}
+		}
+	case "error_pages":
+		pages := m.errorPages
+		if route.ErrorPages != nil {
+			// Checked by buildRouter.
+			pages, _ = NewErrorPages(m.config.ErrorPages, route.ErrorPages)
+		}
+		if pages != nil {
+			return pages.Wrap
+		}
+	case "correlation":
+		if m.config.GenerateCorrelationIDs && len(m.config.CorrelationHeaders) > 0 {
+			return func(h http.Handler) http.Handler {
+				return NewCorrelationHandler(m.config.CorrelationHeaders, h)
+			}
+		}
+	case "logging":
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(NewLogrusHandler(m.config, route.LogLevel.Level(), h.ServeHTTP))
+		}
+	case "metrics":
+		if m.metrics != nil {
+			return func(h http.Handler) http.Handler {
+				return m.metrics.Wrap(name, h)
+			}
+		}
+	case "access":
+		if route.Access != nil {
+			return func(h http.Handler) http.Handler {
+				return NewAccessHandler(name, route.Access, m.config.TrustedProxies, h)
+			}
+		}
+	case "load_shed":
+		if m.loadShed != nil {
+			return m.loadShed.Wrap
+		}
+	case "rate_limit":
+		var limiters []*RateLimiter
+		if m.rateLimit != nil {
+			limiters = append(limiters, m.rateLimit)
+		}
+		if route.RateLimit != nil {
+			limiters = append(limiters, NewRateLimiter(route.RateLimit, m.config.TrustedProxies))
+		}
+		if len(limiters) > 0 {
+			return func(h http.Handler) http.Handler {
+				for _, limiter := range limiters {
+					h = limiter.Wrap(h)
+				}
+				return h
+			}
+		}
+	case "readiness":
+		if m.config.WaitForUpstreams {
+			return NewReadinessGate(name, route.upstreamURLs()).Wrap
+		}
+	case "inflight":
+		return func(h http.Handler) http.Handler {
+			return m.inFlight.Wrap(name, h)
+		}
+	case "max_request_bytes":
+		limit := m.config.MaxRequestBytes
+		if route.MaxRequestBytes != 0 {
+			limit = route.MaxRequestBytes
+		}
+		if limit > 0 || route.MaxDecompressedRequestBytes > 0 {
+			return func(h http.Handler) http.Handler {
+				return NewMaxRequestBytesHandler(limit, route.MaxDecompressedRequestBytes, h)
+			}
+		}
+	case "body_log":
+		if route.DebugLogBodies != nil {
+			return func(h http.Handler) http.Handler {
+				return NewBodyLogHandler(name, route.DebugLogBodies, h)
+			}
+		}
+	case "long_lived":
+		if route.LongLived {
+			return m.longLived.Wrap
+		}
+	case "ws_idle_timeout":
+		if route.WSIdleTimeout > 0 {
+			return func(h http.Handler) http.Handler {
+				return NewWebsocketIdleTimeoutHandler(route.WSIdleTimeout, h)
+			}
+		}
+	case "require_tls":
+		if route.RequireTLS != "" {
+			var httpsPort string
+			if m.config.TLS != nil {
+				_, httpsPort, _ = net.SplitHostPort(m.config.TLS.Listen)
+			}
+			return func(h http.Handler) http.Handler {
+				return NewRequireTLSHandler(route.RequireTLS, m.config.TrustedProxies, httpsPort, h)
+			}
+		}
+	case "client_cert":
+		if route.RequireClientCert {
+			return NewClientCertHandler
+		}
+	case "auth":
+		if route.Auth != nil {
+			return NewAuthenticator(name, route.Auth, route.AuthFailMode, m.config.TrustedProxies).Wrap
+		}
+	case "strict_methods":
+		if route.MethodHandling == "strict" {
+			return NewStrictMethodHandler
+		}
+	case "compress":
+		if route.Compress != nil {
+			return func(h http.Handler) http.Handler {
+				return NewCompressHandler(route.Compress, h)
+			}
+		}
+	case "cache":
+		if caches != nil && caches.Response != nil {
+			return caches.Response.Wrap
+		}
+	case "single_flight":
+		if caches != nil && caches.SingleFlight != nil {
+			return caches.SingleFlight.Wrap
+		}
+	case "options":
+		if route.HandleOptions {
+			return NewOptionsHandler(route)
+		}
+	case "timeout":
+		var override *TimeoutOverride
+		if m.config.TrustedTimeoutHeader != "" && route.TrustedMaxTimeout > 0 {
+			override = &TimeoutOverride{
+				Header:  m.config.TrustedTimeoutHeader,
+				Clients: m.config.TrustedTimeoutClients,
+				Ceiling: route.TrustedMaxTimeout,
+			}
+		}
+		if route.Timeout > 0 || route.MaxTimeout > 0 || m.config.DeadlineHeader != "" || override != nil {
+			return func(h http.Handler) http.Handler {
+				return NewTimeoutHandler(m.config.DeadlineHeader, route.Timeout, route.MaxTimeout, override, h)
+			}
+		}
+	case "head_as_get":
+		if route.HeadAsGet {
+			return NewHeadAsGetHandler
+		}
+	case "encoded_slashes":
+		if route.EncodedSlashes == "reject" {
+			return NewEncodedSlashHandler
+		}
+	case "content_type":
+		if len(route.AcceptContentTypes) > 0 {
+			return func(h http.Handler) http.Handler {
+				return NewContentTypeHandler(route.AcceptContentTypes, h)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Defaults for compress settings left unset.
+const defaultCompressMinBytes = 1024
+
+var (
+	defaultCompressEncodings    = []string{"br", "gzip"}
+	defaultCompressContentTypes = []string{
+		"text/*",
+		"application/javascript",
+		"application/json",
+		"application/xml",
+		"application/wasm",
+		"image/svg+xml",
+		"*/*+json",
+		"*/*+xml",
+	}
+)
+
+// compressLevels are the levels each encoding accepts, and the one used
+// when the config doesn't say. Brotli's higher levels are too slow to run on
+// every response.
+var compressLevels = map[string]struct{ min, max, def int }{
+	"br":   {brotli.BestSpeed, brotli.BestCompression, 4},
+	"gzip": {gzip.BestSpeed, gzip.BestCompression, 6},
+}
+
+// NewCompressHandler compresses responses on the fly with the best of the
+// configured encodings the client accepts. Only responses of the listed
+// content types and at least min_bytes long are compressed; ones the
+// upstream already encoded, partial content and anything marked
+// no-transform go out as they are.
+func NewCompressHandler(c *CompressConfig, handler http.Handler) http.Handler {
+	encodings := c.Encodings
+	if len(encodings) == 0 {
+		encodings = defaultCompressEncodings
+	}
+	contentTypes := c.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = defaultCompressContentTypes
+	}
+	minBytes := c.MinBytes
+	if minBytes <= 0 {
+		minBytes = defaultCompressMinBytes
+	}
+	brotliLevel, gzipLevel := compressLevels["br"].def, compressLevels["gzip"].def
+	if level, ok := c.Level["br"]; ok {
+		brotliLevel = level
+	}
+	if level, ok := c.Level["gzip"]; ok {
+		gzipLevel = level
+	}
+	// Writers are pooled per handler as a gzip.Writer's level is fixed
+	// when it's made.
+	gzipWriters := &sync.Pool{
+		New: func() interface{} {
+			gz, _ := gzip.NewWriterLevel(nil, gzipLevel)
+			return gz
+		},
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || isUpgradeRequest(r) {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: rw,
+			encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding"), encodings),
+			contentTypes:   contentTypes,
+			minBytes:       minBytes,
+			brotliLevel:    brotliLevel,
+			gzipWriters:    gzipWriters,
+		}
+		defer cw.finish()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the offered encoding the client prefers, ties
+// going to the first offered. It returns "" if the client accepts none.
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		qualities[coding] = q
+	}
+
+	var best string
+	var bestQ float64
+	for _, encoding := range offered {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// matchContentType reports whether contentType is one of patterns, which
+// may use * for the type, the subtype or a structured syntax suffix's
+// subtype (*/*+json).
+func matchContentType(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	for _, pattern := range patterns {
+		patternType, patternSubtype, _ := strings.Cut(strings.ToLower(pattern), "/")
+		if patternType != "*" && patternType != typ {
+			continue
+		}
+		switch {
+		case patternSubtype == "*" || patternSubtype == subtype:
+			return true
+		case strings.HasPrefix(patternSubtype, "*+") && strings.HasSuffix(subtype, patternSubtype[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// to compress it: right away when it is ineligible or declares its length,
+// otherwise once min bytes have been written, the handler flushes or the
+// handler returns.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding     string
+	contentTypes []string
+	minBytes     int
+	brotliLevel  int
+	gzipWriters  *sync.Pool
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buffered    []byte
+	encoder     io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(statusCode int) {
+	if statusCode < 200 {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.status, w.wroteHeader = statusCode, true
+
+	if !w.eligible() {
+		w.decide(false)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if w.encoding == "" {
+		w.decide(false)
+		return
+	}
+	if length, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+		w.decide(length >= w.minBytes)
+	}
+}
+
+// eligible reports whether the response could be compressed for a client
+// that accepts it.
+func (w *compressWriter) eligible() bool {
+	header := w.Header()
+	switch {
+	case w.status == http.StatusNoContent || w.status == http.StatusNotModified || w.status == http.StatusPartialContent:
+		return false
+	case header.Get("Content-Encoding") != "" && !strings.EqualFold(header.Get("Content-Encoding"), "identity"):
+		return false
+	case hasCacheDirective(header, "no-transform"):
+		return false
+	}
+	return matchContentType(header.Get("Content-Type"), w.contentTypes)
+}
+
+func (w *compressWriter) decide(compress bool) {
+	w.decided = true
+	if compress {
+		header := w.Header()
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		// The compressed body isn't byte for byte what a strong ETag
+		// promises.
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		switch w.encoding {
+		case "br":
+			w.encoder = brotli.NewWriterLevel(w.ResponseWriter, w.brotliLevel)
+		case "gzip":
+			gz := w.gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(w.ResponseWriter)
+			w.encoder = gz
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buffered) > 0 {
+		buffered := w.buffered
+		w.buffered = nil
+		w.write(buffered)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buffered = append(w.buffered, data...)
+		if len(w.buffered) >= w.minBytes {
+			w.decide(true)
+		}
+		return len(data), nil
+	}
+	return w.write(data)
+}
+
+func (w *compressWriter) write(data []byte) (int, error) {
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush sends what has been written so far, compressed if the response is
+// being compressed, for streaming responses.
+func (w *compressWriter) Flush() {
+	if w.wroteHeader && !w.decided {
+		w.decide(true)
+	}
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// finish settles a response the handler is done with: one still held back
+// was too short to compress, and an encoder has its last bytes to write.
+func (w *compressWriter) finish() {
+	if w.wroteHeader && !w.decided {
+		w.decide(false)
+	}
+	if w.encoder == nil {
+		return
+	}
+	w.encoder.Close()
+	if gz, ok := w.encoder.(*gzip.Writer); ok {
+		gz.Reset(nil)
+		w.gzipWriters.Put(gz)
+	}
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressPassesThroughEncodedResponse(t *testing.T) {
+	text := strings.Repeat("already compressed upstream ", 100)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	io.WriteString(gz, text)
+	gz.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Write(gzipped.Bytes())
+	}))
+	defer upstream.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    compress: {}\n")
+
+	for _, acceptEncoding := range []string{"gzip", "br", "br, gzip"} {
+		t.Run(acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/app/file.txt", nil)
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Errorf("Content-Encoding = %q, want gzip", got)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), gzipped.Bytes()) {
+				t.Fatalf("body was changed: got %d bytes, upstream sent %d", rec.Body.Len(), gzipped.Len())
+			}
+			gr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(gr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != text {
+				t.Error("body doesn't decompress to what the upstream compressed")
+			}
+		})
+	}
+}
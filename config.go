@@ -0,0 +1,1265 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type Config struct {
+	Routes map[string]*Route
+
+	// Mount the whole frontend under this path (e.g. /gateway) when it sits
+	// behind a shared ingress. It is stripped along with each route's own
+	// prefix before forwarding. healthz_path and the admin and metrics
+	// listeners' paths are under it too.
+	BasePath string `yaml:"base_path"`
+
+	// Disable HTTP keep-alives on the frontend listener so every request
+	// gets a fresh connection. Useful behind connection-pooling balancers.
+	DisableKeepAlives bool `yaml:"disable_keep_alives"`
+
+	// Limits on client connections. read_timeout bounds reading a whole
+	// request, headers and body; write_timeout bounds the time from the
+	// end of the request headers to the end of the response; idle_timeout
+	// is how long a keep-alive connection may wait for its next request
+	// (defaults to read_timeout). Unset means no limit. Websocket, SSE and
+	// long_lived routes' requests are exempt from read_timeout and
+	// write_timeout.
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+
+	// Maximum size of request headers. Defaults to Go's 1MB.
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// Longest request target (path and query) to accept, in bytes; longer
+	// ones get a 414. Defaults to 8KB.
+	MaxURLLength int `yaml:"max_url_length"`
+	// Largest request body to accept, in bytes; larger ones get a 413.
+	// Routes can set their own. Unset means no limit.
+	MaxRequestBytes int64 `yaml:"max_request_bytes"`
+	// How long a client may take to send its request headers, against
+	// slowloris-style clients holding connections open. Defaults to
+	// read_timeout; unset, there is no limit.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+
+	// Cap on simultaneously open client connections per listener. Excess
+	// connections wait to be accepted. Zero means unlimited.
+	MaxConnections int `yaml:"max_connections"`
+	// Cap on open connections from a single client IP per listener; further
+	// ones are closed as soon as they are accepted. Connections from
+	// trusted_proxies aren't counted. Zero means unlimited.
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+
+	// Route paths as they arrive. By default requests whose path contains
+	// duplicate slashes or dot segments are redirected to the cleaned path
+	// first, so backends never see them.
+	PreserveRawPaths bool `yaml:"preserve_raw_paths"`
+
+	// Reject requests without a Host header with 400 before routing. If
+	// allowed_hosts is set (implies require_host), the Host must also be
+	// one of them; "*.example.com" matches any subdomain. healthz_path is
+	// exempt, for probes that address the IP.
+	RequireHost  bool     `yaml:"require_host"`
+	AllowedHosts []string `yaml:"allowed_hosts"`
+
+	// Log requests for these paths at debug rather than info level. Entries
+	// match exactly, or as a prefix when they end in "*" (e.g. "/healthz",
+	// "/static/*").
+	LogExcludePaths []string `yaml:"log_exclude_paths"`
+	// Also log the latency as a float number of milliseconds (latency_ms)
+	// for aggregators that can't parse Go duration strings.
+	LogLatencyMs bool `yaml:"log_latency_ms"`
+	// Where logs go: "stderr" (default), "stdout", "syslog" (configured
+	// by the syslog section) or the path of a file to append to.
+	LogOutput string        `yaml:"log_output"`
+	Syslog    *SyslogConfig `yaml:"syslog"`
+	// Rotate a log_output file by size instead of letting it grow.
+	LogRotate *LogRotateConfig `yaml:"log_rotate"`
+	// Least severe entries logged: debug, info (default), warn or error.
+	LogLevel string `yaml:"log_level"`
+	// "text" (default) or "json", one object per line.
+	LogFormat string `yaml:"log_format"`
+	// Add the request's User-Agent and Referer headers to access logs.
+	LogUserAgent bool `yaml:"log_user_agent"`
+	LogReferer   bool `yaml:"log_referer"`
+	// The fields access log entries have, in place of the default set:
+	// any of request, method, remote, status, text_status, latency,
+	// latency_ms, bytes, user_agent, referer, host, proto, request_id,
+	// upstream_instance, attempts, retried, edge_latency_ms, the
+	// correlation headers' fields and, with log_upstream_timings, the
+	// timing fields. Fields a request has no value for are left out.
+	LogFields []string `yaml:"log_fields"`
+	// Break upstream latency down in access logs: dns_ms, connect_ms,
+	// tls_ms and upstream_ttfb_ms (from asking for a connection to the
+	// first response byte). Off by default, since tracing every upstream
+	// call has a cost.
+	LogUpstreamTimings bool `yaml:"log_upstream_timings"`
+	// Header in which trusted_proxies pass the time they received the
+	// request, e.g. X-Request-Start. The time from then to our receiving it
+	// is logged as edge_latency_ms. Values may be Unix seconds, millis or
+	// micros, optionally prefixed with "t=".
+	RequestStartHeader string `yaml:"request_start_header"`
+
+	// Let clients set their own deadline for the upstream call through this
+	// header (e.g. X-Request-Timeout: 5s), bounded by each route's
+	// max_timeout.
+	DeadlineHeader string `yaml:"deadline_header"`
+	// A deadline header (e.g. X-Max-Timeout) honored only from
+	// trusted_timeout_clients, which may ask for up to a route's
+	// trusted_max_timeout. Routes without one ignore the header.
+	TrustedTimeoutHeader  string   `yaml:"trusted_timeout_header"`
+	TrustedTimeoutClients CIDRList `yaml:"trusted_timeout_clients"`
+
+	// Serve these well-known files from the frontend instead of proxying
+	// them. Unset, they are routed like any other path.
+	RobotsTxt *StaticContent `yaml:"robots_txt"`
+	Favicon   *StaticContent `yaml:"favicon"`
+
+	// How this proxy identifies itself in Via headers. Defaults to the
+	// hostname.
+	ProxyName string `yaml:"proxy_name"`
+
+	// Proxies (CIDRs or IPs) in front of the frontend whose forwarding
+	// headers, such as X-Forwarded-Proto, are believed.
+	TrustedProxies CIDRList `yaml:"trusted_proxies"`
+
+	// Give requests that arrive without an X-Request-Id one, forwarded
+	// upstream, logged and returned to the client. Off by default, so
+	// requests are passed through as they came; setting request_id_format
+	// turns it on too.
+	GenerateRequestIDs bool `yaml:"generate_request_ids"`
+	// How X-Request-Id is generated: "uuid" (default), "ulid", "prefix"
+	// (request_id_prefix followed by a counter) or "none" to leave requests
+	// without an ID. With tracing on and no format set, generated IDs are
+	// the request's trace ID instead.
+	RequestIDFormat string `yaml:"request_id_format"`
+	RequestIDPrefix string `yaml:"request_id_prefix"`
+	// Also send X-Request-Id as a trailer on streamed responses.
+	RequestIDTrailer bool `yaml:"request_id_trailer"`
+
+	// Further correlation headers (e.g. X-Correlation-Id) to log, each as
+	// its own field: X-Correlation-Id is logged as correlation_id. They
+	// are forwarded upstream like any header; with generate_correlation_ids
+	// set, requests missing one get a fresh UUID first.
+	CorrelationHeaders     []string `yaml:"correlation_headers"`
+	GenerateCorrelationIDs bool     `yaml:"generate_correlation_ids"`
+
+	// DNS server for resolving upstream hosts, for when the system
+	// resolver can't be changed. Unset, the system resolver is used.
+	Resolver *ResolverConfig `yaml:"resolver"`
+
+	// Also act as a forward proxy to an allowlist of destinations. Unset,
+	// absolute-form requests are routed like any other.
+	ForwardProxy *ForwardProxyConfig `yaml:"forward_proxy"`
+
+	// Templates for the frontend's own error responses, keyed by status
+	// ("502"), class ("5xx") or "default"; the most specific wins.
+	ErrorPages map[string]*ErrorPage `yaml:"error_pages"`
+
+	// CORS policy. Unset, any origin is allowed. Routes can override parts
+	// of it in their own cors section.
+	CORS *CORSConfig `yaml:"cors"`
+
+	// Export Prometheus metrics on a listener of their own.
+	Metrics *MetricsConfig `yaml:"metrics"`
+
+	// Trace requests with OpenTelemetry and export the spans over OTLP.
+	Tracing *TracingConfig `yaml:"tracing"`
+
+	// Serve the health of every route's upstreams as JSON at this path
+	// (e.g. /healthz), with a 503 while any route has no healthy upstream.
+	HealthzPath string `yaml:"healthz_path"`
+
+	// Limit the request rate of each client across all routes. Routes can
+	// set a rate_limit of their own on top.
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+
+	// Turn new requests away with a 503 while the process is overloaded.
+	// Off unless set.
+	LoadShed *LoadShedConfig `yaml:"load_shed"`
+
+	// Cap retries, over all routes, at a share of the requests of routes
+	// that retry, so retries can't pile onto an outage. Off unless set.
+	RetryBudget *RetryBudgetConfig `yaml:"retry_budget"`
+
+	// Methods routes with a retry policy retry besides GET and HEAD,
+	// unless a route lists its own in retry.idempotent_methods.
+	IdempotentMethods []string `yaml:"idempotent_methods"`
+
+	// Reorder the handler chain, outermost first. Middleware left out keep
+	// their default relative order after the listed ones; see
+	// DefaultMiddlewareOrder for the defaults and why they are ordered so.
+	MiddlewareOrder []string `yaml:"middleware_order"`
+
+	// Answer each route's requests with 503 until its upstream has accepted
+	// a connection, so a frontend starting ahead of its backends doesn't
+	// hand out 502s. The admin listener and well-known files are served
+	// regardless.
+	WaitForUpstreams bool `yaml:"wait_for_upstreams"`
+
+	// How long a route's first upstream discovery may take before the
+	// route is served without upstreams, answering no_healthy_status (503
+	// by default) until a later lookup finds some. Lookups are retried
+	// every second meanwhile. Unset, a lookup that fails or takes over 5s
+	// fails startup, or a reload.
+	DiscoveryStartupTimeout time.Duration `yaml:"discovery_startup_timeout"`
+
+	// How long to let in-flight requests finish once shutdown starts:
+	// shutdown_timeout (default 10s) after a SIGTERM, interrupt_timeout
+	// (default shutdown_timeout) after a SIGINT.
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout"`
+	InterruptTimeout time.Duration `yaml:"interrupt_timeout"`
+	// Keep some listeners (http, https or admin) up for a while after
+	// shutdown begins, e.g. {admin: 5s} to keep observing the drain of the
+	// public ones. Unlisted listeners stop straight away.
+	ShutdownDelays map[string]time.Duration `yaml:"shutdown_delays"`
+
+	// On SIGUSR2, start a new copy of the binary that inherits the
+	// listening sockets, then drain and exit once it is serving. Used for
+	// zero-downtime binary upgrades.
+	GracefulRestart bool `yaml:"graceful_restart"`
+	// Keep the PID of the serving process here, updated across restarts,
+	// so supervisors can follow it.
+	PIDFile string `yaml:"pid_file"`
+
+	// Address for plain HTTP. Defaults to :8080.
+	Listen string `yaml:"listen"`
+	// Also accept cleartext HTTP/2 (h2c, with prior knowledge, as gRPC
+	// clients use it) on the plain listener.
+	H2C bool `yaml:"h2c"`
+
+	// Serve TLS on an additional listener when set.
+	TLS *TLSConfig `yaml:"tls"`
+
+	// Serve admin and debugging endpoints on a separate listener when set.
+	Admin *AdminConfig `yaml:"admin"`
+}
+
+type AdminConfig struct {
+	// Address for the admin listener. Defaults to 127.0.0.1:9090 so the
+	// endpoints are not reachable from outside the host.
+	Listen string `yaml:"listen"`
+	// Only answer connections from these addresses or CIDR ranges.
+	AllowFrom CIDRList `yaml:"allow_from"`
+	// Exit if the admin listener can't bind its address. By default the
+	// error is logged and the proxy runs without it.
+	Strict bool `yaml:"strict"`
+	// Serve Go's profiling handlers under /admin/debug/pprof/.
+	Pprof bool `yaml:"pprof"`
+}
+
+type MetricsConfig struct {
+	// Address for the metrics listener. Defaults to 127.0.0.1:9100.
+	Listen string `yaml:"listen"`
+	// Path metrics are served at, under base_path. Defaults to /metrics.
+	Path string `yaml:"path"`
+	// Most label combinations each metric exports. Past it, new routes and
+	// upstreams are counted under "other", and gauges for them are
+	// dropped, with a warning. Defaults to 10000.
+	MaxSeries int `yaml:"max_series"`
+	// Exit if the metrics listener can't bind its address. By default the
+	// error is logged and the proxy runs without it.
+	Strict bool `yaml:"strict"`
+}
+
+// DiscoveryConfig says where a route's upstreams are looked up. The first
+// lookup happens when the route is loaded and has to find at least one
+// instance; later ones that fail or find none keep the upstreams found last.
+type DiscoveryConfig struct {
+	// "dns_srv" or "consul".
+	Type string `yaml:"type"`
+	// The SRV record (e.g. _http._tcp.api.example.com) or the Consul
+	// service name.
+	Name string `yaml:"name"`
+	// Scheme to reach the instances with: http (default) or https.
+	Scheme string `yaml:"scheme"`
+	// How often to look again. Defaults to 30s.
+	Interval time.Duration `yaml:"interval"`
+
+	// Consul agent to ask. Defaults to http://127.0.0.1:8500.
+	ConsulAddress string `yaml:"consul_address"`
+	ConsulToken   string `yaml:"consul_token"`
+	// Only instances with this tag, in this datacenter.
+	Tag        string `yaml:"tag"`
+	Datacenter string `yaml:"datacenter"`
+	// Also use instances failing their Consul health checks.
+	IncludeUnhealthy bool `yaml:"include_unhealthy"`
+}
+
+// AccessConfig limits a route to client addresses. The client address is
+// the connecting one, or behind trusted_proxies the one they forwarded.
+type AccessConfig struct {
+	// Only these CIDRs or IPs may use the route. Empty allows everyone
+	// not denied.
+	Allow CIDRList `yaml:"allow"`
+	// These may not, even when also allowed.
+	Deny CIDRList `yaml:"deny"`
+}
+
+type LogRotateConfig struct {
+	// Start a new file once the current one reaches this size. Defaults to
+	// 100.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// Rotated files to keep; unset keeps them all, subject to max_age.
+	MaxBackups int `yaml:"max_backups"`
+	// Delete rotated files older than this, rounded up to whole days.
+	// Unset keeps them regardless of age.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Gzip rotated files.
+	Compress bool `yaml:"compress"`
+}
+
+type TracingConfig struct {
+	// OTLP/HTTP collector address. Defaults to localhost:4318.
+	Endpoint string `yaml:"endpoint"`
+	// Export over plain HTTP rather than HTTPS.
+	Insecure bool `yaml:"insecure"`
+	// Headers sent with each export, e.g. a collector API key.
+	Headers map[string]string `yaml:"headers"`
+	// service.name spans are reported under. Defaults to frontend.
+	ServiceName string `yaml:"service_name"`
+	// Share of traces started here to sample, from 0 to 1 (default 1).
+	// Requests arriving with a trace follow its sampling decision.
+	SampleRate float64 `yaml:"sample_rate"`
+	// Trace context headers read from requests and sent upstream:
+	// tracecontext (W3C traceparent and baggage) and/or b3. Defaults to
+	// tracecontext.
+	Propagators []string `yaml:"propagators"`
+}
+
+// StaticContent is a small fixed response, given inline or loaded from a
+// file at startup.
+type StaticContent struct {
+	Content string `yaml:"content"`
+	File    string `yaml:"file"`
+	// Defaults to a type guessed from the file extension.
+	ContentType string `yaml:"content_type"`
+}
+
+// FallbackContent is a static page served in place of an error when a
+// route's upstream is down.
+type FallbackContent struct {
+	StaticContent `yaml:",inline"`
+	// Status to serve the page with. Defaults to 200, so clients and caches
+	// treat it as a working (if degraded) page.
+	Status int `yaml:"status"`
+}
+
+// An ErrorPage is rendered for browsers (html) and API clients (json) in
+// place of a built-in error. Both are Go templates, given inline or as a
+// file, with .Status, .StatusText, .Message and .RequestID; json templates
+// can quote values with {{json .Message}}. Clients asking for a format the
+// page lacks get the next less specific page, or the built-in response.
+type ErrorPage struct {
+	HTML *StaticContent `yaml:"html"`
+	JSON *StaticContent `yaml:"json"`
+}
+
+// A StatusAction replaces an upstream response with another one.
+type StatusAction struct {
+	// Serve this page (with its own status, 200 by default).
+	Static *FallbackContent `yaml:"static"`
+	// Proxy the request to this upstream instead.
+	Upstream string `yaml:"upstream"`
+}
+
+// AuthConfig says which JWTs a protected route accepts.
+type AuthConfig struct {
+	// Where the signing keys are published. Unset, it is discovered from
+	// the issuer's OpenID configuration.
+	JWKSURL string `yaml:"jwks_url"`
+	// Required iss claim, if set.
+	Issuer string `yaml:"issuer"`
+	// Accepted aud claims; a token has to be for one of them.
+	Audience []string `yaml:"audience"`
+	// Claims a token must have, with these values (or containing them, for
+	// list claims such as groups). Other tokens get a 403.
+	RequiredClaims map[string]string `yaml:"required_claims"`
+	// Claims to pass upstream, by header name, e.g. {sub: X-User-Id}.
+	ForwardClaims map[string]string `yaml:"forward_claims"`
+	// Clock skew allowed on exp and nbf (default 1m).
+	Leeway time.Duration `yaml:"leeway"`
+	// Log browsers in through the issuer instead of answering 401.
+	OIDC *OIDCConfig `yaml:"oidc"`
+}
+
+// OIDCConfig is the client registration for the browser login flow.
+type OIDCConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// Absolute URL the provider sends browsers back to. Its path has to be
+	// under the route's prefix, where it is answered by the frontend.
+	RedirectURL string `yaml:"redirect_url"`
+	// Defaults to openid, profile and email.
+	Scopes []string `yaml:"scopes"`
+	// Cookie the ID token is kept in. Defaults to frontend_session.
+	CookieName string `yaml:"cookie_name"`
+}
+
+// CompressConfig says which responses to compress and how.
+type CompressConfig struct {
+	// Encodings to offer, in order of preference: br and gzip (the
+	// default is both, br first).
+	Encodings []string `yaml:"encodings"`
+	// Content types worth compressing, with * wildcards such as text/*.
+	// Defaults to text, JSON, JavaScript, XML, SVG and WebAssembly.
+	ContentTypes []string `yaml:"content_types"`
+	// Responses shorter than this go out uncompressed (default 1024).
+	MinBytes int `yaml:"min_bytes"`
+	// Compression level per encoding, trading CPU for size: br 0-11
+	// (default 4) and gzip 1-9 (default 6).
+	Level map[string]int `yaml:"level"`
+}
+
+// CacheConfig sizes a route's response cache.
+type CacheConfig struct {
+	// How long responses stay fresh when the upstream doesn't say, through
+	// Cache-Control max-age or Expires. Defaults to a minute.
+	TTL time.Duration `yaml:"ttl"`
+	// Largest response kept (default 1MB); bigger ones are passed through.
+	MaxObjectBytes int64 `yaml:"max_object_bytes"`
+	// Total size of kept response bodies, beyond which the least recently
+	// used are evicted. Unbounded when zero.
+	MaxBytes int64 `yaml:"max_bytes"`
+	// Request header that skips the cache when set to anything but 0 or
+	// false, e.g. X-Cache-Bypass: 1, to fetch a fresh copy while debugging.
+	// With bypass_refresh, the fresh copy then replaces the cached one, as
+	// it does for clients sending Cache-Control: no-cache.
+	BypassHeader  string `yaml:"bypass_header"`
+	BypassRefresh bool   `yaml:"bypass_refresh"`
+}
+
+// StaticRouteConfig is the directory a static route serves.
+type StaticRouteConfig struct {
+	Root string `yaml:"root"`
+	// Files to serve for a directory, first found wins. Defaults to
+	// index.html.
+	Index []string `yaml:"index"`
+	// Serve the root index file for paths without a file extension that
+	// match nothing, for single-page apps doing their own routing.
+	SPAFallback bool `yaml:"spa_fallback"`
+	// Cache-Control for files other than index files, e.g.
+	// "public, max-age=31536000, immutable" for fingerprinted assets.
+	CacheControl string `yaml:"cache_control"`
+	// List the contents of directories without an index file instead of
+	// answering 404.
+	ListDirectories bool `yaml:"list_directories"`
+}
+
+// CircuitBreakerConfig says when to stop sending requests to a failing
+// upstream. Connection errors, timeouts and 5xx answers count as failures.
+type CircuitBreakerConfig struct {
+	// Open after this many failures in a row (default 5).
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+	// Also open when this share of requests (0 to 1) fails within window,
+	// once there were at least min_requests. Off when zero.
+	ErrorRate   float64       `yaml:"error_rate"`
+	Window      time.Duration `yaml:"window"`
+	MinRequests int           `yaml:"min_requests"`
+	// How long to fail requests before probing again (default 30s).
+	Cooldown time.Duration `yaml:"cooldown"`
+	// Probe requests let through after the cooldown; the circuit closes
+	// once they all succeed (default 1).
+	HalfOpenProbes int `yaml:"half_open_probes"`
+}
+
+// RetryPolicy says when a route sends a failed request again.
+type RetryPolicy struct {
+	// Attempts in total, the first one included.
+	Attempts int `yaml:"attempts"`
+	// What to retry: connect_failure (the default), timeout, 5xx or
+	// specific status codes such as 503.
+	On []string `yaml:"on"`
+	// Methods to retry besides GET and HEAD, which always are, e.g. [PUT,
+	// DELETE] for an API that implements them idempotently. Instead of
+	// the global idempotent_methods, not on top of them.
+	IdempotentMethods []string `yaml:"idempotent_methods"`
+	// Pause before the first retry, growing with each one after. Defaults
+	// to 50ms.
+	Backoff time.Duration `yaml:"backoff"`
+	// How the pause is randomized: "full" (anywhere up to it), "equal"
+	// (between half and all of it) or "none". By default it varies by up
+	// to 10%.
+	Jitter string `yaml:"jitter"`
+	// Time allowed for each attempt, body included. The route's timeout
+	// still bounds them all together.
+	PerTryTimeout time.Duration `yaml:"per_try_timeout"`
+	// Largest request body kept for replay (default 64KB). Requests with
+	// bigger bodies are only tried once.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// RetryBudgetConfig bounds how many retries are made over a sliding window.
+type RetryBudgetConfig struct {
+	// Retries allowed as a share of requests, from 0 to 1 (default 0.1).
+	Ratio float64 `yaml:"ratio"`
+	// Retries allowed per window whatever the ratio, so quiet periods
+	// can still retry (default 10).
+	MinRetries int `yaml:"min_retries"`
+	// Length of the window (default 10s).
+	Window time.Duration `yaml:"window"`
+}
+
+// CanaryConfig splits a route's traffic between versions of its upstream,
+// e.g. 95% to v1 and 5% to v2.
+type CanaryConfig struct {
+	Versions []CanaryVersion `yaml:"versions"`
+	// Request header naming the version to use, e.g. X-Canary: v2, to try
+	// a version out regardless of its weight.
+	Header string `yaml:"header"`
+	// Cookie naming the version to use. With sticky, clients get it set
+	// to the version they were first assigned, so they stay on it; the
+	// cookie defaults to canary_<route> then.
+	Cookie string `yaml:"cookie"`
+	Sticky bool   `yaml:"sticky"`
+}
+
+// AffinityConfig pins clients to one of a route's upstreams while it stays
+// in rotation.
+type AffinityConfig struct {
+	// "cookie" sets a cookie naming the upstream that answered; "hash"
+	// picks the upstream by consistent hashing of hash_on.
+	Type string `yaml:"type"`
+	// Cookie to set, default backend_<route>, or with hash_on: cookie the
+	// cookie to hash.
+	Cookie string `yaml:"cookie"`
+	// Lifetime of the set cookie; unset, it lasts the browser session.
+	CookieMaxAge time.Duration `yaml:"cookie_max_age"`
+	// What to hash: client_ip (the default), header or cookie. Requests
+	// without it are balanced as usual.
+	HashOn string `yaml:"hash_on"`
+	Header string `yaml:"header"`
+}
+
+type CanaryVersion struct {
+	Name     string `yaml:"name"`
+	Upstream string `yaml:"upstream"`
+	// Share of traffic relative to the other versions; 0 takes only
+	// requests asking for this version.
+	Weight int `yaml:"weight"`
+}
+
+// MirrorConfig says where to shadow a route's traffic to.
+type MirrorConfig struct {
+	Upstream string `yaml:"upstream"`
+	// Share of requests to mirror, from 0 to 1 (the default, all of them).
+	SampleRate float64 `yaml:"sample_rate"`
+	// Time allowed for a mirrored request (default 5s).
+	Timeout time.Duration `yaml:"timeout"`
+	// Requests with larger bodies aren't mirrored (default 64KB).
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// HealthCheck configures active upstream health checks.
+type HealthCheck struct {
+	// Path to request from each upstream. Defaults to /; any 2xx or 3xx
+	// answer counts as healthy.
+	Path string `yaml:"path"`
+	// Method to probe with (default GET).
+	Method string `yaml:"method"`
+	// Statuses that count as healthy instead of any 2xx or 3xx.
+	ExpectedStatus []int `yaml:"expected_status"`
+	// Text the response body has to contain, within its first 64KB.
+	ExpectedBody string `yaml:"expected_body"`
+	// Time between probes (default 10s) and how long each may take
+	// (default 2s).
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// How the interval is randomized so instances don't probe in lockstep:
+	// "full", "equal" or "none" as for retries. By default it varies by up
+	// to 10%.
+	Jitter string `yaml:"jitter"`
+	// Consecutive good probes to bring an upstream back (default 2) and
+	// bad ones to take it out (default 3).
+	HealthyThreshold   int `yaml:"healthy_threshold"`
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+}
+
+// Deprecation announces that a route is going away. Dates are given as
+// 2006-01-02 or RFC 3339.
+type Deprecation struct {
+	// When the route was (or will be) deprecated, sent as Deprecation.
+	Date string `yaml:"date"`
+	// When it stops working, sent as Sunset (RFC 8594).
+	Sunset string `yaml:"sunset"`
+	// Migration docs, sent as a Link with rel="deprecation".
+	Link string `yaml:"link"`
+}
+
+type SyslogConfig struct {
+	// "udp", "tcp" or "unix" with the daemon's address. Both unset, logs go
+	// to the local syslog daemon.
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	// Facility name, e.g. daemon (the default) or local0.
+	Facility string `yaml:"facility"`
+	// Tag for each message, "frontend" by default.
+	Tag string `yaml:"tag"`
+}
+
+type BodyLogConfig struct {
+	// Most requests to log per minute (default 10).
+	PerMinute int `yaml:"per_minute"`
+	// Bytes of each body to keep (default 4096).
+	MaxBytes int `yaml:"max_bytes"`
+	// JSON field names whose values are replaced with [REDACTED].
+	Redact []string `yaml:"redact"`
+}
+
+type ForwardProxyConfig struct {
+	// Hosts that may be reached; "*." entries match any subdomain.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// Allow CONNECT tunnels (for https) to the same hosts.
+	Connect bool `yaml:"connect"`
+	// Ports CONNECT tunnels may reach (default 443).
+	ConnectPorts []int `yaml:"connect_ports"`
+}
+
+type ResolverConfig struct {
+	// host:port of the DNS server.
+	Address string `yaml:"address"`
+	// "udp" or "tcp". Unset, the Go resolver picks per query (UDP, falling
+	// back to TCP for truncated answers).
+	Protocol string `yaml:"protocol"`
+}
+
+type CORSConfig struct {
+	// Origins allowed to make cross-origin requests; "*" allows all and an
+	// entry may contain one wildcard, e.g. https://*.example.com.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// Methods and request headers cross-origin requests may use. Default to
+	// GET, POST and HEAD, and the CORS-safelisted headers plus
+	// X-Requested-With.
+	AllowedMethods []string `yaml:"allowed_methods"`
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	// Response headers scripts may read besides the CORS-safelisted ones.
+	ExposedHeaders []string `yaml:"exposed_headers"`
+	// Let requests carry cookies and HTTP authentication. Can't be combined
+	// with allowing every origin.
+	AllowCredentials *bool `yaml:"allow_credentials"`
+	// How long browsers may cache a preflight's answer.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Answer requests from disallowed origins with this status (e.g. 403)
+	// instead of serving them without CORS headers.
+	RejectStatus int `yaml:"reject_status"`
+}
+
+type RateLimitConfig struct {
+	// Requests per second allowed on average, and how many may come at
+	// once. The burst defaults to the rate.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// Tell clients apart by this header (e.g. X-Api-Key) when they send
+	// it. Otherwise, and by default, clients are told apart by address,
+	// looking through trusted_proxies.
+	KeyHeader string `yaml:"key_header"`
+}
+
+type LoadShedConfig struct {
+	// Shed load while the Go heap holds more than this many bytes.
+	MaxHeapBytes int64 `yaml:"max_heap_bytes"`
+	// How often to check. Defaults to 1s.
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// Sent to shed clients as Retry-After, rounded up to whole seconds.
+	// Defaults to 5s.
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+type TLSConfig struct {
+	// Address for the TLS listener. Defaults to :8443.
+	Listen   string `yaml:"listen"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Get certificates from an ACME CA (Let's Encrypt) instead of
+	// cert_file and key_file.
+	Autocert *AutocertConfig `yaml:"autocert"`
+	// Redirect every request on the plain HTTP listener to https, instead
+	// of per route with require_tls.
+	RedirectHTTP bool `yaml:"redirect_http"`
+	// Speak only HTTP/1.1 on the TLS listener. By default clients can
+	// negotiate HTTP/2.
+	DisableHTTP2 bool `yaml:"disable_http2"`
+
+	// Client certificate verification: "none" (default), "optional" or
+	// "require". With "optional", routes that set require_client_cert still
+	// insist on a verified certificate while others accept anyone.
+	ClientAuth string `yaml:"client_auth"`
+	// PEM bundle of CAs trusted to sign client certificates.
+	ClientCAFile string `yaml:"client_ca_file"`
+
+	// Lowest protocol version to accept: "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string `yaml:"min_version"`
+	// Restrict TLS 1.2 and below to these suites, by IANA name. Go picks the
+	// TLS 1.3 suites itself.
+	CipherSuites []string `yaml:"cipher_suites"`
+
+	// Turn off session ticket resumption altogether.
+	SessionTicketsDisabled bool `yaml:"session_tickets_disabled"`
+	// File of hex-encoded 32-byte session ticket keys, one per line, newest
+	// first: the first key encrypts new tickets and every key decrypts.
+	// The file is re-read every minute, so keys can be rotated (and shared
+	// between instances) by rewriting it. Unset, Go generates and rotates
+	// its own keys.
+	SessionTicketKeysFile string `yaml:"session_ticket_keys_file"`
+}
+
+type AutocertConfig struct {
+	// Hostnames certificates may be requested for. Required, so that
+	// arbitrary Host headers can't make us ask the CA for certificates.
+	Hosts []string `yaml:"hosts"`
+	// Directory certificates and the account key are kept in across
+	// restarts. Defaults to autocert-cache.
+	CacheDir string `yaml:"cache_dir"`
+	// Contact address given to the CA for expiry notices.
+	Email string `yaml:"email"`
+	// ACME directory to use. Defaults to Let's Encrypt production.
+	DirectoryURL string `yaml:"directory_url"`
+}
+
+// Route is the configuration for a single proxied path prefix. In config.yaml
+// a route may be given either as a bare upstream URL or as a mapping of
+// options:
+//
+//	routes:
+//	  foo: http://localhost:8081/
+//	  bar:
+//	    upstream: http://localhost:8082/
+//	    accept_content_types: [application/json]
+type Route struct {
+	// "proxy" (the default) sends requests upstream; "static" serves the
+	// files in static.root instead, and ignores the upstream settings.
+	Type     string             `yaml:"type"`
+	Static   *StaticRouteConfig `yaml:"static"`
+	Upstream string             `yaml:"upstream"`
+	// Several upstreams to balance between instead of a single upstream,
+	// using balance: "round_robin" (default), "least_connections",
+	// "random" or "weighted". An upstream that keeps refusing connections
+	// is left out for a few seconds.
+	Upstreams []string `yaml:"upstreams"`
+	Balance   string   `yaml:"balance"`
+	// Share of traffic for each upstream under balance: weighted, keyed by
+	// the upstream as listed in upstreams. Unlisted upstreams weigh 1, and
+	// a weight of 0 takes one out of rotation.
+	Weights map[string]int `yaml:"weights"`
+	// Upstreams held in reserve for upstream or upstreams: they only get
+	// requests while none of those can take them, because all are failing
+	// health checks, ejected, drained or behind an open circuit.
+	Backup []string `yaml:"backup"`
+	// Split traffic between versions of the upstream by weight, instead
+	// of upstream or upstreams.
+	Canary *CanaryConfig `yaml:"canary"`
+	// Keep each client on the same upstream.
+	Affinity *AffinityConfig `yaml:"affinity"`
+	// Look the upstreams up in DNS SRV records or Consul instead, and keep
+	// looking so the route follows instances as they come and go.
+	Discovery *DiscoveryConfig `yaml:"discovery"`
+	// Also send a copy of requests to a shadow upstream, ignoring its
+	// answers, to try a new backend out on real traffic.
+	Mirror *MirrorConfig `yaml:"mirror"`
+	// Probe upstreams in the background and stop sending requests to
+	// those failing.
+	HealthCheck *HealthCheck `yaml:"health_check"`
+	// Answer for requests made while every upstream is failing its health
+	// checks, so a backend that is down entirely stands out from a single
+	// failed request. Defaults to 503 "no healthy upstream".
+	NoHealthyStatus  int    `yaml:"no_healthy_status"`
+	NoHealthyMessage string `yaml:"no_healthy_message"`
+	// Upstream statuses to treat as failures as 5xx are, for backends that
+	// signal errors some other way. Either kind is retried under the 5xx
+	// condition, trips circuit breakers, counts toward ejecting the
+	// upstream and is counted as an upstream error in metrics.
+	ErrorStatusCodes []int `yaml:"error_status_codes"`
+	// Overrides of the global CORS policy: settings given here replace the
+	// global ones, the rest are kept.
+	CORS *CORSConfig `yaml:"cors"`
+	// Only let through clients from allowed addresses.
+	Access *AccessConfig `yaml:"access"`
+	// Only let through requests with a valid JWT.
+	Auth *AuthConfig `yaml:"auth"`
+	// What auth does while the JWKS or issuer can't be reached: "closed"
+	// (the default) rejects tokens it can't check, "open" lets requests
+	// through unauthenticated, choosing availability over security.
+	AuthFailMode string `yaml:"auth_fail_mode"`
+	// Compress responses for clients that accept it.
+	Compress *CompressConfig `yaml:"compress"`
+	// Keep GET responses in memory and answer repeats from there.
+	Cache *CacheConfig `yaml:"cache"`
+	// Fail requests fast with a 503 while an upstream keeps failing them.
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker"`
+
+	// Path prefix to match, without slashes. Defaults to the route's name,
+	// so several routes can share a prefix when they differ in Queries.
+	// "/" matches every path and strips nothing, which together with host
+	// gives a whole virtual host to one upstream.
+	Prefix string `yaml:"prefix"`
+	// How the route matches paths: "prefix" (the default) matches prefix
+	// and strips it; "exact" matches path only; "regex" matches the
+	// regular expression path against the request path. Exact and regex
+	// routes' paths are relative to base_path, which is all they strip.
+	Match string `yaml:"match"`
+	Path  string `yaml:"path"`
+	// For exact and regex routes, replace the part of the path that
+	// matched with this, expanding $1 and ${name} to the regex's
+	// captures: path ^/v1/users/(\d+) with rewrite /internal/users/$1
+	// sends /v1/users/42/posts upstream as /internal/users/42/posts.
+	Rewrite string `yaml:"rewrite"`
+	// Forward the path as the client sent it, base_path and prefix
+	// included, instead of stripping them.
+	PreservePath bool `yaml:"preserve_path"`
+	// Only match requests carrying these query parameters. Values may use
+	// mux patterns, e.g. {service:foo|bar}. Requests that don't match fall
+	// through to other routes on the same prefix.
+	Queries map[string]string `yaml:"queries"`
+	// Only match requests for this Host. A leading "*." matches any single
+	// subdomain label (*.api.example.com); mux patterns such as
+	// {tenant:[a-z]+}.example.com work too, with the variables available
+	// through mux.Vars. The Host header is passed upstream unchanged
+	// unless upstream_host_header is set. Host routes are still ordered by
+	// prefix among the rest; give them a priority to have them win over
+	// longer prefixes without a host.
+	Host string `yaml:"host"`
+	// Routes are tried highest priority first. Routes with equal priority
+	// (0 unless set) are ordered longest prefix first, so a negative value
+	// pushes a route behind overlapping ones regardless of its prefix.
+	Priority int `yaml:"priority"`
+
+	// If non-empty, requests carrying a body must have one of these
+	// Content-Types (e.g. "application/json" or "text/*").
+	AcceptContentTypes []string `yaml:"accept_content_types"`
+
+	// Limit the request rate of each client on this route, answering
+	// those over it with a 429.
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+
+	// Mark routes serving websockets or SSE. Their connections are closed
+	// as soon as shutdown starts rather than holding up the drain of
+	// normal requests until the grace period expires.
+	LongLived bool `yaml:"long_lived"`
+	// Close a proxied websocket once no data has flowed in either direction
+	// for this long.
+	WSIdleTimeout time.Duration `yaml:"ws_idle_timeout"`
+	// How often to flush streamed response bodies to the client. SSE
+	// (text/event-stream) and responses of unknown length are flushed as
+	// they arrive regardless; -1 flushes everything immediately.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+
+	// How to treat an inbound X-Forwarded-For: "append" (the default) adds
+	// the connecting address to it, "replace" discards it for just that
+	// address, and "trust" passes it on unchanged.
+	XFFMode string `yaml:"xff_mode"`
+	// Which forwarding headers to send upstream: "x-forwarded" (the
+	// default, X-Forwarded-For), "forwarded" (RFC 7239 Forwarded with
+	// for, proto and host) or "both".
+	ForwardedHeaders string `yaml:"forwarded_headers"`
+
+	// Change the method of upstream requests, keyed by the client's method
+	// (e.g. {PUT: POST}). Checks in the handler chain, such as
+	// head_as_get and single_flight, see the client's method.
+	MethodRewrite map[string]string `yaml:"method_rewrite"`
+	// What to do with methods clients send in the wrong case or make up:
+	// "pass" (default) forwards them as sent, "normalize" uppercases them
+	// (get becomes GET) and "strict" also answers methods outside the
+	// standard set with a 501.
+	MethodHandling string `yaml:"method_handling"`
+
+	// Headers to set on upstream requests. Values are Go templates
+	// rendered per request, with .PathVar (mux variables from the route's
+	// host and query patterns), .Header, .Query, .Host and .Path, e.g.
+	// X-Tenant: '{{.PathVar "tenant"}}'.
+	RequestHeaders map[string]string `yaml:"request_headers"`
+	// Longest rendered request_headers value to send (default 4KB);
+	// longer ones are logged and left out.
+	MaxHeaderValueBytes int `yaml:"max_header_value_bytes"`
+
+	// Send the stripped base path upstream as X-Forwarded-Prefix.
+	ForwardedPrefix bool `yaml:"forwarded_prefix"`
+	// Send X-Forwarded-Proto and X-Forwarded-Host. Values set by
+	// trusted_proxies are passed on; anyone else's are replaced with the
+	// protocol and Host the request reached us with.
+	ForwardedProtoHost bool `yaml:"forwarded_proto_host"`
+	// Send the upstream's host as the Host header instead of the client's,
+	// for virtual-hosted backends that only answer to their own name.
+	UpstreamHostHeader bool `yaml:"upstream_host_header"`
+	// Headers to remove from requests before they go upstream, applied
+	// before request_headers.
+	StripRequestHeaders []string `yaml:"strip_request_headers"`
+
+	// Headers to add to this route's responses, e.g. Cache-Control. An
+	// upstream's own value wins unless force_response_headers is set.
+	AddResponseHeaders   map[string]string `yaml:"add_response_headers"`
+	ForceResponseHeaders bool              `yaml:"force_response_headers"`
+	// Headers to remove from upstream responses, e.g. Server or
+	// X-Powered-By.
+	StripResponseHeaders []string `yaml:"strip_response_headers"`
+	// Warn clients off an API version being sunset with Deprecation,
+	// Sunset and Link headers on every response.
+	Deprecation *Deprecation `yaml:"deprecation"`
+
+	// Append a Via entry to requests sent upstream and to responses sent
+	// back. via_name defaults to the global proxy_name.
+	AddVia  bool   `yaml:"add_via"`
+	ViaName string `yaml:"via_name"`
+
+	// Tell clients which upstream answered in an X-Served-By header. It is
+	// the upstream's host unless served_by_name gives a name to show
+	// instead.
+	AddServedBy  bool   `yaml:"add_served_by"`
+	ServedByName string `yaml:"served_by_name"`
+
+	// Rewrite upstream status codes before they reach the client, keyed by
+	// upstream code (e.g. {418: 429}).
+	StatusRemap map[int]int `yaml:"status_remap"`
+
+	// Handle upstream responses with these statuses differently, keyed by
+	// upstream status: serve a static page or send the request to another
+	// upstream, e.g. {404: {static: {file: index.html}}} for an SPA. To
+	// just change the status, use status_remap.
+	StatusActions map[int]*StatusAction `yaml:"status_actions"`
+
+	// Error pages for this route, replacing global ones with the same key.
+	ErrorPages map[string]*ErrorPage `yaml:"error_pages"`
+	// Answer upstream 5xx responses with the frontend's own error response
+	// (error pages included) instead, so every backend's failures look the
+	// same to clients. Status actions still come first.
+	InterceptErrors bool `yaml:"intercept_errors"`
+
+	// Correct the Content-Type of upstream responses: force_content_type
+	// replaces it on every response, content_type_map replaces listed media
+	// types (e.g. text/plain: application/json). Unset, it passes through.
+	ForceContentType string            `yaml:"force_content_type"`
+	ContentTypeMap   map[string]string `yaml:"content_type_map"`
+
+	// Share one upstream call between concurrent identical GET/HEAD
+	// requests. Responses are buffered in memory, so only enable this for
+	// routes with modestly sized responses.
+	SingleFlight bool `yaml:"single_flight"`
+
+	// Reject requests without a verified TLS client certificate with 403.
+	// Requires tls.client_auth to be "optional" or "require".
+	RequireClientCert bool `yaml:"require_client_cert"`
+	// Pass the client certificate's subject and verification state upstream
+	// as X-Client-Cert-Subject and X-Client-Cert-Verified.
+	ForwardClientCert bool `yaml:"forward_client_cert"`
+	// Keep the route off plain HTTP: "redirect" sends clients to https,
+	// "reject" answers 403. Requests count as secure when they arrived over
+	// TLS or a trusted proxy set X-Forwarded-Proto: https.
+	RequireTLS string `yaml:"require_tls"`
+
+	// Answer OPTIONS requests with a 204 at the frontend instead of
+	// proxying them upstream.
+	HandleOptions bool `yaml:"handle_options"`
+	// Level for this route's access log entries, e.g. debug for chatty
+	// low-value routes. Defaults to info.
+	LogLevel LogLevel `yaml:"log_level"`
+
+	// Set to false to take the route out of service without deleting it;
+	// its paths then fall through to the remaining routes.
+	Enabled *bool `yaml:"enabled"`
+
+	// Send HEAD requests upstream as GET and drop the body, for backends
+	// that answer HEAD with a 405.
+	HeadAsGet bool `yaml:"head_as_get"`
+
+	// What to do with percent-encoded slashes in the path: "decode" (the
+	// default) forwards them as plain slashes, "pass" keeps them encoded
+	// and "reject" answers 400.
+	EncodedSlashes string `yaml:"encoded_slashes"`
+	// What to do with duplicate slashes once the prefix is stripped: "pass"
+	// (the default) or "collapse". Only reachable with preserve_raw_paths;
+	// otherwise such paths are redirected before routing.
+	DuplicateSlashes string `yaml:"duplicate_slashes"`
+
+	// Clean the path (resolving "." and ".." and collapsing duplicate
+	// slashes) after stripping the base path and before forwarding.
+	NormalizePath bool `yaml:"normalize_path"`
+	// Prepend this path to what is left after stripping the base path, for
+	// backends mounted under their own prefix: with add_prefix /v2, a
+	// request for /api/users reaches the api upstream as /v2/users.
+	AddPrefix string `yaml:"add_prefix"`
+	// Point Location and Content-Location headers naming the upstream, or
+	// a path without the stripped prefix, back at the public path.
+	RewriteLocation bool `yaml:"rewrite_location"`
+	// Do the same for absolute URLs in HTML and JSON bodies, and for
+	// root-relative links in HTML, so apps work under a prefix unchanged.
+	// gzip, deflate and br bodies are decoded to be rewritten. Bodies over
+	// rewrite_body_max_bytes (default 1MB) pass through as is.
+	RewriteBody         bool  `yaml:"rewrite_body"`
+	RewriteBodyMaxBytes int64 `yaml:"rewrite_body_max_bytes"`
+
+	// How long to wait for the upstream's response headers. A stuck
+	// backend fails fast with a 502 once this passes.
+	HeaderTimeout time.Duration `yaml:"header_timeout"`
+	// How long the response body may go without delivering any data. This
+	// bounds stalls without limiting the total length of large downloads.
+	IdleReadTimeout time.Duration `yaml:"idle_read_timeout"`
+	// How long to wait for a TCP connection to the upstream. Defaults to
+	// Go's 30s; raise it for distant backends with slow connection setup.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	// TCP keep-alive probe interval for upstream connections. Defaults to
+	// 30s; negative disables the probes.
+	UpstreamKeepAlive time.Duration `yaml:"upstream_keep_alive"`
+	// Idle upstream connections kept open per backend for reuse. Defaults
+	// to Go's 2, which makes busy routes open and close connections all
+	// the time; raise it to about the route's concurrent requests.
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+	// Cap on connections per backend, idle or in use. Requests beyond it
+	// wait for a connection. Unset means no cap.
+	MaxConnsPerHost int `yaml:"max_conns_per_host"`
+	// How long an idle upstream connection is kept. Defaults to 90s.
+	UpstreamIdleTimeout time.Duration `yaml:"upstream_idle_timeout"`
+	// Requests whose upstream connection fails are sent to up to two
+	// other healthy upstreams, since no part of the request has been sent
+	// yet. Set this to fail on the first refused connection instead.
+	DisableDialRetry bool `yaml:"disable_dial_retry"`
+	// Send idempotent requests again when the upstream fails them, on
+	// the same or (with several upstreams) another backend.
+	Retry *RetryPolicy `yaml:"retry"`
+	// Total time allowed for the upstream call, answered with a 504 when it
+	// runs out. Clients may ask for a different deadline via deadline_header
+	// but never more than max_timeout, which defaults to timeout.
+	Timeout    time.Duration `yaml:"timeout"`
+	MaxTimeout time.Duration `yaml:"max_timeout"`
+	// Ceiling for deadlines requested through trusted_timeout_header.
+	TrustedMaxTimeout time.Duration `yaml:"trusted_max_timeout"`
+	// Tell clients which timeout a 504 came from, and its value, in
+	// X-Timeout-Kind (total, dial or header) and X-Timeout (e.g. 5s).
+	// Either way the upstream failure is logged with timeout and
+	// timeout_value.
+	ReportTimeouts bool `yaml:"report_timeouts"`
+
+	// Largest upstream response body to pass on, in bytes. Unset means no
+	// limit.
+	MaxResponseBytes int64 `yaml:"max_response_bytes"`
+	// Largest request body to accept, in bytes, instead of the global
+	// max_request_bytes. Negative means no limit.
+	MaxRequestBytes int64 `yaml:"max_request_bytes"`
+	// Largest gzip or deflate request body to accept once decompressed, in
+	// bytes; larger ones get a 413 as well. The body still goes upstream
+	// compressed, this only measures it, so set it on routes whose upstream
+	// decompresses request bodies. Unset means no limit.
+	MaxDecompressedRequestBytes int64 `yaml:"max_decompressed_request_bytes"`
+
+	// Read the entire upstream response before sending it, so it goes out
+	// with a Content-Length. Responses over buffer_max_bytes (default 1MB)
+	// are streamed as usual. Any later stage that needs the whole body
+	// (rewriting, compression) can rely on it being in memory only for
+	// responses under the cap.
+	BufferResponse bool  `yaml:"buffer_response"`
+	BufferMaxBytes int64 `yaml:"buffer_max_bytes"`
+
+	// DEBUGGING ONLY: log a sample of request and response bodies.
+	DebugLogBodies *BodyLogConfig `yaml:"debug_log_bodies"`
+
+	// Serve this page instead of an error when the upstream request fails.
+	Fallback *FallbackContent `yaml:"fallback"`
+
+	// Expect: 100-continue is forwarded, so the client only sends its body
+	// once the upstream agrees to take it. expect_continue_timeout is how
+	// long to wait for the upstream's 100 before sending the body anyway
+	// (default 1s). strip_expect_continue drops the header instead, for
+	// upstreams that mishandle it.
+	ExpectContinueTimeout time.Duration `yaml:"expect_continue_timeout"`
+	StripExpectContinue   bool          `yaml:"strip_expect_continue"`
+
+	// Open a new upstream connection for every request instead of reusing
+	// pooled ones, for stateful backends that mishandle keep-alive.
+	DisableUpstreamKeepAlives bool `yaml:"disable_upstream_keep_alives"`
+
+	// Use HTTP/2 to https upstreams that support it, multiplexing requests
+	// over fewer connections. Otherwise upstream requests use HTTP/1.1.
+	UpstreamHTTP2 bool `yaml:"upstream_http2"`
+	// Use cleartext HTTP/2 (h2c, with prior knowledge) to http upstreams
+	// and HTTP/2 to https ones, as gRPC backends need. Requests go out as
+	// HTTP/2 only.
+	UpstreamH2C bool `yaml:"upstream_h2c"`
+}
+
+// LogLevel is a level for access log entries: debug, info (the default),
+// warn or error.
+type LogLevel string
+
+func (level *LogLevel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+	parsed, err := log.ParseLevel(name)
+	if err != nil || parsed < log.ErrorLevel || parsed > log.DebugLevel {
+		return &invalidEntryError{entry: name, err: fmt.Errorf("unknown log level %q (valid: debug, info, warn, error)", name)}
+	}
+	*level = LogLevel(name)
+	return nil
+}
+
+// Level returns the logrus level, defaulting to info.
+func (level LogLevel) Level() log.Level {
+	if parsed, err := log.ParseLevel(string(level)); err == nil {
+		return parsed
+	}
+	return log.InfoLevel
+}
+
+// IsEnabled reports whether the route should be registered. Routes are
+// enabled unless the config says otherwise.
+func (route *Route) IsEnabled() bool {
+	return route.Enabled == nil || *route.Enabled
+}
+
+// upstreamURLs returns the route's upstreams, whichever way they were given.
+func (route *Route) upstreamURLs() []string {
+	if route.Canary != nil {
+		var upstreams []string
+		for _, version := range route.Canary.Versions {
+			upstreams = append(upstreams, version.Upstream)
+		}
+		return upstreams
+	}
+	if len(route.Upstreams) > 0 {
+		return route.Upstreams
+	}
+	if route.Upstream == "" {
+		return nil
+	}
+	return []string{route.Upstream}
+}
+
+// matchRank orders routes by how specific their matcher is.
+func (route *Route) matchRank() int {
+	switch route.Match {
+	case "exact":
+		return 0
+	case "regex":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// UnmarshalYAML accepts both the short string form and the full mapping form.
+func (route *Route) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var upstream string
+	if err := unmarshal(&upstream); err == nil {
+		route.Upstream = upstream
+		return nil
+	}
+
+	type plain Route
+	return unmarshal((*plain)(route))
+}
+
+const (
+	defaultListen          = ":8080"
+	defaultShutdownTimeout = 10 * time.Second
+	defaultMaxURLLength    = 8 << 10
+)
+
+// loadConfig reads and parses the config file, applies the command line
+// options over it and fills in defaults. With AllowEmptyConfig, a missing
+// file gives an empty config rather than an error.
+func loadConfig(options *Options) (Config, error) {
+	var config Config
+	configFile, err := ioutil.ReadFile(options.ConfigPath)
+	if os.IsNotExist(err) && options.AllowEmptyConfig {
+		log.Warnf("%s not found, starting with no routes", options.ConfigPath)
+		err = nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(configFile, &config); err != nil {
+		return config, locateEntryError(configFile, err)
+	}
+	options.apply(&config)
+	config.applyDefaults()
+	return config, nil
+}
+
+// applyDefaults fills in settings that were left out of the config file.
+func (config *Config) applyDefaults() {
+	if config.BasePath != "" {
+		config.BasePath = "/" + strings.Trim(config.BasePath, "/")
+		if config.BasePath == "/" {
+			config.BasePath = ""
+		}
+	}
+	if config.Listen == "" {
+		config.Listen = defaultListen
+	}
+	if config.Admin != nil && config.Admin.Listen == "" {
+		config.Admin.Listen = "127.0.0.1:9090"
+	}
+	if config.Metrics != nil {
+		if config.Metrics.Listen == "" {
+			config.Metrics.Listen = "127.0.0.1:9100"
+		}
+		if config.Metrics.Path == "" {
+			config.Metrics.Path = "/metrics"
+		}
+	}
+	if config.MaxURLLength <= 0 {
+		config.MaxURLLength = defaultMaxURLLength
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if config.InterruptTimeout <= 0 {
+		config.InterruptTimeout = config.ShutdownTimeout
+	}
+	if config.ProxyName == "" {
+		config.ProxyName, _ = os.Hostname()
+		if config.ProxyName == "" {
+			config.ProxyName = "frontend"
+		}
+	}
+	for name, route := range config.Routes {
+		if route.AddVia && route.ViaName == "" {
+			route.ViaName = config.ProxyName
+		}
+		if route.Prefix == "" {
+			route.Prefix = name
+		}
+		route.Prefix = strings.Trim(route.Prefix, "/")
+	}
+	if config.TLS != nil && config.TLS.Listen == "" {
+		config.TLS.Listen = ":8443"
+	}
+}
+
+// orderedRouteNames returns the route names in registration order. mux uses
+// the first route that matches, so routes go in priority order, then exact
+// routes, regex routes (in name order) and the longer prefixes first and, for
+// a shared prefix, routes with host or query matchers before the catch-all.
+func (config *Config) orderedRouteNames() []string {
+	names := make([]string, 0, len(config.Routes))
+	for name := range config.Routes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := config.Routes[names[i]], config.Routes[names[j]]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if a.matchRank() != b.matchRank() {
+			return a.matchRank() < b.matchRank()
+		}
+		if len(a.Prefix) != len(b.Prefix) {
+			return len(a.Prefix) > len(b.Prefix)
+		}
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+		if len(a.Queries) != len(b.Queries) {
+			return len(a.Queries) > len(b.Queries)
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
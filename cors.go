@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rs/cors"
+)
+
+// NewCORSMiddleware builds the CORS layer. Without a cors section it keeps
+// cors.Default()'s permissive behavior. When reject_status is set, requests
+// (including preflights) from origins that aren't allowed get that status
+// and an explanation, rather than a normal response silently missing the
+// CORS headers, which is hard to debug from a browser.
+func NewCORSMiddleware(c *CORSConfig) Middleware {
+	if c == nil {
+		return cors.Default().Handler
+	}
+
+	options := cors.Options{
+		AllowedOrigins: c.AllowedOrigins,
+		AllowedMethods: c.AllowedMethods,
+		AllowedHeaders: c.AllowedHeaders,
+		ExposedHeaders: c.ExposedHeaders,
+		MaxAge:         int(c.MaxAge.Seconds()),
+	}
+	if c.AllowCredentials != nil {
+		options.AllowCredentials = *c.AllowCredentials
+	}
+	policy := cors.New(options)
+	return func(h http.Handler) http.Handler {
+		handler := policy.Handler(h)
+		if c.RejectStatus == 0 {
+			return handler
+		}
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Origin") != "" && !policy.OriginAllowed(r) {
+				WriteError(rw, r, c.RejectStatus, "origin "+r.Header.Get("Origin")+" is not allowed")
+				return
+			}
+			handler.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// mergeCORSConfig applies a route's cors section on top of the global one.
+func mergeCORSConfig(global, route *CORSConfig) *CORSConfig {
+	var merged CORSConfig
+	if global != nil {
+		merged = *global
+	}
+	if route.AllowedOrigins != nil {
+		merged.AllowedOrigins = route.AllowedOrigins
+	}
+	if route.AllowedMethods != nil {
+		merged.AllowedMethods = route.AllowedMethods
+	}
+	if route.AllowedHeaders != nil {
+		merged.AllowedHeaders = route.AllowedHeaders
+	}
+	if route.ExposedHeaders != nil {
+		merged.ExposedHeaders = route.ExposedHeaders
+	}
+	if route.AllowCredentials != nil {
+		merged.AllowCredentials = route.AllowCredentials
+	}
+	if route.MaxAge != 0 {
+		merged.MaxAge = route.MaxAge
+	}
+	if route.RejectStatus != 0 {
+		merged.RejectStatus = route.RejectStatus
+	}
+	return &merged
+}
+
+// validateCORSConfig rejects policies browsers won't honor.
+func validateCORSConfig(c *CORSConfig) error {
+	if c == nil || c.AllowCredentials == nil || !*c.AllowCredentials {
+		return nil
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return errors.New("allow_credentials needs allowed_origins")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			return errors.New("allow_credentials can't be combined with allowed_origins \"*\"")
+		}
+	}
+	return nil
+}
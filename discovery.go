@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults for discovery settings left unset.
+const (
+	defaultDiscoveryInterval = 30 * time.Second
+	defaultConsulAddress     = "http://127.0.0.1:8500"
+	discoveryTimeout         = 5 * time.Second
+	// How soon a route that has no upstreams yet looks again.
+	discoveryPendingInterval = time.Second
+)
+
+// A discoverer looks up a route's upstream URLs.
+type discoverer func(ctx context.Context) ([]string, error)
+
+// newDiscoverer returns the lookup c describes: DNS SRV records, through
+// resolver if set, or a Consul catalog's instances of a service.
+func newDiscoverer(c *DiscoveryConfig, resolver *net.Resolver) (discoverer, error) {
+	scheme := c.Scheme
+	switch scheme {
+	case "":
+		scheme = "http"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unknown scheme %q (valid: http, https)", c.Scheme)
+	}
+	if c.Name == "" {
+		return nil, errors.New("name is required")
+	}
+
+	switch c.Type {
+	case "dns_srv":
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		return func(ctx context.Context) ([]string, error) {
+			_, records, err := resolver.LookupSRV(ctx, "", "", c.Name)
+			if err != nil {
+				return nil, err
+			}
+			// Records of a higher priority value are only for when all of
+			// the lowest ones are down, which health checks cover.
+			var upstreams []string
+			for _, record := range records {
+				if record.Priority != records[0].Priority {
+					break
+				}
+				host := strings.TrimSuffix(record.Target, ".")
+				upstreams = append(upstreams, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+			}
+			return upstreams, nil
+		}, nil
+	case "consul":
+		return newConsulDiscoverer(c, scheme)
+	default:
+		return nil, fmt.Errorf("unknown type %q (valid: dns_srv, consul)", c.Type)
+	}
+}
+
+func newConsulDiscoverer(c *DiscoveryConfig, scheme string) (discoverer, error) {
+	address := c.ConsulAddress
+	if address == "" {
+		address = defaultConsulAddress
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(address, "/") + "/v1/health/service/" + url.PathEscape(c.Name))
+	if err != nil {
+		return nil, fmt.Errorf("consul_address: %v", err)
+	}
+	query := url.Values{}
+	if !c.IncludeUnhealthy {
+		query.Set("passing", "true")
+	}
+	if c.Tag != "" {
+		query.Set("tag", c.Tag)
+	}
+	if c.Datacenter != "" {
+		query.Set("dc", c.Datacenter)
+	}
+	endpoint.RawQuery = query.Encode()
+
+	client := &http.Client{Timeout: discoveryTimeout}
+	return func(ctx context.Context) ([]string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if c.ConsulToken != "" {
+			req.Header.Set("X-Consul-Token", c.ConsulToken)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("consul answered %d", res.StatusCode)
+		}
+		var entries []struct {
+			Node    struct{ Address string }
+			Service struct {
+				Address string
+				Port    int
+			}
+		}
+		if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("consul response: %v", err)
+		}
+		var upstreams []string
+		for _, entry := range entries {
+			// Services registered without an address of their own are at
+			// their node's.
+			host := entry.Service.Address
+			if host == "" {
+				host = entry.Node.Address
+			}
+			upstreams = append(upstreams, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+		}
+		sort.Strings(upstreams)
+		return upstreams, nil
+	}, nil
+}
+
+// discover runs one lookup, bounded by timeout.
+func (d discoverer) discover(timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	upstreams, err := d(ctx)
+	if err == nil && len(upstreams) == 0 {
+		err = errors.New("no instances found")
+	}
+	return upstreams, err
+}
+
+// StartDiscovery looks the balancer's backends up again every interval
+// until Close, or every discoveryPendingInterval while it has none. A failed
+// lookup, or one finding no instances, keeps the current backends.
+func (b *Balancer) StartDiscovery(d discoverer, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+	go func() {
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			pending := len(b.Backends()) == 0
+			if pending {
+				timer.Reset(discoveryPendingInterval)
+			}
+			select {
+			case <-b.stop:
+				return
+			case <-timer.C:
+			}
+			timer.Reset(interval)
+			upstreams, err := d.discover(discoveryTimeout)
+			if err == nil {
+				err = b.SetBackends(upstreams)
+			}
+			switch {
+			case err != nil && pending:
+				log.WithField("route", b.route).WithError(err).Warn("upstream discovery failed, route still has no upstreams")
+			case err != nil:
+				log.WithField("route", b.route).WithError(err).Warn("upstream discovery failed, keeping current upstreams")
+			case pending:
+				log.WithField("route", b.route).Info("upstream discovery succeeded, route is serving")
+			}
+		}
+	}()
+}
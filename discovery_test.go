@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestDiscoveryStartupTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	// A Consul agent that is down until up is set.
+	var up int32
+	consul := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			http.Error(rw, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		p, _ := strconv.Atoi(port)
+		fmt.Fprintf(rw, `[{"Node": {"Address": "127.0.0.1"}, "Service": {"Port": %d}}]`, p)
+	}))
+	defer consul.Close()
+	routes := "routes:\n  app:\n    discovery: {type: consul, name: app, consul_address: " + consul.URL + "}\n"
+
+	t.Run("unset", func(t *testing.T) {
+		var c Config
+		if err := yaml.Unmarshal([]byte(routes), &c); err != nil {
+			t.Fatal(err)
+		}
+		c.applyDefaults()
+		middleware, err := NewMiddlewareSet(&c, NewLongLivedTracker(), NewInFlightTracker())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := buildRouter(&c, middleware, nil); err == nil {
+			t.Error("router built though discovery failed")
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		router := newTestRouter(t, "discovery_startup_timeout: 100ms\n"+routes)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status before discovery = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+
+		atomic.StoreInt32(&up, 1)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/", nil))
+			if rec.Code == http.StatusOK {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("status = %d after discovery came back, want %d", rec.Code, http.StatusOK)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
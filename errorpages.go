@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ErrorPages are the templates WriteError renders in place of its built-in
+// responses, keyed by status ("503"), status class ("5xx") or "default".
+type ErrorPages struct {
+	pages map[string]*errorPage
+}
+
+type errorPage struct {
+	html *htmltemplate.Template
+	json *template.Template
+}
+
+// errorPageData is what error page templates are executed with.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+}
+
+// NewErrorPages loads the pages of global and route, route's replacing
+// global's with the same key. It returns nil if neither has any.
+func NewErrorPages(global, route map[string]*ErrorPage) (*ErrorPages, error) {
+	merged := make(map[string]*ErrorPage, len(global)+len(route))
+	for key, page := range global {
+		merged[key] = page
+	}
+	for key, page := range route {
+		merged[key] = page
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+
+	pages := &ErrorPages{pages: make(map[string]*errorPage, len(merged))}
+	for key, c := range merged {
+		if !validErrorPageKey(key) {
+			return nil, fmt.Errorf("error_pages: invalid key %q (want a status, a class such as 5xx, or default)", key)
+		}
+		page := &errorPage{}
+		if c.HTML != nil {
+			body, _, err := c.HTML.load("")
+			if err != nil {
+				return nil, fmt.Errorf("error_pages %s: %v", key, err)
+			}
+			if page.html, err = htmltemplate.New(key).Parse(string(body)); err != nil {
+				return nil, fmt.Errorf("error_pages %s: %v", key, err)
+			}
+		}
+		if c.JSON != nil {
+			body, _, err := c.JSON.load("")
+			if err != nil {
+				return nil, fmt.Errorf("error_pages %s: %v", key, err)
+			}
+			page.json, err = template.New(key).Funcs(template.FuncMap{"json": jsonValue}).Parse(string(body))
+			if err != nil {
+				return nil, fmt.Errorf("error_pages %s: %v", key, err)
+			}
+		}
+		pages.pages[key] = page
+	}
+	return pages, nil
+}
+
+func validErrorPageKey(key string) bool {
+	if key == "default" {
+		return true
+	}
+	if len(key) == 3 && key[0] >= '1' && key[0] <= '5' && key[1:] == "xx" {
+		return true
+	}
+	status, err := strconv.Atoi(key)
+	return err == nil && status >= 100 && status <= 599
+}
+
+// jsonValue lets JSON templates quote values: {"error": {{json .Message}}}.
+func jsonValue(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// Wrap makes handler's error responses use the pages.
+func (p *ErrorPages) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), errorPagesKey{}, p)))
+	})
+}
+
+type errorPagesKey struct{}
+
+func errorPagesFromContext(ctx context.Context) *ErrorPages {
+	pages, _ := ctx.Value(errorPagesKey{}).(*ErrorPages)
+	return pages
+}
+
+// write renders the page for status in the format the client asked for. It
+// returns false, having written nothing, when there is no such page.
+func (p *ErrorPages) write(rw http.ResponseWriter, r *http.Request, status int, message string) bool {
+	format := negotiateErrorFormat(r.Header.Get("Accept"))
+	for _, key := range []string{strconv.Itoa(status), strconv.Itoa(status/100) + "xx", "default"} {
+		page, ok := p.pages[key]
+		if !ok {
+			continue
+		}
+		data := errorPageData{
+			Status:     status,
+			StatusText: http.StatusText(status),
+			Message:    message,
+			RequestID:  r.Header.Get("X-Request-Id"),
+		}
+		var body bytes.Buffer
+		var err error
+		switch {
+		case format == "application/json" && page.json != nil:
+			err = page.json.Execute(&body, data)
+		case format == "text/html" && page.html != nil:
+			err = page.html.Execute(&body, data)
+		default:
+			// This page has nothing for the format; a less specific one
+			// might.
+			continue
+		}
+		if err != nil {
+			log.WithField("error_page", key).WithError(err).Error("error page template failed")
+			return false
+		}
+		header := rw.Header()
+		header.Set("Content-Type", format+"; charset=utf-8")
+		header.Set("Content-Length", strconv.Itoa(body.Len()))
+		rw.WriteHeader(status)
+		rw.Write(body.Bytes())
+		return true
+	}
+	return false
+}
+
+// NewInterceptErrorsModifier replaces upstream 5xx responses with the
+// frontend's own error response, so clients of a route get one error format
+// whichever backend failed. Retry-After is kept.
+func NewInterceptErrorsModifier() ResponseModifier {
+	return func(res *http.Response) error {
+		if res.StatusCode < 500 {
+			return nil
+		}
+		res.Body.Close()
+		status, retryAfter := res.StatusCode, res.Header.Get("Retry-After")
+		return &statusActionError{status: status, handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if retryAfter != "" {
+				rw.Header().Set("Retry-After", retryAfter)
+			}
+			WriteError(rw, r, status, "")
+		})}
+	}
+}
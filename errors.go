@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type errorBody struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+// WriteError writes an error response in the format the client asked for
+// via Accept: JSON for API clients, a small HTML page for browsers and plain
+// text for everyone else, or the route's error page for the status and
+// format if it has one. message may be empty.
+func WriteError(rw http.ResponseWriter, r *http.Request, status int, message string) {
+	header := rw.Header()
+	header.Del("Content-Length")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Add("Vary", "Accept")
+	if isGRPCRequest(r) {
+		writeGRPCError(rw, status, message)
+		return
+	}
+	if pages := errorPagesFromContext(r.Context()); pages != nil && pages.write(rw, r, status, message) {
+		return
+	}
+
+	text := http.StatusText(status)
+	switch negotiateErrorFormat(r.Header.Get("Accept")) {
+	case "application/json":
+		header.Set("Content-Type", "application/json; charset=utf-8")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(errorBody{Status: status, Error: text, Message: message})
+	case "text/html":
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		rw.WriteHeader(status)
+		fmt.Fprintf(rw, "<!DOCTYPE html>\n<html><head><title>%d %s</title></head>\n<body><h1>%d %s</h1>",
+			status, html.EscapeString(text), status, html.EscapeString(text))
+		if message != "" {
+			fmt.Fprintf(rw, "<p>%s</p>", html.EscapeString(message))
+		}
+		fmt.Fprint(rw, "</body></html>\n")
+	default:
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(status)
+		if message != "" {
+			fmt.Fprintf(rw, "%d %s: %s\n", status, text, message)
+		} else {
+			fmt.Fprintf(rw, "%d %s\n", status, text)
+		}
+	}
+}
+
+// isGRPCRequest reports whether r is a gRPC call, whose client only
+// understands errors given as a grpc-status.
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeGRPCError answers a gRPC call with a trailers-only response carrying
+// the gRPC status for an HTTP one, mapped as gRPC's own clients map them.
+func writeGRPCError(rw http.ResponseWriter, status int, message string) {
+	code := 2 // UNKNOWN
+	switch status {
+	case http.StatusBadRequest:
+		code = 13 // INTERNAL
+	case http.StatusUnauthorized:
+		code = 16 // UNAUTHENTICATED
+	case http.StatusForbidden:
+		code = 7 // PERMISSION_DENIED
+	case http.StatusNotFound:
+		code = 12 // UNIMPLEMENTED
+	case http.StatusRequestEntityTooLarge:
+		code = 8 // RESOURCE_EXHAUSTED
+	case http.StatusGatewayTimeout:
+		code = 4 // DEADLINE_EXCEEDED
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = 14 // UNAVAILABLE
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	header := rw.Header()
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	header.Set("Grpc-Message", url.PathEscape(message))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// negotiateErrorFormat picks between JSON, HTML and plain text based on the
+// Accept header's preferences, defaulting to plain text.
+func negotiateErrorFormat(accept string) string {
+	best, bestQ := "text/plain", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		var format string
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			format = "application/json"
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			format = "text/html"
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// NewProxyErrorHandler replaces ReverseProxy's bare 502 with a negotiated
+// error response, using 504 when the upstream call ran out of time. If the
+// route has a fallback page, that is served instead.
+//
+// Timeouts are logged with which of the route's timeouts fired and its
+// value, and with report_timeouts the 504 says so too in X-Timeout and
+// X-Timeout-Kind.
+func NewProxyErrorHandler(route *Route, fallback http.Handler) func(http.ResponseWriter, *http.Request, error) {
+	return func(rw http.ResponseWriter, r *http.Request, err error) {
+		var action *statusActionError
+		if errors.As(err, &action) {
+			action.handler.ServeHTTP(rw, r)
+			return
+		}
+		entry := log.WithFields(log.Fields{
+			"request": r.RequestURI,
+			"method":  r.Method,
+		}).WithError(err)
+		if clientDisconnected(r) {
+			// Not the upstream's fault and nobody left to answer; note it for
+			// the access log the way nginx does.
+			entry.WithField("client_disconnect", true).Debug("client went away before the upstream responded")
+			rw.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if info := RequestInfoFromContext(r.Context()); info != nil {
+			info.SetUpstreamError(upstreamErrorKind(r, err))
+		}
+		kind, value := firedTimeout(r, err, route)
+		if kind != "" {
+			entry = entry.WithFields(log.Fields{"timeout": kind, "timeout_value": value.String()})
+		}
+		if fallback != nil {
+			entry.Warn("upstream request failed, serving fallback")
+			fallback.ServeHTTP(rw, r)
+			return
+		}
+		entry.Warn("upstream request failed")
+		if kind != "" && route.ReportTimeouts {
+			rw.Header().Set("X-Timeout", value.String())
+			rw.Header().Set("X-Timeout-Kind", kind)
+		}
+		writeProxyError(rw, r, err, route)
+	}
+}
+
+// statusClientClosedRequest is nginx's non-standard status for requests the
+// client abandoned. It only ever shows up in our logs.
+const statusClientClosedRequest = 499
+
+// clientDisconnected reports whether the request failed because the client
+// closed its connection, which cancels the request context.
+func clientDisconnected(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// NewErrorStatusModifier notes responses with one of statuses as upstream
+// errors, of kind "error_status", for metrics.
+func NewErrorStatusModifier(statuses []int) ResponseModifier {
+	failed := make(map[int]bool, len(statuses))
+	for _, status := range statuses {
+		failed[status] = true
+	}
+	return func(res *http.Response) error {
+		if !failed[res.StatusCode] {
+			return nil
+		}
+		if info := RequestInfoFromContext(res.Request.Context()); info != nil {
+			info.SetUpstreamError("error_status")
+		}
+		return nil
+	}
+}
+
+// upstreamErrorKind classifies an upstream failure the way writeProxyError
+// answers it, for metrics.
+func upstreamErrorKind(r *http.Request, err error) string {
+	switch {
+	case errors.Is(err, errNoHealthyUpstream):
+		return "no_healthy_upstream"
+	case errors.Is(err, errCircuitOpen):
+		return "circuit_open"
+	case errors.As(err, new(*http.MaxBytesError)):
+		return "request_too_large"
+	case isTimeout(err) || r.Context().Err() == context.DeadlineExceeded:
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+func writeProxyError(rw http.ResponseWriter, r *http.Request, err error, route *Route) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		WriteError(rw, r, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+	if errors.Is(err, errNoHealthyUpstream) {
+		status, message := route.NoHealthyStatus, route.NoHealthyMessage
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		if message == "" {
+			message = "no healthy upstream"
+		}
+		WriteError(rw, r, status, message)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		WriteError(rw, r, http.StatusServiceUnavailable, "upstream circuit open")
+		return
+	}
+	if isTimeout(err) || r.Context().Err() == context.DeadlineExceeded {
+		WriteError(rw, r, http.StatusGatewayTimeout, "upstream timed out")
+		return
+	}
+	WriteError(rw, r, http.StatusBadGateway, "")
+}
+
+// firedTimeout works out which of the route's timeouts err is from: the
+// total deadline, dial_timeout or header_timeout. It returns "" for errors
+// that aren't one of those.
+func firedTimeout(r *http.Request, err error, route *Route) (string, time.Duration) {
+	if r.Context().Err() == context.DeadlineExceeded {
+		var deadline time.Duration
+		if info := RequestInfoFromContext(r.Context()); info != nil {
+			deadline = info.Deadline()
+		}
+		return "total", deadline
+	}
+	if !isTimeout(err) {
+		return "", 0
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		if route.DialTimeout > 0 {
+			return "dial", route.DialTimeout
+		}
+		return "dial", defaultDialTimeout
+	}
+	if route.HeaderTimeout > 0 && strings.Contains(err.Error(), "awaiting response headers") {
+		return "header", route.HeaderTimeout
+	}
+	return "", 0
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
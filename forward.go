@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// NewForwardProxyHandler serves requests made to us as a forward proxy:
+// absolute-form requests (GET http://dest/ HTTP/1.1) and, when enabled,
+// CONNECT tunnels. Only destinations in the allowlist are reached, and
+// tunnels only to the allowed ports; others get a 403. Everything else goes to handler, so reverse-proxy routes are
+// unaffected. Forward proxy requests get an access log entry of their own.
+func NewForwardProxyHandler(config *Config, transport http.RoundTripper, handler http.Handler) http.Handler {
+	c := config.ForwardProxy
+	proxy := &httputil.ReverseProxy{
+		// The request URL already names the destination.
+		Director:     func(req *http.Request) {},
+		Transport:    transport,
+		ErrorHandler: NewProxyErrorHandler(&Route{}, nil),
+	}
+	forward := NewLogrusHandler(config, log.InfoLevel, func(rw http.ResponseWriter, r *http.Request) {
+		if !hostAllowed(stripPort(r.Host), c.AllowedHosts) {
+			WriteError(rw, r, http.StatusForbidden, "destination not allowed")
+			return
+		}
+		if r.Method == http.MethodConnect {
+			if !c.Connect {
+				WriteError(rw, r, http.StatusMethodNotAllowed, "CONNECT is not enabled")
+				return
+			}
+			if !connectPortAllowed(r.Host, c.ConnectPorts) {
+				WriteError(rw, r, http.StatusForbidden, "destination port not allowed")
+				return
+			}
+			tunnel(rw, r)
+			return
+		}
+		if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+			WriteError(rw, r, http.StatusBadRequest, "unsupported scheme")
+			return
+		}
+		proxy.ServeHTTP(rw, r)
+	})
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || r.URL.IsAbs() {
+			forward(rw, r)
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// How long to wait for a CONNECT destination to accept the connection.
+const tunnelDialTimeout = 10 * time.Second
+
+// The port CONNECT tunnels may reach when connect_ports is unset.
+const defaultConnectPort = 443
+
+// connectPortAllowed reports whether a CONNECT to hostport may go ahead.
+func connectPortAllowed(hostport string, allowed []int) bool {
+	_, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return false
+	}
+	if len(allowed) == 0 {
+		return port == defaultConnectPort
+	}
+	for _, a := range allowed {
+		if a == port {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel answers a CONNECT by connecting to the requested host:port and
+// relaying bytes both ways until either side closes.
+func tunnel(rw http.ResponseWriter, r *http.Request) {
+	dest, err := net.DialTimeout("tcp", r.Host, tunnelDialTimeout)
+	if err != nil {
+		log.WithField("destination", r.Host).WithError(err).Warn("CONNECT dial failed")
+		WriteError(rw, r, http.StatusBadGateway, "")
+		return
+	}
+	defer dest.Close()
+
+	// The 200 goes straight onto the connection: through the
+	// ResponseWriter it would announce a chunked body.
+	client, brw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		log.WithError(err).Error("CONNECT hijack failed")
+		WriteError(rw, r, http.StatusInternalServerError, "")
+		return
+	}
+	defer client.Close()
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// Anything the client sent after the CONNECT may already be
+		// buffered.
+		io.Copy(dest, brw)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, dest)
+		done <- struct{}{}
+	}()
+	<-done
+}
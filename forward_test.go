@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestForwardProxyConnect(t *testing.T) {
+	// A destination that echoes whatever it is sent.
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(dest.Addr().String())
+
+	tests := []struct {
+		name   string
+		ports  string
+		status int
+	}{
+		{"allowed port", "[" + port + "]", http.StatusOK},
+		{"other port", "[1]", http.StatusForbidden},
+		{"default port", "[]", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c Config
+			if err := yaml.Unmarshal([]byte("forward_proxy: {allowed_hosts: [127.0.0.1], connect: true, connect_ports: "+test.ports+"}\n"), &c); err != nil {
+				t.Fatal(err)
+			}
+			c.applyDefaults()
+			proxy := httptest.NewServer(NewForwardProxyHandler(&c, http.DefaultTransport, http.NotFoundHandler()))
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", dest.Addr())
+			br := bufio.NewReader(conn)
+			if test.status != http.StatusOK {
+				res, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.StatusCode != test.status {
+					t.Errorf("status = %d, want %d", res.StatusCode, test.status)
+				}
+				return
+			}
+
+			// Exactly a status line and the blank line: no headers, in
+			// particular no Transfer-Encoding.
+			for _, want := range []string{"HTTP/1.1 200 Connection Established\r\n", "\r\n"} {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if line != want {
+					t.Fatalf("response line %q, want %q", line, want)
+				}
+			}
+			io.WriteString(conn, "ping")
+			echo := make([]byte, 4)
+			if _, err := io.ReadFull(br, echo); err != nil {
+				t.Fatal(err)
+			}
+			if string(echo) != "ping" {
+				t.Errorf("tunnel echoed %q, want ping", echo)
+			}
+		})
+	}
+}
@@ -1,66 +1,333 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"gopkg.in/tylerb/graceful.v1"
-	"gopkg.in/yaml.v2"
-
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
-	"github.com/rs/cors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http/httpguts"
 )
 
-func NewRewriteReverseProxy(basePath string, redirectUrl string) *httputil.ReverseProxy {
-	target, err := url.Parse(redirectUrl)
+// NewRewriteReverseProxy proxies a route's requests, stripping basePath from
+// their paths. With pathPattern set, the part of the remaining path it
+// matches is replaced by the route's rewrite, if it has one.
+func NewRewriteReverseProxy(basePath string, route *Route, pathPattern *regexp.Regexp, balancer *Balancer, trusted CIDRList, resolver *net.Resolver, retryBudget *RetryBudget, idempotent []string) (*httputil.ReverseProxy, error) {
+	headerTemplates, err := parseHeaderTemplates(route.RequestHeaders)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	methodRewrite := make(map[string]string, len(route.MethodRewrite))
+	for from, to := range route.MethodRewrite {
+		methodRewrite[strings.ToUpper(from)] = strings.ToUpper(to)
 	}
-	targetQuery := target.RawQuery
+	maxHeaderValueBytes := route.MaxHeaderValueBytes
+	if maxHeaderValueBytes <= 0 {
+		maxHeaderValueBytes = defaultMaxHeaderValueBytes
+	}
+	addPrefix := strings.TrimSuffix(route.AddPrefix, "/")
+	if addPrefix != "" && !strings.HasPrefix(addPrefix, "/") {
+		addPrefix = "/" + addPrefix
+	}
+	escapedAddPrefix := (&url.URL{Path: addPrefix}).EscapedPath()
 	director := func(req *http.Request) {
+		// A route still waiting on discovery has no backend to pick; the
+		// balancer's transport fails the request.
+		target := &url.URL{}
+		if backend := balancer.PickFor(req); backend != nil {
+			target = backend.URL
+		}
+		targetQuery := target.RawQuery
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
+		if info := RequestInfoFromContext(req.Context()); info != nil {
+			info.SetUpstream(target.Host)
+		}
+		if route.MethodHandling == "normalize" || route.MethodHandling == "strict" {
+			req.Method = strings.ToUpper(req.Method)
+		}
+		if method, ok := methodRewrite[req.Method]; ok {
+			req.Method = method
+		}
 		req.URL.Path = strings.TrimPrefix(req.URL.Path, basePath)
+		if route.EncodedSlashes == "pass" {
+			// RawPath keeps escapes such as %2F but is only used while it
+			// still matches Path, so strip it the same way.
+			req.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, basePath)
+		} else {
+			req.URL.RawPath = ""
+		}
+		if pathPattern != nil && route.Rewrite != "" {
+			req.URL.Path = pathPattern.ReplaceAllString(req.URL.Path, route.Rewrite)
+			req.URL.RawPath = ""
+		}
+		if route.DuplicateSlashes == "collapse" {
+			if req.URL.RawPath != "" {
+				// Collapse only literal slashes, not ones encoded as %2F.
+				req.URL.RawPath = collapseSlashes(req.URL.RawPath)
+				req.URL.Path, _ = url.PathUnescape(req.URL.RawPath)
+			} else {
+				req.URL.Path = collapseSlashes(req.URL.Path)
+			}
+		}
+		if route.NormalizePath {
+			req.URL.Path = normalizePath(req.URL.Path)
+			req.URL.RawPath = ""
+		}
+		if addPrefix != "" {
+			req.URL.Path = addPrefix + req.URL.Path
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = escapedAddPrefix + req.URL.RawPath
+			}
+		}
 		if targetQuery == "" || req.URL.RawQuery == "" {
 			req.URL.RawQuery = targetQuery + req.URL.RawQuery
 		} else {
 			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
 		}
+		setForwardedFor(req, route.XFFMode)
+		switch route.ForwardedHeaders {
+		case "forwarded":
+			// Instead of X-Forwarded-For, however xff_mode would treat it.
+			delete(req.Header, passForwardedForHeader)
+			req.Header["X-Forwarded-For"] = nil
+			setForwarded(req)
+		case "both":
+			setForwarded(req)
+		}
+		if route.RewriteBody {
+			// Let the transport ask for gzip and decode it, so bodies
+			// arrive rewritable; compression can encode them again.
+			req.Header.Del("Accept-Encoding")
+		}
+		if route.StripExpectContinue {
+			// The body goes upstream straight away; we still send the client
+			// its 100 Continue as soon as the proxy starts reading it.
+			req.Header.Del("Expect")
+		}
+		if route.ForwardedPrefix {
+			// Tell prefix-aware backends what we stripped so they can build
+			// external URLs.
+			req.Header.Set("X-Forwarded-Prefix", basePath)
+		}
+		if route.ForwardedProtoHost {
+			setForwardedProtoHost(req, trusted)
+		}
+		for _, name := range route.StripRequestHeaders {
+			req.Header.Del(name)
+		}
+		setHeaderTemplates(req, headerTemplates, maxHeaderValueBytes)
+		if route.UpstreamHostHeader {
+			req.Host = target.Host
+		}
+		if route.ForwardClientCert {
+			setClientCertHeaders(req)
+		}
+		if route.AddVia {
+			// Add rather than Set so the chain of proxies is preserved.
+			req.Header.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, route.ViaName))
+		}
+	}
+
+	var modifiers []ResponseModifier
+	if len(route.StatusActions) > 0 {
+		actions := make(map[int]http.Handler, len(route.StatusActions))
+		for status, action := range route.StatusActions {
+			switch {
+			case action.Static != nil && action.Upstream == "":
+				actions[status], err = NewFallbackHandler(action.Static)
+			case action.Upstream != "" && action.Static == nil:
+				actions[status], err = newRedirectedProxy(action.Upstream, resolver)
+			default:
+				err = errors.New("set exactly one of static and upstream")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("status_actions %d: %v", status, err)
+			}
+		}
+		modifiers = append(modifiers, NewStatusActionModifier(actions))
+	}
+	if len(route.ErrorStatusCodes) > 0 {
+		modifiers = append(modifiers, NewErrorStatusModifier(route.ErrorStatusCodes))
+	}
+	if route.InterceptErrors {
+		modifiers = append(modifiers, NewInterceptErrorsModifier())
+	}
+	if len(route.StatusRemap) > 0 {
+		modifiers = append(modifiers, NewStatusRemapModifier(route.StatusRemap))
+	}
+	paths := publicPaths{basePath: strings.TrimSuffix(basePath, "/"), addPrefix: addPrefix}
+	if route.RewriteLocation {
+		modifiers = append(modifiers, NewLocationRewriteModifier(paths, balancer))
+	}
+	if len(route.StripResponseHeaders) > 0 {
+		modifiers = append(modifiers, NewStripHeadersModifier(route.StripResponseHeaders))
+	}
+	if route.Deprecation != nil {
+		modifier, err := NewDeprecationModifier(route.Deprecation)
+		if err != nil {
+			return nil, err
+		}
+		modifiers = append(modifiers, modifier)
+	}
+	if len(route.AddResponseHeaders) > 0 {
+		modifiers = append(modifiers, NewAddHeadersModifier(route.AddResponseHeaders, route.ForceResponseHeaders))
+	}
+	if route.ForceContentType != "" || len(route.ContentTypeMap) > 0 {
+		modifiers = append(modifiers, NewContentTypeModifier(route.ForceContentType, route.ContentTypeMap))
+	}
+	if route.Canary != nil && route.Canary.Sticky {
+		modifiers = append(modifiers, NewCanaryCookieModifier(balancer))
+	}
+	if route.Affinity != nil && route.Affinity.Type == "cookie" {
+		modifiers = append(modifiers, NewAffinityCookieModifier(balancer))
+	}
+	if route.AddServedBy {
+		modifiers = append(modifiers, NewServedByModifier(route.ServedByName))
+	}
+	if route.AddVia {
+		modifiers = append(modifiers, NewViaModifier(route.ViaName))
+	}
+	if route.IdleReadTimeout > 0 {
+		modifiers = append(modifiers, NewIdleReadTimeoutModifier(route.IdleReadTimeout))
+	}
+	if route.MaxResponseBytes > 0 {
+		modifiers = append(modifiers, NewMaxResponseBytesModifier(route.MaxResponseBytes))
+	}
+	if route.RewriteBody {
+		maxBytes := route.RewriteBodyMaxBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultRewriteBodyMaxBytes
+		}
+		modifiers = append(modifiers, NewBodyRewriteModifier(paths, balancer, maxBytes))
+	}
+	if route.BufferResponse {
+		maxBytes := route.BufferMaxBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultBufferMaxBytes
+		}
+		modifiers = append(modifiers, NewBufferResponseModifier(maxBytes))
+	}
+
+	var fallback http.Handler
+	if route.Fallback != nil {
+		fallback, err = NewFallbackHandler(route.Fallback)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Innermost, so each attempt at an upstream gets its own span.
+	var transport http.RoundTripper = tracingTransport{NewRouteTransport(route, resolver)}
+	if len(balancer.Backends()) > 1 || route.HealthCheck != nil || route.CircuitBreaker != nil || route.Discovery != nil {
+		transport = balancer.Transport(transport, !route.DisableDialRetry)
+	}
+	if route.Retry != nil {
+		transport, err = NewRetryTransport(route.Retry, balancer, retryBudget, idempotent, transport)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if route.Mirror != nil {
+		transport, err = NewMirrorTransport(route.Mirror, route, resolver, transport)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %v", err)
+		}
+	}
+	if route.XFFMode == "trust" {
+		transport = passForwardedForTransport{transport}
 	}
-	return &httputil.ReverseProxy{Director: director}
+
+	// Upstream redirects reach the client untouched: ReverseProxy sends
+	// requests through an http.RoundTripper, which never follows them
+	// (only http.Client does, via CheckRedirect).
+	return &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      transport,
+		ModifyResponse: chainResponseModifiers(modifiers),
+		ErrorHandler:   NewProxyErrorHandler(route, fallback),
+		FlushInterval:  route.FlushInterval,
+	}, nil
 }
 
-type Config struct {
-	Routes map[string]string
+// newRedirectedProxy resends an already directed request (the one the proxy
+// hands its error handler) to another upstream. Path and headers are final,
+// X-Forwarded-For included, so only the destination changes.
+func newRedirectedProxy(upstream string, resolver *net.Resolver) (http.Handler, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			setForwardedFor(req, "trust")
+		},
+		Transport:    passForwardedForTransport{NewRouteTransport(&Route{}, resolver)},
+		ErrorHandler: NewProxyErrorHandler(&Route{}, nil),
+	}, nil
 }
 
 type StatusLoggingResponseWriter struct {
-	status int
+	status   int
+	bytes    int64
+	hijacked bool
 	http.ResponseWriter
 }
 
 func NewStatusLoggingResponseWriter(res http.ResponseWriter) *StatusLoggingResponseWriter {
 	// Default the status code to 200.
-	return &StatusLoggingResponseWriter{200, res}
+	return &StatusLoggingResponseWriter{status: 200, ResponseWriter: res}
 }
 
 func (w *StatusLoggingResponseWriter) Status() int {
 	return w.status
 }
 
+// BytesWritten is how much of the response body has been written.
+func (w *StatusLoggingResponseWriter) BytesWritten() int64 {
+	return w.bytes
+}
+
+// Hijack notes that the connection was taken over. ReverseProxy writes the
+// 101 of an upgrade straight onto the hijacked connection, past WriteHeader.
+func (w *StatusLoggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// noteUpgrade records the 101 of an upgrade that went through Hijack, once
+// the handler for r is done.
+func (w *StatusLoggingResponseWriter) noteUpgrade(r *http.Request) {
+	if w.hijacked && isUpgradeRequest(r) {
+		w.status = http.StatusSwitchingProtocols
+	}
+}
+
 // Satisfy the http.ResponseWriter interface.
 func (w *StatusLoggingResponseWriter) Header() http.Header {
 	return w.ResponseWriter.Header()
 }
 
 func (w *StatusLoggingResponseWriter) Write(data []byte) (int, error) {
-	return w.ResponseWriter.Write(data)
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
 }
 
 func (w *StatusLoggingResponseWriter) WriteHeader(statusCode int) {
@@ -71,52 +338,624 @@ func (w *StatusLoggingResponseWriter) WriteHeader(statusCode int) {
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
-func NewLogrusHandler(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// the proxy needs to hijack the connection for protocol upgrades.
+func (w *StatusLoggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// NewLogrusHandler logs each request at level once it completes, or at debug
+// for paths in log_exclude_paths.
+func NewLogrusHandler(config *Config, level log.Level, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
 		loggingWriter := NewStatusLoggingResponseWriter(rw)
+		r, info := WithRequestInfo(r)
+		if config.LogUpstreamTimings {
+			r = r.WithContext(info.TraceUpstream(r.Context()))
+		}
 		handler(loggingWriter, r)
 
 		latency := time.Since(start)
-		entry := log.WithFields(log.Fields{
+		loggingWriter.noteUpgrade(r)
+		fields := log.Fields{
 			"request":     r.RequestURI,
 			"method":      r.Method,
 			"remote":      r.RemoteAddr,
 			"status":      loggingWriter.Status(),
 			"text_status": http.StatusText(loggingWriter.Status()),
 			"latency":     latency,
-		})
-
+			"bytes":       loggingWriter.BytesWritten(),
+			"latency_ms":  float64(latency) / float64(time.Millisecond),
+			"user_agent":  r.UserAgent(),
+			"referer":     r.Referer(),
+			"host":        r.Host,
+			"proto":       r.Proto,
+		}
 		if reqID := r.Header.Get("X-Request-Id"); reqID != "" {
-			entry = entry.WithField("request_id", reqID)
+			fields["request_id"] = reqID
+		}
+		for _, header := range config.CorrelationHeaders {
+			if value := r.Header.Get(header); value != "" {
+				fields[correlationLogField(header)] = value
+			}
+		}
+		if upstream := info.Upstream(); upstream != "" {
+			attempts := info.Attempts()
+			fields["upstream_instance"] = upstream
+			fields["attempts"] = attempts
+			fields["retried"] = attempts > 1
+		}
+		if config.RequestStartHeader != "" && fromTrustedProxy(r, config.TrustedProxies) {
+			if edgeStart, ok := parseRequestStart(r.Header.Get(config.RequestStartHeader)); ok {
+				fields["edge_latency_ms"] = float64(start.Sub(edgeStart)) / float64(time.Millisecond)
+			}
+		}
+		if config.LogUpstreamTimings {
+			for name, value := range info.UpstreamTimingFields() {
+				fields[name] = value
+			}
+		}
+		entry := log.WithFields(selectLogFields(fields, config))
+		if pathExcludedFromLog(r.URL.Path, config.LogExcludePaths) {
+			// Probes and scrapes are still visible with debug logging on.
+			entry.Debug("completed handling request")
+		} else {
+			logAtLevel(entry, level, "completed handling request")
+		}
+	}
+}
+
+// accessLogFields are the fields log_fields can pick from, besides the
+// correlation headers' and upstream timings'.
+var accessLogFields = []string{
+	"request", "method", "remote", "status", "text_status", "latency", "bytes",
+	"latency_ms", "user_agent", "referer", "host", "proto", "request_id",
+	"upstream_instance", "attempts", "retried", "edge_latency_ms",
+}
+
+// selectLogFields narrows an access log entry to config.LogFields, or
+// without those drops the fields that are off unless their own setting
+// turns them on.
+func selectLogFields(fields log.Fields, config *Config) log.Fields {
+	if len(config.LogFields) > 0 {
+		selected := make(log.Fields, len(config.LogFields))
+		for _, name := range config.LogFields {
+			if value, ok := fields[name]; ok {
+				selected[name] = value
+			}
+		}
+		return selected
+	}
+	for name, enabled := range map[string]bool{
+		"latency_ms": config.LogLatencyMs,
+		"user_agent": config.LogUserAgent,
+		"referer":    config.LogReferer,
+		"host":       false,
+		"proto":      false,
+	} {
+		if !enabled {
+			delete(fields, name)
+		}
+	}
+	return fields
+}
+
+// parseRequestStart reads an X-Request-Start style timestamp, guessing the
+// unit from its magnitude: "t=1700000000.123", "1700000000123" (millis) and
+// "1700000000123456" (micros) all work.
+func parseRequestStart(value string) (time.Time, bool) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "t=")
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}, false
+	}
+	switch {
+	case n > 1e15:
+		n /= 1e6
+	case n > 1e12:
+		n /= 1e3
+	}
+	return time.Unix(0, int64(n*float64(time.Second))), true
+}
+
+func logAtLevel(entry *log.Entry, level log.Level, msg string) {
+	switch level {
+	case log.DebugLevel:
+		entry.Debug(msg)
+	case log.WarnLevel:
+		entry.Warn(msg)
+	case log.ErrorLevel:
+		entry.Error(msg)
+	default:
+		entry.Info(msg)
+	}
+}
+
+// pathExcludedFromLog matches path against exact entries and entries ending
+// in "*", which match as a prefix.
+func pathExcludedFromLog(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// muxHostTemplate turns a leading "*." wildcard into the equivalent mux
+// pattern. Anything else is already a mux host template.
+func muxHostTemplate(host string) string {
+	if strings.HasPrefix(host, "*.") {
+		return "{subdomain:[^.]+}" + host[1:]
+	}
+	return host
+}
+
+// A Router serves every route, and owns the balancers behind them.
+type Router struct {
+	http.Handler
+	balancers map[string]*Balancer
+	caches    map[string]*RouteCaches
+}
+
+// Close stops the routes' health checks once the router is no longer used.
+func (router *Router) Close() {
+	for _, balancer := range router.balancers {
+		balancer.Close()
+	}
+}
+
+// buildRouter registers the well-known files and every enabled route, each
+// behind its middleware chain, and starts health checks for the routes that
+// have them. Invalid route settings are returned as errors, so a bad reload
+// leaves the running routes in place.
+func buildRouter(config *Config, middleware *MiddlewareSet, resolver *net.Resolver) (*Router, error) {
+	root := mux.NewRouter().StrictSlash(true)
+	// By default mux redirects paths with duplicate slashes or dot segments
+	// to their cleaned form before routing.
+	root.SkipClean(config.PreserveRawPaths)
+	// Everything the frontend serves lives under the global base path.
+	r := root
+	if config.BasePath != "" {
+		r = root.PathPrefix(config.BasePath).Subrouter()
+	}
+
+	// Well-known files answered locally are registered first so they take
+	// precedence over any overlapping route.
+	for _, wellKnown := range []struct {
+		path        string
+		content     *StaticContent
+		defaultType string
+	}{
+		{"/robots.txt", config.RobotsTxt, "text/plain; charset=utf-8"},
+		{"/favicon.ico", config.Favicon, "image/x-icon"},
+	} {
+		if wellKnown.content == nil {
+			continue
+		}
+		handler, err := NewStaticContentHandler(wellKnown.content, wellKnown.defaultType)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", wellKnown.path, err)
+		}
+		r.Handle(wellKnown.path, handler).Methods(http.MethodGet, http.MethodHead)
+	}
+
+	balancers := make(map[string]*Balancer)
+	caches := make(map[string]*RouteCaches)
+	discoverers := make(map[string]discoverer)
+	if config.HealthzPath != "" {
+		r.Handle(config.HealthzPath, NewHealthzHandler(balancers)).Methods(http.MethodGet, http.MethodHead)
+	}
+
+	// Create the reverse proxy paths specified in the config.
+	for _, name := range config.orderedRouteNames() {
+		route := config.Routes[name]
+		if !route.IsEnabled() {
+			log.WithField("route", name).Warn("route disabled")
+			continue
+		}
+		if route.RequireClientCert && (config.TLS == nil || config.TLS.ClientAuth == "" || config.TLS.ClientAuth == "none") {
+			return nil, fmt.Errorf("route %s requires client certificates but tls.client_auth is not enabled", name)
+		}
+		if route.DuplicateSlashes != "" && route.DuplicateSlashes != "pass" && route.DuplicateSlashes != "collapse" {
+			return nil, fmt.Errorf("route %s: unknown duplicate_slashes %q (valid: pass, collapse)", name, route.DuplicateSlashes)
+		}
+		switch route.EncodedSlashes {
+		case "", "decode", "pass", "reject":
+		default:
+			return nil, fmt.Errorf("route %s: unknown encoded_slashes %q (valid: decode, pass, reject)", name, route.EncodedSlashes)
+		}
+		if route.RequireTLS != "" && route.RequireTLS != "redirect" && route.RequireTLS != "reject" {
+			return nil, fmt.Errorf("route %s: unknown require_tls %q (valid: redirect, reject)", name, route.RequireTLS)
+		}
+		switch route.MethodHandling {
+		case "", "pass", "normalize", "strict":
+		default:
+			return nil, fmt.Errorf("route %s: unknown method_handling %q (valid: pass, normalize, strict)", name, route.MethodHandling)
+		}
+		switch route.ForwardedHeaders {
+		case "", "x-forwarded", "forwarded", "both":
+		default:
+			return nil, fmt.Errorf("route %s: unknown forwarded_headers %q (valid: x-forwarded, forwarded, both)", name, route.ForwardedHeaders)
+		}
+		switch route.XFFMode {
+		case "", "append", "replace", "trust":
+		default:
+			return nil, fmt.Errorf("route %s: unknown xff_mode %q (valid: append, replace, trust)", name, route.XFFMode)
+		}
+		if route.CORS != nil {
+			if err := validateCORSConfig(mergeCORSConfig(config.CORS, route.CORS)); err != nil {
+				return nil, fmt.Errorf("route %s: cors: %v", name, err)
+			}
+		}
+		if route.ErrorPages != nil {
+			if _, err := NewErrorPages(config.ErrorPages, route.ErrorPages); err != nil {
+				return nil, fmt.Errorf("route %s: %v", name, err)
+			}
+		}
+		if route.Auth != nil {
+			if err := validateAuthConfig(route.Auth); err != nil {
+				return nil, fmt.Errorf("route %s: auth: %v", name, err)
+			}
+		}
+		if route.HealthCheck != nil {
+			if err := checkJitter(route.HealthCheck.Jitter); err != nil {
+				return nil, fmt.Errorf("route %s: health_check: %v", name, err)
+			}
+			if method := route.HealthCheck.Method; method != "" && !httpguts.ValidHeaderFieldName(method) {
+				return nil, fmt.Errorf("route %s: health_check: invalid method %q", name, method)
+			}
+			for _, status := range route.HealthCheck.ExpectedStatus {
+				if status < 100 || status > 599 {
+					return nil, fmt.Errorf("route %s: health_check: expected_status %d isn't a status code", name, status)
+				}
+			}
+		}
+		for _, status := range route.ErrorStatusCodes {
+			if status < 100 || status > 599 {
+				return nil, fmt.Errorf("route %s: error_status_codes: %d isn't a status code", name, status)
+			}
+		}
+		if route.NoHealthyStatus != 0 && (route.NoHealthyStatus < 400 || route.NoHealthyStatus > 599) {
+			return nil, fmt.Errorf("route %s: no_healthy_status %d isn't an error status", name, route.NoHealthyStatus)
+		}
+		switch route.AuthFailMode {
+		case "", "open", "closed":
+		default:
+			return nil, fmt.Errorf("route %s: unknown auth_fail_mode %q (valid: open, closed)", name, route.AuthFailMode)
+		}
+		if route.Compress != nil {
+			for _, encoding := range route.Compress.Encodings {
+				if encoding != "br" && encoding != "gzip" {
+					return nil, fmt.Errorf("route %s: compress: unknown encoding %q (valid: br, gzip)", name, encoding)
+				}
+			}
+			for encoding, level := range route.Compress.Level {
+				levels, ok := compressLevels[encoding]
+				if !ok {
+					return nil, fmt.Errorf("route %s: compress: level for unknown encoding %q (valid: br, gzip)", name, encoding)
+				}
+				if level < levels.min || level > levels.max {
+					return nil, fmt.Errorf("route %s: compress: %s level %d out of range %d-%d", name, encoding, level, levels.min, levels.max)
+				}
+			}
+		}
+		if route.RateLimit != nil && route.RateLimit.Rate <= 0 {
+			return nil, fmt.Errorf("route %s: rate_limit: rate must be positive", name)
+		}
+		if route.UpstreamH2C && (route.UpstreamHTTP2 || route.DisableUpstreamKeepAlives) {
+			return nil, fmt.Errorf("route %s: upstream_h2c can't be combined with upstream_http2 or disable_upstream_keep_alives", name)
+		}
+		basePath, pathPrefix := fmt.Sprintf("%s/%s", config.BasePath, route.Prefix), fmt.Sprintf("/%s/", route.Prefix)
+		if route.Prefix == "" {
+			basePath, pathPrefix = config.BasePath, "/"
+		}
+		var pathPattern *regexp.Regexp
+		switch route.Match {
+		case "", "prefix":
+			if route.Rewrite != "" {
+				return nil, fmt.Errorf("route %s: rewrite needs match exact or regex; prefix routes use add_prefix", name)
+			}
+		case "exact", "regex":
+			if route.Path == "" {
+				return nil, fmt.Errorf("route %s: match %s needs a path", name, route.Match)
+			}
+			expr := route.Path
+			if route.Match == "exact" {
+				if !strings.HasPrefix(route.Path, "/") {
+					return nil, fmt.Errorf("route %s: path must start with /", name)
+				}
+				expr = "^" + regexp.QuoteMeta(route.Path) + "$"
+			}
+			var err error
+			if pathPattern, err = regexp.Compile(expr); err != nil {
+				return nil, fmt.Errorf("route %s: path: %v", name, err)
+			}
+			basePath = config.BasePath
+		default:
+			return nil, fmt.Errorf("route %s: unknown match %q (valid: prefix, exact, regex)", name, route.Match)
+		}
+		if route.PreservePath {
+			if route.Rewrite != "" {
+				return nil, fmt.Errorf("route %s: set only one of preserve_path and rewrite", name)
+			}
+			basePath = ""
+		}
+		var (
+			handler http.Handler
+			err     error
+		)
+		switch route.Type {
+		case "static":
+			handler, err = NewFileServerHandler(basePath, route.Static)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", name, err)
+			}
+		case "", "proxy":
+			given := 0
+			for _, set := range []bool{route.Upstream != "", len(route.Upstreams) > 0, route.Canary != nil, route.Discovery != nil} {
+				if set {
+					given++
+				}
+			}
+			if given > 1 {
+				return nil, fmt.Errorf("route %s: set only one of upstream, upstreams, canary and discovery", name)
+			}
+			upstreams := route.upstreamURLs()
+			if route.Discovery != nil {
+				discover, err := newDiscoverer(route.Discovery, resolver)
+				if err != nil {
+					return nil, fmt.Errorf("route %s: discovery: %v", name, err)
+				}
+				timeout := config.DiscoveryStartupTimeout
+				if timeout <= 0 {
+					timeout = discoveryTimeout
+				}
+				upstreams, err = discover.discover(timeout)
+				switch {
+				case err != nil && config.DiscoveryStartupTimeout > 0:
+					log.WithField("route", name).WithError(err).
+						Error("upstream discovery failed or timed out, serving the route without upstreams until it succeeds")
+				case err != nil:
+					return nil, fmt.Errorf("route %s: discovery: %v", name, err)
+				}
+				discoverers[name] = discover
+			} else if len(upstreams) == 0 {
+				return nil, fmt.Errorf("route %s: no upstream", name)
+			}
+			var balancer *Balancer
+			balancer, err = NewBalancer(name, upstreams, route.Balance)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", name, err)
+			}
+			if len(route.Backup) > 0 {
+				if route.Canary != nil || route.Discovery != nil {
+					return nil, fmt.Errorf("route %s: backup only applies to upstream and upstreams", name)
+				}
+				if err = balancer.AddBackups(route.Backup); err != nil {
+					return nil, fmt.Errorf("route %s: %v", name, err)
+				}
+			}
+			if len(route.Weights) > 0 {
+				if route.Balance != "weighted" {
+					return nil, fmt.Errorf("route %s: weights need balance: weighted", name)
+				}
+				if len(route.Upstreams) == 0 {
+					return nil, fmt.Errorf("route %s: weights only apply to upstreams", name)
+				}
+				if err = balancer.SetWeights(route.Weights); err != nil {
+					return nil, fmt.Errorf("route %s: %v", name, err)
+				}
+			}
+			balancer.ExportMetrics(middleware.metrics)
+			balancer.CountAsErrors(route.ErrorStatusCodes)
+			if route.Canary != nil {
+				if err = balancer.SplitByVersion(route.Canary); err != nil {
+					return nil, fmt.Errorf("route %s: %v", name, err)
+				}
+			}
+			if route.Affinity != nil {
+				if err = balancer.SetAffinity(route.Affinity, config.TrustedProxies); err != nil {
+					return nil, fmt.Errorf("route %s: %v", name, err)
+				}
+			}
+			if route.CircuitBreaker != nil {
+				balancer.EnableCircuitBreakers(route.CircuitBreaker)
+			}
+			balancers[name] = balancer
+			handler, err = NewRewriteReverseProxy(basePath, route, pathPattern, balancer, config.TrustedProxies, resolver, middleware.retryBudget, config.IdempotentMethods)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", name, err)
+			}
+		default:
+			return nil, fmt.Errorf("route %s: unknown type %q (valid: proxy, static)", name, route.Type)
+		}
+		muxRoute := r.NewRoute()
+		if pathPattern != nil {
+			muxRoute = muxRoute.MatcherFunc(matchPath(config.BasePath, pathPattern))
+		} else {
+			muxRoute = muxRoute.PathPrefix(pathPrefix)
+		}
+		if route.Host != "" {
+			muxRoute = muxRoute.Host(muxHostTemplate(route.Host))
+		}
+		for key, value := range route.Queries {
+			muxRoute = muxRoute.Queries(key, value)
+		}
+		routeCaches := middleware.NewRouteCaches(name, route)
+		if routeCaches != nil {
+			caches[name] = routeCaches
+		}
+		muxRoute.Handler(middleware.Chain(name, route, routeCaches, handler))
+	}
+
+	for name, balancer := range balancers {
+		if check := config.Routes[name].HealthCheck; check != nil {
+			balancer.StartHealthChecks(check, NewRouteTransport(&Route{}, resolver))
+		}
+		if discover, ok := discoverers[name]; ok {
+			balancer.StartDiscovery(discover, config.Routes[name].Discovery.Interval)
 		}
-		entry.Info("completed handling request")
 	}
+	return &Router{Handler: root, balancers: balancers, caches: caches}, nil
 }
 
-func NewCombinedHandler(handler func(http.ResponseWriter, *http.Request)) http.Handler {
-	return cors.Default().Handler(http.HandlerFunc(NewLogrusHandler(handler)))
+// matchPath matches requests whose path, once basePath is stripped,
+// pattern matches.
+func matchPath(basePath string, pattern *regexp.Regexp) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		if !strings.HasPrefix(r.URL.Path, basePath) {
+			return false
+		}
+		return pattern.MatchString(strings.TrimPrefix(r.URL.Path, basePath))
+	}
 }
 
 func main() {
-	configFile, err := ioutil.ReadFile("config.yaml")
+	options, err := parseOptions(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if options.Validate || options.PrintConfig {
+		os.Exit(checkConfig(options))
+	}
+	config, err := loadConfig(options)
+	if err != nil {
+		logConfigErrors(err)
+	}
+	if err := validateConfig(&config); err != nil {
+		logConfigErrors(err)
+	}
+	if err := setupLogOutput(&config); err != nil {
+		log.Fatal(err)
+	}
+
+	longLived := NewLongLivedTracker()
+	inFlight := NewInFlightTracker()
+
+	middleware, err := NewMiddlewareSet(&config, longLived, inFlight)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	var config Config
-	err = yaml.Unmarshal(configFile, &config)
+	resolver, err := NewResolver(config.Resolver)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	r := mux.NewRouter().StrictSlash(true)
+	router, err := buildRouter(&config, middleware, resolver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	routes := NewSwappableHandler(router)
+	reloader := NewConfigReloader(options, &config, middleware, resolver, router, routes)
+	go reloader.ReloadOnSignal()
 
-	// Create the reverse proxy paths specified in the config.
-	for base, redirectPath := range config.Routes {
-		proxy := NewRewriteReverseProxy(fmt.Sprintf("/%s", base), redirectPath)
-		r.NewRoute().PathPrefix(fmt.Sprintf("/%s/", base)).Handler(NewCombinedHandler(proxy.ServeHTTP))
+	var public http.Handler = routes
+	if config.RequireHost || len(config.AllowedHosts) > 0 {
+		var healthz string
+		if config.HealthzPath != "" {
+			healthz = config.BasePath + config.HealthzPath
+		}
+		public = NewHostCheckHandler(config.AllowedHosts, healthz, public)
+	}
+	if config.ForwardProxy != nil {
+		// Outside the host check: forward proxy requests carry the
+		// destination's Host.
+		public = NewForwardProxyHandler(&config, NewRouteTransport(&Route{}, resolver), public)
+	}
+	public = NewMaxURLLengthHandler(config.MaxURLLength, public)
+
+	var autocertManager *autocert.Manager
+	plain := public
+	if config.TLS != nil {
+		if config.TLS.RedirectHTTP {
+			_, httpsPort, _ := net.SplitHostPort(config.TLS.Listen)
+			plain = NewRequireTLSHandler("redirect", config.TrustedProxies, httpsPort, plain)
+		}
+		if config.TLS.Autocert != nil {
+			autocertManager, err = NewAutocertManager(config.TLS.Autocert)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// HTTP-01 challenges arrive on the plain listener, ahead of any
+			// redirect.
+			plain = autocertManager.HTTPHandler(plain)
+		}
+	}
+
+	server := NewServer(config.Listen, plain, &config)
+	server.ShutdownInitiated = longLived.CloseAll
+	if config.H2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	listeners := []Listener{{
+		Name:                "http",
+		Server:              server,
+		MaxConnections:      config.MaxConnections,
+		MaxConnectionsPerIP: config.MaxConnectionsPerIP,
+		TrustedProxies:      config.TrustedProxies,
+	}}
+
+	if config.TLS != nil {
+		tlsConfig, err := NewTLSConfig(config.TLS, autocertManager)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsServer := NewServer(config.TLS.Listen, public, &config)
+		tlsServer.ShutdownInitiated = longLived.CloseAll
+		listeners = append(listeners, Listener{
+			Name:                "https",
+			Server:              tlsServer,
+			TLSConfig:           tlsConfig,
+			MaxConnections:      config.MaxConnections,
+			MaxConnectionsPerIP: config.MaxConnectionsPerIP,
+			TrustedProxies:      config.TrustedProxies,
+		})
 	}
-	graceful.Run(":8080", 10*time.Second, r)
+
+	if config.Admin != nil {
+		adminServer := NewServer(config.Admin.Listen, NewAdminRouter(&config, inFlight, middleware.metrics, reloader), &config)
+		listeners = append(listeners, Listener{Name: "admin", Server: adminServer, Optional: !config.Admin.Strict})
+	}
+
+	if config.Metrics != nil {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle(config.BasePath+config.Metrics.Path, middleware.metrics.Handler())
+		metricsServer := NewServer(config.Metrics.Listen, metricsMux, &config)
+		listeners = append(listeners, Listener{Name: "metrics", Server: metricsServer, Optional: !config.Metrics.Strict})
+	}
+
+	for name, delay := range config.ShutdownDelays {
+		found := false
+		for i := range listeners {
+			if listeners[i].Name == name {
+				listeners[i].StopDelay = delay
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("shutdown_delays: no %s listener", name)
+		}
+	}
+
+	upgrader := NewUpgrader(config.PIDFile)
+	if config.GracefulRestart {
+		upgrader.HandleSignals()
+	}
+
+	log.WithField("keep_alives", !config.DisableKeepAlives).Info("starting frontend")
+	ServeAll(listeners, upgrader, &config)
+
+	// The listeners are closed and requests have drained; flush anything still
+	// buffered before we exit.
+	runShutdownHooks()
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// newTestRouter builds the router for a config given as YAML.
+func newTestRouter(t *testing.T, config string) *Router {
+	t.Helper()
+	var c Config
+	if err := yaml.Unmarshal([]byte(config), &c); err != nil {
+		t.Fatal(err)
+	}
+	c.applyDefaults()
+	middleware, err := NewMiddlewareSet(&c, NewLongLivedTracker(), NewInFlightTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := buildRouter(&c, middleware, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.Close)
+	return router
+}
+
+func TestUpstreamRedirect(t *testing.T) {
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/done" {
+			t.Error("proxy followed the redirect")
+		}
+		http.Redirect(rw, r, upstream.URL+"/done?x=1", http.StatusFound)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name     string
+		config   string
+		location string
+	}{
+		{"passed through", "routes:\n  app: " + upstream.URL + "\n", upstream.URL + "/done?x=1"},
+		{"rewritten", "routes:\n  app:\n    upstream: " + upstream.URL + "\n    rewrite_location: true\n", "/app/done?x=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter(t, test.config)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/start", nil))
+			if rec.Code != http.StatusFound {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusFound)
+			}
+			if got := rec.Header().Get("Location"); got != test.location {
+				t.Errorf("Location = %q, want %q", got, test.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// Default cap on a rendered request_headers value, in bytes.
+const defaultMaxHeaderValueBytes = 4 << 10
+
+// A headerTemplate renders one upstream request header per request.
+type headerTemplate struct {
+	name string
+	tmpl *template.Template
+}
+
+// parseHeaderTemplates compiles a route's request_headers, so a bad
+// template stops the frontend at startup rather than failing per request.
+func parseHeaderTemplates(headers map[string]string) ([]headerTemplate, error) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	templates := make([]headerTemplate, 0, len(names))
+	for _, name := range names {
+		tmpl, err := template.New(name).Parse(headers[name])
+		if err == nil {
+			// Also catch references to fields that don't exist, which
+			// only show up when the template runs.
+			err = tmpl.Execute(ioutil.Discard, headerTemplateData{&http.Request{Header: http.Header{}, URL: &url.URL{}}})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("request_headers %s: %v", name, err)
+		}
+		templates = append(templates, headerTemplate{name, tmpl})
+	}
+	return templates, nil
+}
+
+// setHeaderTemplates renders each template against req and sets the result.
+// A header whose template fails to render, or renders to something longer
+// than maxBytes or containing line breaks, is left out: sending it could get
+// the whole request rejected upstream.
+func setHeaderTemplates(req *http.Request, templates []headerTemplate, maxBytes int) {
+	data := headerTemplateData{req}
+	for _, t := range templates {
+		var value strings.Builder
+		if err := t.tmpl.Execute(&value, data); err != nil {
+			log.WithField("header", t.name).WithError(err).Warn("rendering request header failed")
+			continue
+		}
+		if value.Len() > maxBytes {
+			log.WithFields(log.Fields{
+				"header": t.name,
+				"bytes":  value.Len(),
+				"max":    maxBytes,
+			}).Warn("rendered request header too long, leaving it out")
+			continue
+		}
+		if strings.ContainsAny(value.String(), "\r\n") {
+			log.WithField("header", t.name).Warn("rendered request header contains a line break, leaving it out")
+			continue
+		}
+		req.Header.Set(t.name, value.String())
+	}
+}
+
+// headerTemplateData is what request_headers templates can use, e.g.
+// {{.PathVar "tenant"}} for a variable captured by the route's host or query
+// patterns.
+type headerTemplateData struct {
+	req *http.Request
+}
+
+func (d headerTemplateData) PathVar(name string) string {
+	return mux.Vars(d.req)[name]
+}
+
+func (d headerTemplateData) Header(name string) string {
+	return d.req.Header.Get(name)
+}
+
+func (d headerTemplateData) Query(name string) string {
+	return d.req.URL.Query().Get(name)
+}
+
+func (d headerTemplateData) Host() string {
+	return d.req.Host
+}
+
+func (d headerTemplateData) Path() string {
+	return d.req.URL.Path
+}
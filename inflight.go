@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InFlightTracker records every request currently being proxied so they can
+// be inspected through the admin listener when the frontend seems stuck.
+type InFlightTracker struct {
+	mu       sync.Mutex
+	nextID   uint64
+	requests map[uint64]*inFlightRequest
+}
+
+type inFlightRequest struct {
+	requestID string
+	route     string
+	method    string
+	path      string
+	start     time.Time
+	info      *RequestInfo
+}
+
+func NewInFlightTracker() *InFlightTracker {
+	return &InFlightTracker{requests: make(map[uint64]*inFlightRequest)}
+}
+
+// Wrap registers each request to route for as long as handler is running,
+// including when it panics.
+func (t *InFlightTracker) Wrap(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		entry := &inFlightRequest{
+			requestID: r.Header.Get("X-Request-Id"),
+			route:     route,
+			method:    r.Method,
+			path:      r.URL.RequestURI(),
+			start:     time.Now(),
+			info:      RequestInfoFromContext(r.Context()),
+		}
+
+		t.mu.Lock()
+		id := t.nextID
+		t.nextID++
+		t.requests[id] = entry
+		t.mu.Unlock()
+
+		defer func() {
+			t.mu.Lock()
+			delete(t.requests, id)
+			t.mu.Unlock()
+		}()
+
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+type inFlightJSON struct {
+	RequestID string    `json:"request_id,omitempty"`
+	Route     string    `json:"route"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Start     time.Time `json:"start"`
+	Duration  string    `json:"duration"`
+	Upstream  string    `json:"upstream,omitempty"`
+}
+
+// ServeHTTP dumps the in-flight requests as JSON, oldest first.
+func (t *InFlightTracker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	t.mu.Lock()
+	requests := make([]inFlightJSON, 0, len(t.requests))
+	for _, entry := range t.requests {
+		dumped := inFlightJSON{
+			RequestID: entry.requestID,
+			Route:     entry.route,
+			Method:    entry.method,
+			Path:      entry.path,
+			Start:     entry.start,
+			Duration:  now.Sub(entry.start).String(),
+		}
+		if entry.info != nil {
+			dumped.Upstream = entry.info.Upstream()
+		}
+		requests = append(requests, dumped)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Start.Before(requests[j].Start) })
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(requests)
+}
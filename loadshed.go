@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults for load_shed settings left unset.
+const (
+	defaultLoadShedInterval   = time.Second
+	defaultLoadShedRetryAfter = 5 * time.Second
+)
+
+// A LoadCheck reports whether the process is too loaded to take on more
+// requests, and if so why.
+type LoadCheck func() (overloaded bool, reason string)
+
+// A LoadShedder turns new requests away with a 503 while any of its checks
+// reports overload, so the process degrades gracefully instead of being OOM
+// killed. Checks run periodically rather than per request; reading memory
+// stats stops the world. Requests already admitted carry on.
+type LoadShedder struct {
+	retryAfter string
+	shedding   int32
+
+	mu     sync.Mutex
+	checks []LoadCheck
+}
+
+// NewLoadShedder starts polling the checks configured in c. More can be added
+// with AddCheck.
+func NewLoadShedder(c *LoadShedConfig) *LoadShedder {
+	interval := c.CheckInterval
+	if interval <= 0 {
+		interval = defaultLoadShedInterval
+	}
+	retryAfter := c.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultLoadShedRetryAfter
+	}
+	s := &LoadShedder{retryAfter: strconv.Itoa(int((retryAfter + time.Second - 1) / time.Second))}
+	if c.MaxHeapBytes > 0 {
+		s.AddCheck(heapCheck(c.MaxHeapBytes))
+	}
+	go func() {
+		for range time.Tick(interval) {
+			s.poll()
+		}
+	}()
+	return s
+}
+
+// AddCheck adds a check to those polled.
+func (s *LoadShedder) AddCheck(check LoadCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks = append(s.checks, check)
+}
+
+func (s *LoadShedder) poll() {
+	s.mu.Lock()
+	checks := s.checks
+	s.mu.Unlock()
+
+	overloaded, reason := false, ""
+	for _, check := range checks {
+		if overloaded, reason = check(); overloaded {
+			break
+		}
+	}
+	was := atomic.LoadInt32(&s.shedding) == 1
+	switch {
+	case overloaded && !was:
+		atomic.StoreInt32(&s.shedding, 1)
+		log.WithField("reason", reason).Warn("overloaded, shedding new requests")
+	case !overloaded && was:
+		atomic.StoreInt32(&s.shedding, 0)
+		log.Info("load back to normal, accepting requests")
+	}
+}
+
+func (s *LoadShedder) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.shedding) == 1 {
+			rw.Header().Set("Retry-After", s.retryAfter)
+			WriteError(rw, r, http.StatusServiceUnavailable, "overloaded")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// heapCheck reports overload while the live heap is above maxBytes.
+func heapCheck(maxBytes int64) LoadCheck {
+	return func() (bool, string) {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if int64(stats.HeapAlloc) > maxBytes {
+			return true, "heap " + strconv.FormatUint(stats.HeapAlloc, 10) + " bytes over max_heap_bytes"
+		}
+		return false, ""
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Default size at which log_rotate starts a new file.
+const defaultLogRotateMaxSizeMB = 100
+
+// setupLogOutput points logrus at the configured log_output: "stderr" (the
+// default), "stdout", "syslog", or anything else as a file to append to,
+// rotated with log_rotate. It also sets the log_level and log_format and
+// checks log_fields.
+func setupLogOutput(config *Config) error {
+	if err := validateLogFields(config); err != nil {
+		return err
+	}
+	if config.LogLevel != "" {
+		level, err := log.ParseLevel(config.LogLevel)
+		if err != nil {
+			return fmt.Errorf("log_level: %v", err)
+		}
+		log.SetLevel(level)
+	}
+	switch config.LogFormat {
+	case "", "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log_format %q (valid: text, json)", config.LogFormat)
+	}
+
+	switch config.LogOutput {
+	case "", "stderr":
+		log.SetOutput(os.Stderr)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	case "syslog":
+		hook, err := newSyslogHook(config.Syslog)
+		if err != nil {
+			return fmt.Errorf("log_output syslog: %v", err)
+		}
+		log.AddHook(hook)
+		// Entries only go to syslog; the hook formats them itself.
+		log.SetOutput(ioutil.Discard)
+	default:
+		if c := config.LogRotate; c != nil {
+			maxSize := c.MaxSizeMB
+			if maxSize <= 0 {
+				maxSize = defaultLogRotateMaxSizeMB
+			}
+			day := 24 * time.Hour
+			log.SetOutput(&lumberjack.Logger{
+				Filename:   config.LogOutput,
+				MaxSize:    maxSize,
+				MaxBackups: c.MaxBackups,
+				MaxAge:     int((c.MaxAge + day - 1) / day),
+				Compress:   c.Compress,
+			})
+			return nil
+		}
+		f, err := os.OpenFile(config.LogOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("log_output: %v", err)
+		}
+		log.SetOutput(f)
+	}
+	return nil
+}
+
+// validateLogFields rejects log_fields entries no access log entry could
+// have.
+func validateLogFields(config *Config) error {
+	known := make(map[string]bool)
+	for _, name := range accessLogFields {
+		known[name] = true
+	}
+	for _, header := range config.CorrelationHeaders {
+		known[correlationLogField(header)] = true
+	}
+	timings := map[string]bool{"dns_ms": true, "connect_ms": true, "tls_ms": true, "upstream_ttfb_ms": true, "upstream_conn_reused": true}
+	for _, name := range config.LogFields {
+		switch {
+		case timings[name] && !config.LogUpstreamTimings:
+			return fmt.Errorf("log_fields: %s needs log_upstream_timings", name)
+		case !known[name] && !timings[name]:
+			return fmt.Errorf("log_fields: unknown field %q", name)
+		}
+	}
+	return nil
+}
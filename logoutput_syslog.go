@@ -0,0 +1,89 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogHook sends each entry to syslog with the severity matching its
+// level. It stands in for logrus' hooks/syslog, which is written against the
+// lowercase sirupsen import path and so won't accept our entries.
+type syslogHook struct {
+	writer    *syslog.Writer
+	formatter log.Formatter
+}
+
+func newSyslogHook(c *SyslogConfig) (*syslogHook, error) {
+	if c == nil {
+		c = &SyslogConfig{}
+	}
+	facility := syslog.LOG_DAEMON
+	if c.Facility != "" {
+		var ok bool
+		if facility, ok = syslogFacilities[strings.ToLower(c.Facility)]; !ok {
+			return nil, fmt.Errorf("unknown facility %q", c.Facility)
+		}
+	}
+	tag := c.Tag
+	if tag == "" {
+		tag = "frontend"
+	}
+	// An empty network and address means the local syslog daemon.
+	writer, err := syslog.Dial(c.Network, c.Address, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHook{writer: writer, formatter: &log.TextFormatter{DisableColors: true, DisableTimestamp: true}}, nil
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(string(line), "\n")
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel:
+		return h.writer.Crit(msg)
+	case log.ErrorLevel:
+		return h.writer.Err(msg)
+	case log.WarnLevel:
+		return h.writer.Warning(msg)
+	case log.InfoLevel:
+		return h.writer.Info(msg)
+	default:
+		return h.writer.Debug(msg)
+	}
+}
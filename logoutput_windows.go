@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type syslogHook struct{}
+
+func newSyslogHook(c *SyslogConfig) (*syslogHook, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return nil
+}
+
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	return nil
+}
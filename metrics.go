@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultMaxSeries is how many label combinations a metric exports before
+// new ones are folded into overflowLabel.
+const defaultMaxSeries = 10000
+
+// overflowLabel stands in for the route and upstream of series past a
+// metric's max_series.
+const overflowLabel = "other"
+
+// Metrics holds the Prometheus collectors for proxied requests, labeled by
+// route. They live in their own registry, served on the metrics listener.
+//
+// Routes are labeled by name, never by request path, but names change with
+// reloads and upstreams come and go with discovery, so each metric's series
+// are capped too.
+type Metrics struct {
+	registry       *prometheus.Registry
+	requests       *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	inFlight       *prometheus.GaugeVec
+	upstreamErrors *prometheus.CounterVec
+	breakerState   *prometheus.GaugeVec
+	noHealthy      *prometheus.GaugeVec
+	cacheRequests  *prometheus.CounterVec
+	cacheEntries   *prometheus.GaugeVec
+	cacheBytes     *prometheus.GaugeVec
+	cacheEvictions *prometheus.CounterVec
+	singleFlight   *prometheus.CounterVec
+	retryBudget    prometheus.Gauge
+
+	// series are the limits of the labeled metrics, by name.
+	series map[string]*seriesLimit
+}
+
+// NewMetrics makes the collectors, each exporting at most maxSeries label
+// combinations, or defaultMaxSeries if it isn't positive.
+func NewMetrics(maxSeries int) *Metrics {
+	if maxSeries <= 0 {
+		maxSeries = defaultMaxSeries
+	}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "frontend_requests_total",
+			Help: "Requests handled, by route and response status.",
+		}, []string{"route", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "frontend_request_duration_seconds",
+			Help:    "Time to handle a request, by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "frontend_requests_in_flight",
+			Help: "Requests currently being handled, by route.",
+		}, []string{"route"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "frontend_upstream_errors_total",
+			Help: "Upstream calls that failed, by route and kind of failure.",
+		}, []string{"route", "kind"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "frontend_circuit_breaker_state",
+			Help: "Circuit breaker state by route and upstream: 0 closed, 1 half open, 2 open.",
+		}, []string{"route", "upstream"}),
+		noHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "frontend_route_no_healthy_upstreams",
+			Help: "1 while every upstream of the route is failing its health checks, by route.",
+		}, []string{"route"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "frontend_cache_requests_total",
+			Help: "Requests to routes with a cache, by route and result: hit, miss or bypass.",
+		}, []string{"route", "result"}),
+		cacheEntries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "frontend_cache_entries",
+			Help: "Responses held in a route's cache, by route.",
+		}, []string{"route"}),
+		cacheBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "frontend_cache_bytes",
+			Help: "Size of the response bodies held in a route's cache, by route.",
+		}, []string{"route"}),
+		cacheEvictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "frontend_cache_evictions_total",
+			Help: "Responses evicted from a route's cache to stay under max_bytes, by route.",
+		}, []string{"route"}),
+		singleFlight: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "frontend_single_flight_requests_total",
+			Help: "Coalescable requests on single_flight routes, by route and result: leader (made the upstream call) or coalesced (shared one).",
+		}, []string{"route", "result"}),
+		retryBudget: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "frontend_retry_budget_utilization",
+			Help: "Share of the retry budget used over its window; at 1 no more retries are made.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.duration, m.inFlight, m.upstreamErrors, m.breakerState, m.noHealthy, m.cacheRequests,
+		m.cacheEntries, m.cacheBytes, m.cacheEvictions, m.singleFlight, m.retryBudget,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	m.series = make(map[string]*seriesLimit)
+	for _, name := range []string{
+		"frontend_requests_total", "frontend_request_duration_seconds", "frontend_requests_in_flight",
+		"frontend_upstream_errors_total", "frontend_circuit_breaker_state", "frontend_route_no_healthy_upstreams",
+		"frontend_cache_requests_total", "frontend_cache_entries", "frontend_cache_bytes",
+		"frontend_cache_evictions_total", "frontend_single_flight_requests_total",
+	} {
+		m.series[name] = &seriesLimit{max: maxSeries, seen: make(map[string]bool)}
+	}
+	return m
+}
+
+// A seriesLimit counts the label combinations a metric has exported, and
+// past its max the samples it turns away.
+type seriesLimit struct {
+	max int
+
+	mu      sync.Mutex
+	seen    map[string]bool
+	dropped int64
+}
+
+// SeriesStats reports how close a metric is to its max_series. Dropped
+// counts the samples recorded under overflowLabel or, for gauges, not at
+// all since then.
+type SeriesStats struct {
+	Series    int   `json:"series"`
+	MaxSeries int   `json:"max_series"`
+	Dropped   int64 `json:"dropped"`
+}
+
+// labels returns the label values to record a sample of metric under. Past
+// its max_series, new combinations get their first capped values (the route,
+// then the upstream) replaced with overflowLabel, and false.
+func (m *Metrics) labels(metric string, capped int, values ...string) ([]string, bool) {
+	l := m.series[metric]
+	key := strings.Join(values, "\xff")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[key] || len(l.seen) < l.max {
+		l.seen[key] = true
+		return values, true
+	}
+	if l.dropped == 0 {
+		log.WithFields(log.Fields{"metric": metric, "max_series": l.max}).
+			Warn("metric reached max_series, new label combinations get no series of their own")
+	}
+	l.dropped++
+	overflow := append([]string(nil), values...)
+	for i := 0; i < capped; i++ {
+		overflow[i] = overflowLabel
+	}
+	return overflow, false
+}
+
+// SeriesStats reports on each capped metric, by name.
+func (m *Metrics) SeriesStats() map[string]SeriesStats {
+	stats := make(map[string]SeriesStats, len(m.series))
+	for name, l := range m.series {
+		l.mu.Lock()
+		stats[name] = SeriesStats{Series: len(l.seen), MaxSeries: l.max, Dropped: l.dropped}
+		l.mu.Unlock()
+	}
+	return stats
+}
+
+// Wrap records route's requests. Upstream failures are picked up from the
+// RequestInfo the proxy's error handler fills in, so this has to run
+// inside logging.
+func (m *Metrics) Wrap(route string, handler http.Handler) http.Handler {
+	labels, _ := m.labels("frontend_requests_in_flight", 1, route)
+	inFlight := m.inFlight.WithLabelValues(labels...)
+	labels, _ = m.labels("frontend_request_duration_seconds", 1, route)
+	duration := m.duration.WithLabelValues(labels...)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		statusWriter := NewStatusLoggingResponseWriter(rw)
+		handler.ServeHTTP(statusWriter, r)
+		statusWriter.noteUpgrade(r)
+
+		duration.Observe(time.Since(start).Seconds())
+		labels, _ := m.labels("frontend_requests_total", 1, route, strconv.Itoa(statusWriter.Status()))
+		m.requests.WithLabelValues(labels...).Inc()
+		if info := RequestInfoFromContext(r.Context()); info != nil {
+			if kind := info.UpstreamError(); kind != "" {
+				labels, _ := m.labels("frontend_upstream_errors_total", 1, route, kind)
+				m.upstreamErrors.WithLabelValues(labels...).Inc()
+			}
+		}
+	})
+}
+
+// SetCircuitBreakerState exports the state of an upstream's circuit
+// breaker. Gauges past their max_series are dropped rather than aggregated,
+// as a state can't be summed.
+func (m *Metrics) SetCircuitBreakerState(route, upstream string, state breakerState) {
+	if labels, ok := m.labels("frontend_circuit_breaker_state", 2, route, upstream); ok {
+		m.breakerState.WithLabelValues(labels...).Set(float64(state))
+	}
+}
+
+// SetNoHealthyUpstreams exports whether a route has no healthy upstream.
+func (m *Metrics) SetNoHealthyUpstreams(route string, none bool) {
+	value := 0.0
+	if none {
+		value = 1
+	}
+	if labels, ok := m.labels("frontend_route_no_healthy_upstreams", 1, route); ok {
+		m.noHealthy.WithLabelValues(labels...).Set(value)
+	}
+}
+
+// CacheResult counts a request to a route's response cache.
+func (m *Metrics) CacheResult(route, result string) {
+	labels, _ := m.labels("frontend_cache_requests_total", 1, route, result)
+	m.cacheRequests.WithLabelValues(labels...).Inc()
+}
+
+// SetCacheSize exports how much a route's response cache holds.
+func (m *Metrics) SetCacheSize(route string, entries int, bytes int64) {
+	if labels, ok := m.labels("frontend_cache_entries", 1, route); ok {
+		m.cacheEntries.WithLabelValues(labels...).Set(float64(entries))
+	}
+	if labels, ok := m.labels("frontend_cache_bytes", 1, route); ok {
+		m.cacheBytes.WithLabelValues(labels...).Set(float64(bytes))
+	}
+}
+
+// CacheEviction counts a response evicted from a route's cache.
+func (m *Metrics) CacheEviction(route string) {
+	labels, _ := m.labels("frontend_cache_evictions_total", 1, route)
+	m.cacheEvictions.WithLabelValues(labels...).Inc()
+}
+
+// SingleFlightResult counts a coalescable request on a single_flight route.
+func (m *Metrics) SingleFlightResult(route, result string) {
+	labels, _ := m.labels("frontend_single_flight_requests_total", 1, route, result)
+	m.singleFlight.WithLabelValues(labels...).Inc()
+}
+
+// SetRetryBudgetUtilization exports how much of the retry budget is used.
+func (m *Metrics) SetRetryBudgetUtilization(utilization float64) {
+	m.retryBudget.Set(utilization)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMaxSeries(t *testing.T) {
+	m := NewMetrics(2)
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	for _, route := range []string{"a", "b", "c", "d"} {
+		m.Wrap(route, ok).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if got := testutil.CollectAndCount(m.requests); got != 3 {
+		t.Errorf("frontend_requests_total has %d series, want 2 routes and other", got)
+	}
+	if got := testutil.ToFloat64(m.requests.WithLabelValues(overflowLabel, "200")); got != 2 {
+		t.Errorf("other counted %v requests, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("a", "200")); got != 1 {
+		t.Errorf("a counted %v requests, want 1", got)
+	}
+
+	// Gauges past the limit are dropped instead.
+	for _, upstream := range []string{"a:80", "b:80", "c:80"} {
+		m.SetCircuitBreakerState("a", upstream, breakerOpen)
+	}
+	if got := testutil.CollectAndCount(m.breakerState); got != 2 {
+		t.Errorf("frontend_circuit_breaker_state has %d series, want 2", got)
+	}
+
+	stats := m.SeriesStats()
+	if got, want := stats["frontend_requests_total"], (SeriesStats{Series: 2, MaxSeries: 2, Dropped: 2}); got != want {
+		t.Errorf("frontend_requests_total stats = %+v, want %+v", got, want)
+	}
+	if got, want := stats["frontend_circuit_breaker_state"], (SeriesStats{Series: 2, MaxSeries: 2, Dropped: 1}); got != want {
+		t.Errorf("frontend_circuit_breaker_state stats = %+v, want %+v", got, want)
+	}
+}
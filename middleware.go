@@ -0,0 +1,265 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NewContentTypeHandler rejects requests whose body Content-Type isn't in the
+// allowed list with a 415. Bodyless requests without a Content-Type pass.
+func NewContentTypeHandler(allowed []string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		if contentType == "" && r.ContentLength == 0 {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !mediaTypeAllowed(mediaType, allowed) {
+			WriteError(rw, r, http.StatusUnsupportedMediaType, "")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// mediaTypeAllowed matches exactly or against "type/*" wildcards.
+func mediaTypeAllowed(mediaType string, allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mediaType || a == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewOptionsHandler answers OPTIONS requests itself with a 204 instead of
+// proxying them. CORS preflights are already answered by the cors handler;
+// this catches the rest, which backends commonly reject with a 405. The
+// surrounding cors handler still adds the CORS response headers. Allow lists
+// the methods the route accepts.
+func NewOptionsHandler(route *Route) Middleware {
+	allow := strings.Join(routeMethods(route), ", ")
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodOptions {
+				handler.ServeHTTP(rw, r)
+				return
+			}
+			rw.Header().Set("Allow", allow)
+			rw.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// routeMethods returns the methods route serves: for static routes the ones
+// the file server answers, otherwise the standard ones, which is all strict
+// method handling lets through. OPTIONS is answered either way.
+func routeMethods(route *Route) []string {
+	if route.Type == "static" {
+		return append(append([]string(nil), staticMethods...), http.MethodOptions)
+	}
+	return standardMethodList
+}
+
+// standardMethodList is the methods of RFC 9110 plus PATCH.
+var standardMethodList = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+}
+
+var standardMethods = func() map[string]bool {
+	methods := make(map[string]bool, len(standardMethodList))
+	for _, method := range standardMethodList {
+		methods[method] = true
+	}
+	return methods
+}()
+
+// NewStrictMethodHandler answers methods outside standardMethods with a
+// 501, whatever their case; the director uppercases the rest.
+func NewStrictMethodHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !standardMethods[strings.ToUpper(r.Method)] {
+			WriteError(rw, r, http.StatusNotImplemented, "unsupported method")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// NewHeadAsGetHandler turns HEAD requests into GETs for backends that only
+// implement GET. The upstream's status and headers, Content-Length
+// included, are passed through as if it had answered the HEAD; the body is
+// read and thrown away.
+func NewHeadAsGetHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		handler.ServeHTTP(headResponseWriter{rw}, get)
+	})
+}
+
+// headResponseWriter discards the body. The server would refuse it for a
+// HEAD request anyway, but with an error that aborts the proxied response.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w headResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// NewMaxURLLengthHandler answers 414 to requests whose request target is
+// longer than maxLength bytes, before any routing or proxying is done.
+func NewMaxURLLengthHandler(maxLength int, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > maxLength {
+			WriteError(rw, r, http.StatusRequestURITooLong, "")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// NewMaxRequestBytesHandler answers 413 to requests with a body over limit
+// bytes: straight away when Content-Length says so, otherwise once reading
+// the body runs past the limit, which fails the upstream request. Gzip and
+// deflate bodies are also held to decompressedLimit once decompressed.
+// Either limit is off unless positive.
+func NewMaxRequestBytesHandler(limit, decompressedLimit int64, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if limit > 0 && r.ContentLength > limit {
+			WriteError(rw, r, http.StatusRequestEntityTooLarge, "")
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			if limit > 0 {
+				r.Body = http.MaxBytesReader(rw, r.Body, limit)
+			}
+			if decompressedLimit > 0 {
+				r.Body = newDecompressedLimitReader(r.Body, r.Header.Get("Content-Encoding"), decompressedLimit)
+			}
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// A decompressedLimitReader passes a compressed body on as it is, while
+// decompressing a copy on the side to measure it. Reads fail with an
+// *http.MaxBytesError once the decompressed size passes the limit, so
+// nothing is buffered and a gzip bomb never gets far. A body that doesn't
+// decompress is passed on unmeasured, for the upstream to reject.
+type decompressedLimitReader struct {
+	io.ReadCloser
+	pw *io.PipeWriter
+}
+
+// newDecompressedLimitReader returns body unchanged unless encoding is one
+// it can measure.
+func newDecompressedLimitReader(body io.ReadCloser, encoding string, limit int64) io.ReadCloser {
+	var decompress func(io.Reader) (io.Reader, error)
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		decompress = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "deflate":
+		decompress = func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }
+	default:
+		return body
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		if zr, err := decompress(pr); err == nil {
+			if n, _ := io.Copy(io.Discard, io.LimitReader(zr, limit+1)); n > limit {
+				pr.CloseWithError(&http.MaxBytesError{Limit: limit})
+				return
+			}
+		}
+		io.Copy(io.Discard, pr)
+	}()
+	return &decompressedLimitReader{ReadCloser: body, pw: pw}
+}
+
+func (d *decompressedLimitReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	if n > 0 {
+		if _, werr := d.pw.Write(p[:n]); werr != nil {
+			return 0, werr
+		}
+	}
+	if err == io.EOF {
+		d.pw.Close()
+	}
+	return n, err
+}
+
+func (d *decompressedLimitReader) Close() error {
+	d.pw.Close()
+	return d.ReadCloser.Close()
+}
+
+// NewHostCheckHandler rejects requests with an empty Host header, or one
+// outside allowed when that is non-empty, with a 400 before any routing
+// happens. Entries in allowed may start with "*." to match any subdomain.
+// Requests for exempt, if set, are let through whatever their Host: health
+// probes tend to address the pod's IP.
+func NewHostCheckHandler(allowed []string, exempt string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if exempt != "" && r.URL.Path == exempt {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+		host := strings.ToLower(stripPort(r.Host))
+		if host == "" || (len(allowed) > 0 && !hostAllowed(host, allowed)) {
+			WriteError(rw, r, http.StatusBadRequest, "invalid Host header")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+func hostAllowed(host string, allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == host {
+			return true
+		}
+		if strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPort removes an optional :port suffix, handling bracketed IPv6.
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+}
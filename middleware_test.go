@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMaxDecompressedRequestBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(rw, r.Body)
+	}))
+	defer upstream.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    max_decompressed_request_bytes: 65536\n")
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		status   int
+	}{
+		{"small", gzipped(t, []byte("payload")), "gzip", http.StatusOK},
+		// 10MB of zeros compresses to about 10KB.
+		{"bomb", gzipped(t, make([]byte, 10<<20)), "gzip", http.StatusRequestEntityTooLarge},
+		{"not compressed", make([]byte, 1<<20), "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/app/upload", bytes.NewReader(test.body))
+			if test.encoding != "" {
+				req.Header.Set("Content-Encoding", test.encoding)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("status = %d, want %d", rec.Code, test.status)
+			}
+			// The upstream gets the body as it was sent, still compressed.
+			if test.status == http.StatusOK && !bytes.Equal(rec.Body.Bytes(), test.body) {
+				t.Errorf("upstream got %d bytes, want the %d sent", rec.Body.Len(), len(test.body))
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults and limits for mirror settings.
+const (
+	defaultMirrorTimeout      = 5 * time.Second
+	defaultMirrorMaxBodyBytes = 64 << 10
+	// Mirrored requests in flight per route beyond which more are dropped,
+	// so a slow shadow can't pile up goroutines.
+	maxMirrorsInFlight = 100
+)
+
+// NewMirrorTransport sends a copy of a sample of the route's requests, as
+// they go upstream, to a shadow upstream as well. Copies are sent in the
+// background and their responses thrown away, so the shadow can't slow
+// down or fail the real request. Requests whose body is larger than
+// max_body_bytes aren't mirrored.
+func NewMirrorTransport(c *MirrorConfig, route *Route, resolver *net.Resolver, transport http.RoundTripper) (http.RoundTripper, error) {
+	target, err := url.Parse(c.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	t := &mirrorTransport{
+		RoundTripper: transport,
+		target:       target,
+		shadow:       NewRouteTransport(route, resolver),
+		sampleRate:   c.SampleRate,
+		timeout:      c.Timeout,
+		maxBodyBytes: c.MaxBodyBytes,
+	}
+	if t.sampleRate <= 0 || t.sampleRate > 1 {
+		t.sampleRate = 1
+	}
+	if t.timeout <= 0 {
+		t.timeout = defaultMirrorTimeout
+	}
+	if t.maxBodyBytes <= 0 {
+		t.maxBodyBytes = defaultMirrorMaxBodyBytes
+	}
+	return t, nil
+}
+
+type mirrorTransport struct {
+	http.RoundTripper
+	target       *url.URL
+	shadow       http.RoundTripper
+	sampleRate   float64
+	timeout      time.Duration
+	maxBodyBytes int64
+	inFlight     int32
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isUpgradeRequest(req) || rand.Float64() >= t.sampleRate {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	if atomic.AddInt32(&t.inFlight, 1) > maxMirrorsInFlight {
+		atomic.AddInt32(&t.inFlight, -1)
+		return t.RoundTripper.RoundTrip(req)
+	}
+	body, replayable, err := bufferRequestBody(req, t.maxBodyBytes)
+	if err != nil || !replayable {
+		atomic.AddInt32(&t.inFlight, -1)
+		if err != nil {
+			return nil, err
+		}
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	// A context of its own: the copy mustn't be cancelled with the request
+	// or count towards its RequestInfo.
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	mirrored := req.Clone(ctx)
+	mirrored.URL.Scheme = t.target.Scheme
+	mirrored.URL.Host = t.target.Host
+	if body != nil {
+		mirrored.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	go func() {
+		defer atomic.AddInt32(&t.inFlight, -1)
+		defer cancel()
+		res, err := t.shadow.RoundTrip(mirrored)
+		if err != nil {
+			log.WithFields(log.Fields{"mirror": t.target.Host, "error": err}).Debug("mirrored request failed")
+			return
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(rw, r.Body)
+	}))
+	defer upstream.Close()
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body)
+	}))
+	defer shadow.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n"+
+		"    mirror: {upstream: "+shadow.URL+", max_body_bytes: 16}\n")
+	post := func(body string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/app/echo", strings.NewReader(body)))
+		if got := rec.Body.String(); got != body {
+			t.Fatalf("upstream got body %q, want %q", got, body)
+		}
+	}
+
+	post("payload")
+	select {
+	case got := <-mirrored:
+		if want := "POST /echo payload"; got != want {
+			t.Errorf("shadow got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	// Too large to mirror, but still sent upstream in full.
+	post(strings.Repeat("x", 17))
+	select {
+	case got := <-mirrored:
+		t.Errorf("shadow got %q beyond max_body_bytes", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorSampleRate(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	var mirrored int32
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrored, 1)
+	}))
+	defer shadow.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n"+
+		"    mirror: {upstream: "+shadow.URL+", sample_rate: 0.25}\n")
+
+	for i := 0; i < 400; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/app/", nil))
+	}
+	// Mirrored requests finish in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&mirrored) < 50 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// About 100, with plenty of slack for the random sample.
+	if got := atomic.LoadInt32(&mirrored); got < 50 || got > 150 {
+		t.Errorf("mirrored %d of 400 requests at sample_rate 0.25", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Options are the settings taken from the command line, each falling back
+// to an environment variable so containers can be configured without
+// flags. Set ones win over the config file. Validate and PrintConfig,
+// modes rather than settings, are flags only.
+type Options struct {
+	ConfigPath       string
+	AllowEmptyConfig bool
+	Listen           string
+	ShutdownTimeout  time.Duration
+	LogLevel         string
+	LogFormat        string
+	Validate         bool
+	PrintConfig      bool
+}
+
+// The config file, read from the working directory unless --config says
+// otherwise.
+const defaultConfigPath = "config.yaml"
+
+// parseOptions reads the options from args, using FRONTEND_* environment
+// variables as the defaults.
+func parseOptions(args []string) (*Options, error) {
+	shutdownTimeout, err := envDuration("FRONTEND_SHUTDOWN_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	allowEmptyConfig, err := envBool("FRONTEND_ALLOW_EMPTY_CONFIG")
+	if err != nil {
+		return nil, err
+	}
+	configPath := os.Getenv("FRONTEND_CONFIG")
+	if configPath == "" {
+		configPath = defaultConfigPath
+	}
+
+	var o Options
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.StringVar(&o.ConfigPath, "config", configPath, "config file to read (env FRONTEND_CONFIG)")
+	flags.BoolVar(&o.AllowEmptyConfig, "allow-empty-config", allowEmptyConfig, "start with no routes if the config file doesn't exist yet (env FRONTEND_ALLOW_EMPTY_CONFIG)")
+	flags.StringVar(&o.Listen, "listen", os.Getenv("FRONTEND_LISTEN"), "address for plain HTTP, overriding listen in the config (env FRONTEND_LISTEN)")
+	flags.DurationVar(&o.ShutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long to let requests finish on shutdown, overriding shutdown_timeout (env FRONTEND_SHUTDOWN_TIMEOUT)")
+	flags.StringVar(&o.LogLevel, "log-level", os.Getenv("FRONTEND_LOG_LEVEL"), "debug, info, warn or error, overriding log_level (env FRONTEND_LOG_LEVEL)")
+	flags.StringVar(&o.LogFormat, "log-format", os.Getenv("FRONTEND_LOG_FORMAT"), "text or json, overriding log_format (env FRONTEND_LOG_FORMAT)")
+	flags.BoolVar(&o.Validate, "validate", false, "check the config, including that upstream hosts resolve and routes build, and exit")
+	flags.BoolVar(&o.PrintConfig, "print-config", false, "print the config with defaults and the options above applied, and exit")
+	if err := flags.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// apply puts the options that were set over what the config file says.
+func (o *Options) apply(config *Config) {
+	if o.Listen != "" {
+		config.Listen = o.Listen
+	}
+	if o.ShutdownTimeout > 0 {
+		config.ShutdownTimeout = o.ShutdownTimeout
+	}
+	if o.LogLevel != "" {
+		config.LogLevel = o.LogLevel
+	}
+	if o.LogFormat != "" {
+		config.LogFormat = o.LogFormat
+	}
+}
+
+func envDuration(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return d, nil
+}
+
+func envBool(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", name, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// normalizePath resolves "." and ".." segments and collapses duplicate
+// slashes, keeping a trailing slash if the original had one since some
+// backends treat "/dir" and "/dir/" differently.
+func normalizePath(p string) string {
+	if p == "" {
+		return p
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if !strings.HasPrefix(p, "/") {
+		cleaned = strings.TrimPrefix(cleaned, "/")
+	}
+	return cleaned
+}
+
+// collapseSlashes replaces runs of slashes with a single one, leaving "."
+// and ".." segments alone.
+func collapseSlashes(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.Replace(p, "//", "/", -1)
+	}
+	return p
+}
+
+// hasEncodedSlash reports whether the request path contains a
+// percent-encoded slash, which backends may or may not treat as a separator.
+func hasEncodedSlash(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.URL.RawPath), "%2f")
+}
+
+// NewEncodedSlashHandler answers 400 to requests with %2F in the path, for
+// backends where /a%2Fb and /a/b could be confused.
+func NewEncodedSlashHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if hasEncodedSlash(r) {
+			WriteError(rw, r, http.StatusBadRequest, "encoded slash in path")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
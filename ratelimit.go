@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often a RateLimiter looks for idle clients to forget.
+const rateLimitSweepInterval = time.Minute
+
+// A RateLimiter gives every client a token bucket that refills at rate
+// requests per second up to burst. Clients are told apart by keyHeader when
+// set and present (e.g. X-Api-Key), otherwise by address.
+//
+// Buckets that have refilled completely are dropped on the next sweep: a
+// new bucket would start out full anyway, so forgetting them changes
+// nothing and memory only grows with the clients seen recently.
+type RateLimiter struct {
+	rate      float64
+	burst     float64
+	keyHeader string
+	trusted   CIDRList
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(c *RateLimitConfig, trusted CIDRList) *RateLimiter {
+	burst := c.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(c.Rate))
+	}
+	return &RateLimiter{
+		rate:      c.Rate,
+		burst:     float64(burst),
+		keyHeader: c.KeyHeader,
+		trusted:   trusted,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from key's bucket. When there is none it returns how
+// long until there will be.
+func (l *RateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *RateLimiter) key(r *http.Request) string {
+	if l.keyHeader != "" {
+		if value := r.Header.Get(l.keyHeader); value != "" {
+			return "header:" + value
+		}
+	}
+	return "ip:" + clientIP(r, l.trusted)
+}
+
+// Wrap answers requests over the limit with a 429 and a Retry-After.
+func (l *RateLimiter) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(l.key(r)); !ok {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			WriteError(rw, r, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
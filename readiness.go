@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How often to retry an upstream that isn't accepting connections yet, and
+// how long each attempt may take.
+const (
+	readinessInterval    = time.Second
+	readinessDialTimeout = time.Second
+)
+
+// A ReadinessGate holds a route's requests off with a 503 until one of its
+// upstreams first accepts a TCP connection, so clients arriving while
+// backends are still starting get a clean "not yet" rather than a 502. Once
+// open it stays open; later outages are the proxy's business.
+type ReadinessGate struct {
+	ready int32
+}
+
+func NewReadinessGate(route string, upstreams []string) *ReadinessGate {
+	g := &ReadinessGate{}
+	var addrs []string
+	for _, upstream := range upstreams {
+		if addr, err := upstreamDialAddr(upstream); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		// The proxy reports the bad upstream itself; don't block on it.
+		g.ready = 1
+		return g
+	}
+	go func() {
+		for {
+			for _, addr := range addrs {
+				conn, err := net.DialTimeout("tcp", addr, readinessDialTimeout)
+				if err == nil {
+					conn.Close()
+					atomic.StoreInt32(&g.ready, 1)
+					log.WithFields(log.Fields{
+						"route":    route,
+						"upstream": addr,
+					}).Info("upstream reachable, route ready")
+					return
+				}
+			}
+			time.Sleep(readinessInterval)
+		}
+	}()
+	return g
+}
+
+func (g *ReadinessGate) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&g.ready) == 0 {
+			rw.Header().Set("Retry-After", "1")
+			WriteError(rw, r, http.StatusServiceUnavailable, "upstream not ready")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// upstreamDialAddr is the host:port an upstream URL connects to.
+func upstreamDialAddr(upstream string) (string, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return "", err
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(target.Hostname(), port), nil
+}
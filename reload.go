@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// SwappableHandler serves through a handler that can be replaced while
+// running. Requests already being served finish on the handler they started
+// with.
+type SwappableHandler struct {
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func NewSwappableHandler(handler http.Handler) *SwappableHandler {
+	return &SwappableHandler{handler: handler}
+}
+
+func (s *SwappableHandler) Swap(handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = handler
+}
+
+func (s *SwappableHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	handler := s.handler
+	s.mu.RUnlock()
+	handler.ServeHTTP(rw, r)
+}
+
+// A ConfigReloader re-reads the config file and swaps in its routes. Only
+// routes are reloaded; listeners, TLS and other global settings keep their
+// startup values until the next restart.
+type ConfigReloader struct {
+	// Reloads come from SIGHUP and the admin listener.
+	mu sync.Mutex
+
+	options    *Options
+	config     *Config
+	middleware *MiddlewareSet
+	resolver   *net.Resolver
+	current    *Router
+	routes     *SwappableHandler
+}
+
+func NewConfigReloader(options *Options, config *Config, middleware *MiddlewareSet, resolver *net.Resolver, current *Router, routes *SwappableHandler) *ConfigReloader {
+	return &ConfigReloader{
+		options:    options,
+		config:     config,
+		middleware: middleware,
+		resolver:   resolver,
+		current:    current,
+		routes:     routes,
+	}
+}
+
+// ReloadOnSignal reloads the config whenever the process receives SIGHUP.
+func (c *ConfigReloader) ReloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		c.Reload()
+	}
+}
+
+// RouteChanges lists the routes a reload added, removed and changed, with
+// the hash of the config now applied.
+type RouteChanges struct {
+	ConfigHash string   `json:"config_hash"`
+	Added      []string `json:"added"`
+	Removed    []string `json:"removed"`
+	Changed    []string `json:"changed"`
+}
+
+// configHash identifies a config by the SHA-256 of its effective settings,
+// as --print-config shows them, so equivalent files hash the same.
+func configHash(config *Config) string {
+	out, _ := yaml.Marshal(effectiveConfig(reflect.ValueOf(config)))
+	sum := sha256.Sum256(out)
+	return hex.EncodeToString(sum[:])
+}
+
+// Reload swaps in the routes from the config file. If the file can't be
+// read or a route is invalid, the error is logged and returned, and the
+// running routes are kept.
+func (c *ConfigReloader) Reload() (*RouteChanges, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	options := *c.options
+	options.AllowEmptyConfig = false
+	loaded, err := loadConfig(&options)
+	if err != nil {
+		log.WithError(err).Error("config reload failed, keeping current routes")
+		return nil, err
+	}
+	next := *c.config
+	next.Routes = loaded.Routes
+	if err := validateConfig(&next); err != nil {
+		log.WithError(err).Error("config reload failed, keeping current routes")
+		return nil, err
+	}
+	router, err := buildRouter(&next, c.middleware, c.resolver)
+	if err != nil {
+		log.WithError(err).Error("config reload failed, keeping current routes")
+		return nil, err
+	}
+
+	added, removed, changed := diffRoutes(c.config.Routes, next.Routes)
+	c.routes.Swap(router)
+	c.current.Close()
+	c.current = router
+	c.config.Routes = next.Routes
+	hash := configHash(&next)
+	log.WithFields(log.Fields{
+		"added":       added,
+		"removed":     removed,
+		"changed":     changed,
+		"config_hash": hash,
+	}).Info("reloaded routes")
+
+	loaded.Routes, next.Routes = nil, nil
+	if !reflect.DeepEqual(loaded, next) {
+		log.Warn("config changes outside routes take effect on restart")
+	}
+	return &RouteChanges{ConfigHash: hash, Added: added, Removed: removed, Changed: changed}, nil
+}
+
+// Current returns the routes being served and the router serving them.
+func (c *ConfigReloader) Current() (map[string]*Route, *Router) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config.Routes, c.current
+}
+
+// diffRoutes lists the names of routes added, removed and changed between
+// two route sets.
+func diffRoutes(before, after map[string]*Route) (added, removed, changed []string) {
+	for name, route := range after {
+		previous, ok := before[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case !reflect.DeepEqual(previous, route):
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
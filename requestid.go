@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RequestIDGenerator produces X-Request-Id values for requests that arrive
+// without one.
+type RequestIDGenerator func() string
+
+func NewRequestIDGenerator(format, prefix string) (RequestIDGenerator, error) {
+	switch format {
+	case "", "uuid":
+		return newUUID, nil
+	case "ulid":
+		return newULID, nil
+	case "prefix":
+		// Counters restart with the process, so the prefix should be
+		// unique per instance and start (e.g. hostname plus deploy id).
+		var counter uint64
+		return func() string {
+			return prefix + strconv.FormatUint(atomic.AddUint64(&counter, 1), 10)
+		}, nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown request_id_format %q (valid: uuid, ulid, prefix, none)", format)
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:])
+	return string(out[:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: a 48-bit millisecond timestamp followed by 80
+// random bits in Crockford base32, so IDs sort by creation time.
+func newULID() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	rand.Read(b[6:])
+
+	// 128 bits as 26 base32 digits, the first carrying only 3 bits.
+	var out [26]byte
+	var acc uint32
+	var bits uint
+	pos := 25
+	for i := 15; i >= 0; i-- {
+		acc |= uint32(b[i]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[pos] = crockford[acc&0x1f]
+			pos--
+			acc >>= 5
+			bits -= 5
+		}
+	}
+	out[0] = crockford[acc&0x1f]
+	return string(out[:])
+}
+
+// NewRequestIDHandler makes sure every request carries an X-Request-Id,
+// generating one when the client didn't send it. The same value is
+// forwarded upstream, logged and returned to the client.
+//
+// With trailer set the ID is also sent as a trailer, for clients that only
+// look once a streamed response is complete. Only chunked responses can
+// carry trailers; others just get the header.
+func NewRequestIDHandler(generate RequestIDGenerator, trailer bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = generate()
+			r.Header.Set("X-Request-Id", id)
+		}
+		handler.ServeHTTP(&lateHeaderWriter{
+			ResponseWriter: rw,
+			// Set just before writing so an echo from the upstream doesn't
+			// end up as a second value.
+			set: func(h http.Header) {
+				h.Set("X-Request-Id", id)
+				if trailer {
+					h.Add("Trailer", "X-Request-Id")
+				}
+			},
+		}, r)
+		if trailer {
+			// A declared trailer's value is whatever the header holds once
+			// the handler returns.
+			rw.Header().Set("X-Request-Id", id)
+		}
+	})
+}
+
+// lateHeaderWriter runs set on the response headers right before they are
+// written, so its values win over whatever the handler put there.
+type lateHeaderWriter struct {
+	http.ResponseWriter
+	set         func(http.Header)
+	wroteHeader bool
+}
+
+func (w *lateHeaderWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader && statusCode >= 200 {
+		w.wroteHeader = true
+		w.set(w.ResponseWriter.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *lateHeaderWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for
+// flushing and hijacking.
+func (w *lateHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// NewCorrelationHandler fills in any of headers the request arrived without.
+func NewCorrelationHandler(headers []string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		for _, header := range headers {
+			if r.Header.Get(header) == "" {
+				r.Header.Set(header, newUUID())
+			}
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// correlationLogField is the log field for a correlation header:
+// X-Correlation-Id becomes correlation_id.
+func correlationLogField(header string) string {
+	field := strings.ToLower(strings.Replace(header, "-", "_", -1))
+	return strings.TrimPrefix(field, "x_")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// RequestInfo collects details about a request that are only known deeper in
+// the handler chain (e.g. which upstream the director picked) so the access
+// log can report them once the request completes. It may be read by admin
+// endpoints while the request is in flight, hence the lock.
+type RequestInfo struct {
+	mu            sync.Mutex
+	upstream      string
+	dialErrors    int
+	retries       int
+	deadline      time.Duration
+	upstreamError string
+	timings       upstreamTimings
+}
+
+// upstreamTimings breaks down the time spent on the upstream call, as
+// reported by httptrace. Phases that didn't happen (no DNS lookup for an IP,
+// no dial for a reused connection) stay zero.
+type upstreamTimings struct {
+	getConn, dnsStart, connectStart, tlsStart time.Time
+	dns, connect, tls, ttfb                   time.Duration
+	reused                                    bool
+	traced                                    bool
+}
+
+// WithRequestInfo attaches a fresh RequestInfo to the request's context.
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)), info
+}
+
+// RequestInfoFromContext returns the request's RequestInfo, or nil when the
+// request didn't pass through the logging handler.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*RequestInfo)
+	return info
+}
+
+// SetUpstream records the upstream host the request was sent to.
+func (info *RequestInfo) SetUpstream(host string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.upstream = host
+}
+
+func (info *RequestInfo) Upstream() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.upstream
+}
+
+// AddDialRetry counts an upstream connection attempt that failed and was
+// retried.
+func (info *RequestInfo) AddDialRetry() {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.dialErrors++
+}
+
+// AddRetry counts a request that was sent again under the route's retry
+// policy.
+func (info *RequestInfo) AddRetry() {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.retries++
+}
+
+// Attempts is how many tries it took to reach the upstream, 1 when the first
+// one worked. Dial retries and retried requests both count.
+func (info *RequestInfo) Attempts() int {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.dialErrors + info.retries + 1
+}
+
+// SetDeadline records the total time the request was given for the upstream
+// call, so a timeout can be reported against it.
+func (info *RequestInfo) SetDeadline(deadline time.Duration) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.deadline = deadline
+}
+
+func (info *RequestInfo) Deadline() time.Duration {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.deadline
+}
+
+// SetUpstreamError records why the upstream call failed: "timeout",
+// "no_healthy_upstream" or "error".
+func (info *RequestInfo) SetUpstreamError(kind string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.upstreamError = kind
+}
+
+func (info *RequestInfo) UpstreamError() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.upstreamError
+}
+
+// TraceUpstream returns ctx with a ClientTrace that records upstream
+// latency phases into info. After retries the last attempt wins.
+func (info *RequestInfo) TraceUpstream(ctx context.Context) context.Context {
+	record := func(f func(t *upstreamTimings)) {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		f(&info.timings)
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			record(func(t *upstreamTimings) { t.getConn = time.Now() })
+		},
+		GotConn: func(conn httptrace.GotConnInfo) {
+			record(func(t *upstreamTimings) { t.reused, t.traced = conn.Reused, true })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			record(func(t *upstreamTimings) { t.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			record(func(t *upstreamTimings) { t.dns = time.Since(t.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			record(func(t *upstreamTimings) { t.connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			record(func(t *upstreamTimings) { t.connect = time.Since(t.connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			record(func(t *upstreamTimings) { t.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			record(func(t *upstreamTimings) { t.tls = time.Since(t.tlsStart) })
+		},
+		GotFirstResponseByte: func() {
+			record(func(t *upstreamTimings) { t.ttfb = time.Since(t.getConn) })
+		},
+	})
+}
+
+// UpstreamTimingFields returns the recorded phases as log fields in
+// milliseconds, or nil if no upstream connection was made.
+func (info *RequestInfo) UpstreamTimingFields() map[string]interface{} {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	t := info.timings
+	if !t.traced {
+		return nil
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	fields := map[string]interface{}{
+		"upstream_conn_reused": t.reused,
+		"upstream_ttfb_ms":     ms(t.ttfb),
+	}
+	if !t.dnsStart.IsZero() {
+		fields["dns_ms"] = ms(t.dns)
+	}
+	if !t.connectStart.IsZero() {
+		fields["connect_ms"] = ms(t.connect)
+	}
+	if !t.tlsStart.IsZero() {
+		fields["tls_ms"] = ms(t.tls)
+	}
+	return fields
+}
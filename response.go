@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A ResponseModifier adjusts an upstream response before it is copied to the
+// client. Modifiers run in order from the proxy's ModifyResponse.
+type ResponseModifier func(*http.Response) error
+
+func chainResponseModifiers(modifiers []ResponseModifier) func(*http.Response) error {
+	if len(modifiers) == 0 {
+		return nil
+	}
+	return func(res *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// NewStatusRemapModifier rewrites upstream status codes according to remap,
+// e.g. a backend's 418 into a 429.
+func NewStatusRemapModifier(remap map[int]int) ResponseModifier {
+	return func(res *http.Response) error {
+		if code, ok := remap[res.StatusCode]; ok {
+			res.StatusCode = code
+			res.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+		}
+		return nil
+	}
+}
+
+// NewStatusActionModifier hands responses with a status in actions over to
+// that status's handler instead of passing them on, e.g. to serve an SPA's
+// index page for the API's 404s. The upstream body is discarded and the
+// proxy's error handler runs the handler for the original request.
+func NewStatusActionModifier(actions map[int]http.Handler) ResponseModifier {
+	return func(res *http.Response) error {
+		if handler, ok := actions[res.StatusCode]; ok {
+			res.Body.Close()
+			return &statusActionError{status: res.StatusCode, handler: handler}
+		}
+		return nil
+	}
+}
+
+// statusActionError carries a replacement response from ModifyResponse to
+// the error handler, for status_actions and intercept_errors; it isn't a
+// failure.
+type statusActionError struct {
+	status  int
+	handler http.Handler
+}
+
+func (e *statusActionError) Error() string {
+	return fmt.Sprintf("upstream answered %d, response replaced", e.status)
+}
+
+// NewAddHeadersModifier sets headers on the response. Headers the upstream
+// already sent are left alone unless force is set.
+func NewAddHeadersModifier(headers map[string]string, force bool) ResponseModifier {
+	return func(res *http.Response) error {
+		for name, value := range headers {
+			if force || res.Header.Get(name) == "" {
+				res.Header.Set(name, value)
+			}
+		}
+		return nil
+	}
+}
+
+// NewDeprecationModifier marks responses as coming from a deprecated API:
+// Deprecation as an RFC 9745 structured date, Sunset as an HTTP date and a
+// Link to migration docs.
+func NewDeprecationModifier(d *Deprecation) (ResponseModifier, error) {
+	var deprecation, sunset string
+	if d.Date != "" {
+		date, err := parseDeprecationDate(d.Date)
+		if err != nil {
+			return nil, fmt.Errorf("deprecation date: %v", err)
+		}
+		deprecation = "@" + strconv.FormatInt(date.Unix(), 10)
+	}
+	if d.Sunset != "" {
+		date, err := parseDeprecationDate(d.Sunset)
+		if err != nil {
+			return nil, fmt.Errorf("deprecation sunset: %v", err)
+		}
+		sunset = date.UTC().Format(http.TimeFormat)
+	}
+	var link string
+	if d.Link != "" {
+		link = fmt.Sprintf("<%s>; rel=\"deprecation\"", d.Link)
+	}
+	return func(res *http.Response) error {
+		if deprecation != "" {
+			res.Header.Set("Deprecation", deprecation)
+		}
+		if sunset != "" {
+			res.Header.Set("Sunset", sunset)
+		}
+		if link != "" {
+			res.Header.Add("Link", link)
+		}
+		return nil
+	}, nil
+}
+
+func parseDeprecationDate(value string) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// NewStripHeadersModifier removes headers from the response.
+func NewStripHeadersModifier(headers []string) ResponseModifier {
+	return func(res *http.Response) error {
+		for _, name := range headers {
+			res.Header.Del(name)
+		}
+		return nil
+	}
+}
+
+// NewViaModifier appends this proxy to the response's Via header.
+func NewViaModifier(name string) ResponseModifier {
+	return func(res *http.Response) error {
+		res.Header.Add("Via", fmt.Sprintf("%d.%d %s", res.ProtoMajor, res.ProtoMinor, name))
+		return nil
+	}
+}
+
+// NewServedByModifier reports the upstream that answered in X-Served-By:
+// name if given, to avoid exposing internal hosts, otherwise the host the
+// request was sent to.
+func NewServedByModifier(name string) ResponseModifier {
+	return func(res *http.Response) error {
+		servedBy := name
+		if servedBy == "" {
+			servedBy = res.Request.URL.Host
+		}
+		res.Header.Set("X-Served-By", servedBy)
+		return nil
+	}
+}
+
+// NewContentTypeModifier fixes up mislabeled upstream responses. A non-empty
+// force replaces every Content-Type; otherwise types found in mapping (by
+// media type, ignoring parameters such as charset) are replaced by their
+// value.
+func NewContentTypeModifier(force string, mapping map[string]string) ResponseModifier {
+	normalized := make(map[string]string, len(mapping))
+	for from, to := range mapping {
+		normalized[strings.ToLower(from)] = to
+	}
+	return func(res *http.Response) error {
+		if force != "" {
+			res.Header.Set("Content-Type", force)
+			return nil
+		}
+		mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err != nil {
+			return nil
+		}
+		if to, ok := normalized[mediaType]; ok {
+			res.Header.Set("Content-Type", to)
+		}
+		return nil
+	}
+}
+
+// BufferedResponse is an http.ResponseWriter that keeps the whole response in
+// memory so it can be inspected or replayed to one or more clients.
+type BufferedResponse struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func NewBufferedResponse() *BufferedResponse {
+	return &BufferedResponse{header: make(http.Header)}
+}
+
+func (b *BufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *BufferedResponse) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+func (b *BufferedResponse) WriteHeader(statusCode int) {
+	if b.status == 0 {
+		b.status = statusCode
+	}
+}
+
+func (b *BufferedResponse) Status() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+// WriteTo replays the buffered response onto rw. Fields announced in a
+// Trailer header were set after the body and go out after it again.
+func (b *BufferedResponse) WriteTo(rw http.ResponseWriter) {
+	trailers := make(map[string]bool)
+	for _, announced := range b.header["Trailer"] {
+		for _, k := range strings.Split(announced, ",") {
+			trailers[http.CanonicalHeaderKey(strings.TrimSpace(k))] = true
+		}
+	}
+
+	header := rw.Header()
+	for k, v := range b.header {
+		if !trailers[k] {
+			header[k] = append([]string(nil), v...)
+		}
+	}
+	rw.WriteHeader(b.Status())
+	rw.Write(b.body.Bytes())
+	for k := range trailers {
+		if v, ok := b.header[k]; ok {
+			header[k] = append([]string(nil), v...)
+		}
+	}
+}
+
+// Default cap for buffer_response when buffer_max_bytes isn't set.
+const defaultBufferMaxBytes = 1 << 20
+
+// NewBufferResponseModifier reads the whole upstream body into memory before
+// the proxy starts writing to the client, so the response goes out with an
+// exact Content-Length. Bodies larger than maxBytes fall back to streaming:
+// what was read so far is sent first, followed by the rest of the upstream
+// body. So do responses announcing trailers (gRPC-web, for one): trailers
+// need chunked encoding, which a Content-Length would rule out.
+func NewBufferResponseModifier(maxBytes int64) ResponseModifier {
+	return func(res *http.Response) error {
+		if res.ContentLength > maxBytes || res.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+		if len(res.Trailer) > 0 {
+			log.WithField("upstream", res.Request.URL.String()).Debug("streaming response with trailers instead of buffering it")
+			return nil
+		}
+
+		buffered, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(buffered)) > maxBytes {
+			res.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(buffered), res.Body), res.Body}
+			return nil
+		}
+
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(buffered))
+		res.ContentLength = int64(len(buffered))
+		res.Header.Set("Content-Length", strconv.Itoa(len(buffered)))
+		res.TransferEncoding = nil
+		return nil
+	}
+}
+
+var errResponseTooLarge = errors.New("upstream response exceeds max_response_bytes")
+
+// NewMaxResponseBytesModifier refuses upstream responses larger than
+// maxBytes. One that declares its size up front is answered with a 502
+// before anything is sent; one that only turns out too large while being
+// copied is cut off there, and the client sees a truncated response.
+func NewMaxResponseBytesModifier(maxBytes int64) ResponseModifier {
+	return func(res *http.Response) error {
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+		if res.ContentLength > maxBytes {
+			return errResponseTooLarge
+		}
+		res.Body = &maxBytesReader{body: res.Body, remaining: maxBytes, upstream: res.Request.URL.String()}
+		return nil
+	}
+}
+
+type maxBytesReader struct {
+	body      io.ReadCloser
+	remaining int64
+	upstream  string
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	// Read one byte past the limit so a body of exactly maxBytes still
+	// succeeds.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.body.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		log.WithField("upstream", r.upstream).Error("aborting upstream response over max_response_bytes")
+		return n + int(r.remaining), errResponseTooLarge
+	}
+	return n, err
+}
+
+func (r *maxBytesReader) Close() error {
+	return r.body.Close()
+}
+
+type multiReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (m *multiReadCloser) Close() error {
+	return m.closer.Close()
+}
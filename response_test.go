@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrailersForwarded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		rw.WriteHeader(http.StatusOK)
+		io.WriteString(rw, "body")
+		rw.(http.Flusher).Flush()
+		rw.Header().Set("Grpc-Status", "0")
+		rw.Header().Set("Grpc-Message", "done")
+	}))
+	defer upstream.Close()
+
+	configs := []struct {
+		name   string
+		config string
+	}{
+		{"streamed", "routes:\n  app: " + upstream.URL + "\n"},
+		{"buffer_response", "routes:\n  app:\n    upstream: " + upstream.URL + "\n    buffer_response: true\n"},
+		{"single_flight", "routes:\n  app:\n    upstream: " + upstream.URL + "\n    single_flight: true\n"},
+	}
+	for _, c := range configs {
+		for _, http2 := range []bool{false, true} {
+			name := c.name + "/HTTP/1.1"
+			if http2 {
+				name = c.name + "/HTTP/2"
+			}
+			t.Run(name, func(t *testing.T) {
+				proxy := httptest.NewUnstartedServer(newTestRouter(t, c.config))
+				if http2 {
+					proxy.EnableHTTP2 = true
+					proxy.StartTLS()
+				} else {
+					proxy.Start()
+				}
+				defer proxy.Close()
+
+				res, err := proxy.Client().Get(proxy.URL + "/app/call")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				want := 1
+				if http2 {
+					want = 2
+				}
+				if res.ProtoMajor != want {
+					t.Fatalf("response over HTTP/%d, want HTTP/%d", res.ProtoMajor, want)
+				}
+				body, err := io.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(body) != "body" {
+					t.Errorf("body = %q, want body", body)
+				}
+				// Trailers are only filled in once the body has been read.
+				if got := res.Trailer.Get("Grpc-Status"); got != "0" {
+					t.Errorf("Grpc-Status trailer = %q, want 0", got)
+				}
+				if got := res.Trailer.Get("Grpc-Message"); got != "done" {
+					t.Errorf("Grpc-Message trailer = %q, want done", got)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults for retry settings left unset.
+const (
+	defaultRetryBackoff      = 50 * time.Millisecond
+	defaultRetryMaxBodyBytes = 64 << 10
+
+	defaultRetryBudgetRatio      = 0.1
+	defaultRetryBudgetMinRetries = 10
+	defaultRetryBudgetWindow     = 10 * time.Second
+	// The window slides a bucket at a time.
+	retryBudgetBuckets = 10
+
+	// Unless told otherwise, pauses vary by up to this share either way.
+	defaultJitter = 0.1
+)
+
+// checkJitter validates a jitter setting: "full", "equal", "none", or ""
+// for the default.
+func checkJitter(jitter string) error {
+	switch jitter {
+	case "", "full", "equal", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown jitter %q (valid: full, equal, none)", jitter)
+}
+
+// withJitter randomizes a pause so instances that started together don't
+// keep acting in lockstep. "full" picks anywhere from 0 to d, "equal" from
+// d/2 to d, and the default stays within 10% of d.
+func withJitter(d time.Duration, jitter string) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	switch jitter {
+	case "none":
+		return d
+	case "full":
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	case "equal":
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	spread := int64(float64(d) * defaultJitter)
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread+1))
+}
+
+// NewRetryTransport retries idempotent requests (of policy.IdempotentMethods,
+// or by default the methods RFC 9110 calls idempotent) that failed in one of
+// the ways listed in policy.On:
+//
+//   - connect_failure: the upstream couldn't be reached (after the dial
+//     retries every route gets).
+//   - timeout: the attempt ran out of per_try_timeout or header_timeout.
+//   - 5xx, or a specific status such as 503: the upstream answered with it.
+//     5xx takes in the route's error_status_codes too.
+//
+// Each attempt asks balancer for a backend again, so with several upstreams
+// a retry usually goes elsewhere. Request bodies are buffered for replay up
+// to max_body_bytes; requests with larger bodies get a single attempt.
+func NewRetryTransport(policy *RetryPolicy, balancer *Balancer, budget *RetryBudget, idempotent []string, transport http.RoundTripper) (http.RoundTripper, error) {
+	t := &retryTransport{
+		RoundTripper:  transport,
+		balancer:      balancer,
+		budget:        budget,
+		attempts:      policy.Attempts,
+		backoff:       policy.Backoff,
+		jitter:        policy.Jitter,
+		perTryTimeout: policy.PerTryTimeout,
+		maxBodyBytes:  policy.MaxBodyBytes,
+		statuses:      make(map[int]bool),
+	}
+	if t.backoff <= 0 {
+		t.backoff = defaultRetryBackoff
+	}
+	if t.maxBodyBytes <= 0 {
+		t.maxBodyBytes = defaultRetryMaxBodyBytes
+	}
+	if err := checkJitter(policy.Jitter); err != nil {
+		return nil, fmt.Errorf("retry: %v", err)
+	}
+	// The route's own additions stand in for the global ones.
+	methods := append([]string(nil), idempotentMethods...)
+	if len(policy.IdempotentMethods) > 0 {
+		methods = append(methods, policy.IdempotentMethods...)
+	} else {
+		methods = append(methods, idempotent...)
+	}
+	t.idempotent = make(map[string]bool, len(methods))
+	for _, method := range methods {
+		t.idempotent[strings.ToUpper(method)] = true
+	}
+	on := policy.On
+	if len(on) == 0 {
+		on = []string{"connect_failure"}
+	}
+	for _, condition := range on {
+		switch condition {
+		case "connect_failure":
+			t.onConnectFailure = true
+		case "timeout":
+			t.onTimeout = true
+		case "5xx":
+			t.on5xx = true
+		default:
+			status, err := strconv.Atoi(condition)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("retry: unknown condition %q (valid: connect_failure, timeout, 5xx or a status code)", condition)
+			}
+			t.statuses[status] = true
+		}
+	}
+	return t, nil
+}
+
+type retryTransport struct {
+	http.RoundTripper
+	balancer      *Balancer
+	budget        *RetryBudget
+	attempts      int
+	backoff       time.Duration
+	jitter        string
+	perTryTimeout time.Duration
+	maxBodyBytes  int64
+
+	onConnectFailure, onTimeout, on5xx bool
+	statuses                           map[int]bool
+	idempotent                         map[string]bool
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.attempts < 2 || !t.isIdempotent(req.Method) {
+		return t.try(req)
+	}
+	body, replayable, err := bufferRequestBody(req, t.maxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return t.try(req)
+	}
+	t.budget.Request()
+
+	for attempt := 1; ; attempt++ {
+		outreq := req.Clone(req.Context())
+		if body != nil {
+			outreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if attempt > 1 {
+			t.redirect(outreq)
+		}
+		res, err := t.try(outreq)
+		if attempt == t.attempts || !t.shouldRetry(res, err) || req.Context().Err() != nil || !t.budget.Retry() {
+			return res, err
+		}
+
+		entry := log.WithFields(log.Fields{
+			"upstream": outreq.URL.Host,
+			"attempt":  attempt,
+		})
+		if err != nil {
+			entry = entry.WithError(err)
+		} else {
+			entry = entry.WithField("status", res.StatusCode)
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4<<10))
+			res.Body.Close()
+		}
+		entry.Debug("upstream attempt failed, retrying")
+		if info := RequestInfoFromContext(req.Context()); info != nil {
+			info.AddRetry()
+		}
+
+		select {
+		case <-time.After(withJitter(time.Duration(attempt)*t.backoff, t.jitter)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// try makes one attempt, bounded by the per-try timeout. The timeout covers
+// reading the body too, so it is only released once the body is closed.
+func (t *retryTransport) try(req *http.Request) (*http.Response, error) {
+	if t.perTryTimeout <= 0 {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.perTryTimeout)
+	res, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// redirect points a retry at whichever backend the balancer picks now.
+func (t *retryTransport) redirect(req *http.Request) {
+	if t.balancer == nil || len(t.balancer.Backends()) < 2 {
+		return
+	}
+	retarget(req, t.balancer.PickFor(req).URL)
+}
+
+func (t *retryTransport) shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		switch {
+		case isDialError(err):
+			return t.onConnectFailure
+		case isTimeout(err):
+			return t.onTimeout
+		}
+		return false
+	}
+	return t.statuses[res.StatusCode] || (t.on5xx && t.balancer.failedStatus(res.StatusCode))
+}
+
+// bufferRequestBody reads the request body into memory so it can be sent
+// again. A body over maxBytes can't be replayed; what was read is put back
+// in front of the rest.
+func bufferRequestBody(req *http.Request, maxBytes int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > maxBytes {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > maxBytes {
+		req.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return body, true, nil
+}
+
+// A RetryBudget caps retries at a share of requests over a sliding window,
+// across every route sharing it. While it is used up, failed attempts are
+// returned as they are. A nil RetryBudget allows every retry.
+type RetryBudget struct {
+	ratio      float64
+	minRetries int
+	bucket     time.Duration
+	metrics    *Metrics
+
+	mu        sync.Mutex
+	buckets   [retryBudgetBuckets]retryBudgetBucket
+	exhausted bool
+}
+
+type retryBudgetBucket struct {
+	start             int64 // UnixNano, a multiple of the bucket length
+	requests, retries int
+}
+
+func NewRetryBudget(c *RetryBudgetConfig, metrics *Metrics) (*RetryBudget, error) {
+	if c.Ratio < 0 || c.Ratio > 1 {
+		return nil, errors.New("retry_budget: ratio must be between 0 and 1")
+	}
+	b := &RetryBudget{ratio: c.Ratio, minRetries: c.MinRetries, bucket: c.Window / retryBudgetBuckets, metrics: metrics}
+	if b.ratio == 0 {
+		b.ratio = defaultRetryBudgetRatio
+	}
+	if b.minRetries <= 0 {
+		b.minRetries = defaultRetryBudgetMinRetries
+	}
+	if c.Window <= 0 {
+		b.bucket = defaultRetryBudgetWindow / retryBudgetBuckets
+	}
+	return b, nil
+}
+
+// Request counts a request that may be retried.
+func (b *RetryBudget) Request() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current(time.Now()).requests++
+}
+
+// Retry reports whether the budget has room for another retry, and counts
+// it if so.
+func (b *RetryBudget) Retry() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	bucket := b.current(now)
+	requests, retries := b.totals(now)
+	allowed := int(b.ratio * float64(requests))
+	if allowed < b.minRetries {
+		allowed = b.minRetries
+	}
+	ok := retries < allowed
+	if ok {
+		bucket.retries++
+		retries++
+	}
+	if b.metrics != nil {
+		b.metrics.SetRetryBudgetUtilization(float64(retries) / float64(allowed))
+	}
+	switch {
+	case !ok && !b.exhausted:
+		log.WithFields(log.Fields{
+			"requests": requests,
+			"retries":  retries,
+			"window":   b.bucket * retryBudgetBuckets,
+		}).Warn("retry budget used up, not retrying until it recovers")
+	case ok && b.exhausted:
+		log.Info("retry budget recovered, retrying again")
+	}
+	b.exhausted = !ok
+	return ok
+}
+
+// current returns the bucket now falls in, emptying it if it last held an
+// older stretch of time. b.mu must be held.
+func (b *RetryBudget) current(now time.Time) *retryBudgetBucket {
+	start := now.UnixNano() - now.UnixNano()%int64(b.bucket)
+	bucket := &b.buckets[(start/int64(b.bucket))%retryBudgetBuckets]
+	if bucket.start != start {
+		*bucket = retryBudgetBucket{start: start}
+	}
+	return bucket
+}
+
+// totals adds up the buckets within the window. b.mu must be held.
+func (b *RetryBudget) totals(now time.Time) (requests, retries int) {
+	oldest := now.UnixNano() - int64(b.bucket)*retryBudgetBuckets
+	for _, bucket := range b.buckets {
+		if bucket.start > oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	return requests, retries
+}
+
+// idempotentMethods are always retried. Other methods HTTP calls
+// idempotent, PUT and DELETE among them, are only retried once configured
+// in idempotent_methods, since not every API implements them that way.
+var idempotentMethods = []string{http.MethodGet, http.MethodHead}
+
+// isIdempotent reports whether a request with method may be retried.
+func (t *retryTransport) isIdempotent(method string) bool {
+	return t.idempotent[strings.ToUpper(method)]
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
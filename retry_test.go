@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetryIdempotentMethods(t *testing.T) {
+	// Fails every other request, so a retry always gets a 200.
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+	route := "routes:\n  app:\n    upstream: " + upstream.URL + "\n    retry:\n      attempts: 2\n      on: [503]\n"
+
+	tests := []struct {
+		name    string
+		config  string
+		retried map[string]bool
+	}{
+		{"default", route, map[string]bool{"GET": true, "HEAD": true, "PUT": false, "DELETE": false}},
+		{"global", "idempotent_methods: [PUT]\n" + route, map[string]bool{"GET": true, "PUT": true, "DELETE": false}},
+		{"route", "idempotent_methods: [PUT]\n" + route + "      idempotent_methods: [delete]\n",
+			map[string]bool{"GET": true, "PUT": false, "DELETE": true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter(t, test.config)
+			for method, retried := range test.retried {
+				atomic.StoreInt32(&calls, 0)
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest(method, "/app/", nil))
+				if got := rec.Code == http.StatusOK; got != retried {
+					t.Errorf("%s retried = %v, want %v", method, got, retried)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/andybalholm/brotli"
+)
+
+// Default cap for rewrite_body when rewrite_body_max_bytes isn't set.
+const defaultRewriteBodyMaxBytes = 1 << 20
+
+// publicPaths maps paths as an upstream sees them back to the ones clients
+// use: add_prefix is taken off again and basePath, the prefix the proxy
+// stripped, put back on. Paths already under basePath, from upstreams that
+// know their public prefix, are left as they are.
+type publicPaths struct {
+	basePath  string
+	addPrefix string
+}
+
+func (p publicPaths) fix(upstreamPath string) string {
+	if p.addPrefix != "" && strings.HasPrefix(upstreamPath, p.addPrefix) {
+		rest := upstreamPath[len(p.addPrefix):]
+		if rest == "" || strings.ContainsAny(rest[:1], "/?#") {
+			upstreamPath = rest
+		}
+	}
+	if !strings.HasPrefix(upstreamPath, "/") {
+		upstreamPath = "/" + upstreamPath
+	}
+	if p.basePath == "" || upstreamPath == p.basePath || strings.HasPrefix(upstreamPath, p.basePath+"/") {
+		return upstreamPath
+	}
+	return p.basePath + upstreamPath
+}
+
+// upstreamHosts are the hosts that stand for the upstream in the URLs of
+// res: its backends' and the Host header the request was sent with.
+func upstreamHosts(res *http.Response, balancer *Balancer) map[string]bool {
+	hosts := map[string]bool{res.Request.URL.Host: true}
+	if res.Request.Host != "" {
+		hosts[res.Request.Host] = true
+	}
+	for _, backend := range balancer.Backends() {
+		hosts[backend.URL.Host] = true
+	}
+	return hosts
+}
+
+// NewLocationRewriteModifier points Location and Content-Location headers
+// that name the upstream back at the proxy. URLs at an upstream host become
+// root-relative, so clients stay on the scheme and host they came in with,
+// and root-relative paths get the route's public prefix. Relative and
+// foreign URLs are left alone.
+func NewLocationRewriteModifier(paths publicPaths, balancer *Balancer) ResponseModifier {
+	return func(res *http.Response) error {
+		var hosts map[string]bool
+		for _, name := range []string{"Location", "Content-Location"} {
+			value := res.Header.Get(name)
+			if value == "" {
+				continue
+			}
+			location, err := url.Parse(value)
+			if err != nil {
+				continue
+			}
+			if location.Host != "" {
+				if hosts == nil {
+					hosts = upstreamHosts(res, balancer)
+				}
+				if !hosts[location.Host] {
+					continue
+				}
+			} else if !strings.HasPrefix(location.Path, "/") {
+				continue
+			}
+			public := paths.fix(location.EscapedPath())
+			if location.RawQuery != "" {
+				public += "?" + location.RawQuery
+			}
+			if location.Fragment != "" {
+				public += "#" + location.EscapedFragment()
+			}
+			res.Header.Set(name, public)
+		}
+		return nil
+	}
+}
+
+// Root-relative links in HTML attributes: href="/about", not href="//cdn".
+var htmlRootLink = regexp.MustCompile(`(\s(?:href|src|action|poster)\s*=\s*["'])(/(?:[^/"'][^"']*)?)(["'])`)
+
+// How many host sets hostPatterns holds patterns for before it starts over:
+// there is one set per Host header sent upstream, and changed backends make
+// new ones.
+const maxHostPatterns = 64
+
+// hostPatterns compiles, once per set of upstream hosts, the pattern
+// NewBodyRewriteModifier finds absolute URLs at those hosts with.
+type hostPatterns struct {
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+func (p *hostPatterns) get(hosts map[string]bool) *regexp.Regexp {
+	quoted := make([]string, 0, len(hosts))
+	for host := range hosts {
+		quoted = append(quoted, regexp.QuoteMeta(host))
+	}
+	sort.Strings(quoted)
+	key := strings.Join(quoted, "|")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if re, ok := p.patterns[key]; ok {
+		return re
+	}
+	if p.patterns == nil || len(p.patterns) >= maxHostPatterns {
+		p.patterns = make(map[string]*regexp.Regexp)
+	}
+	// The host must end where the match does, so example.com doesn't
+	// match example.com.evil or example.com:8080.
+	re := regexp.MustCompile(`(?:https?:)?//(?:` + key + `)(?:(/[^\s"'<>()\\]*)|([^\w.:-])|$)`)
+	p.patterns[key] = re
+	return re
+}
+
+// replaceAllSubmatchFunc is re.ReplaceAllFunc, but repl gets each match's
+// submatches (nil for those that didn't take part) from the one search.
+func replaceAllSubmatchFunc(re *regexp.Regexp, src []byte, repl func(groups [][]byte) []byte) []byte {
+	matches := re.FindAllSubmatchIndex(src, -1)
+	if matches == nil {
+		return src
+	}
+	var out []byte
+	last := 0
+	for _, m := range matches {
+		groups := make([][]byte, len(m)/2)
+		for i := range groups {
+			if m[2*i] >= 0 {
+				groups[i] = src[m[2*i]:m[2*i+1]]
+			}
+		}
+		out = append(out, src[last:m[0]]...)
+		out = append(out, repl(groups)...)
+		last = m[1]
+	}
+	return append(out, src[last:]...)
+}
+
+// Content-Encodings decodeBody undoes.
+var decodableEncodings = map[string]bool{"gzip": true, "x-gzip": true, "deflate": true, "br": true}
+
+// decodeBody undoes one of decodableEncodings, stopping once the decoded
+// body passes limit bytes.
+func decodeBody(encoding string, body []byte, limit int64) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		r = brotli.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.LimitReader(r, limit+1))
+}
+
+// NewBodyRewriteModifier rewrites absolute URLs at upstream hosts in HTML
+// and JSON bodies, and in HTML root-relative links too, the way
+// NewLocationRewriteModifier rewrites headers. Bodies the upstream
+// compressed anyway are decoded first and sent on decoded if anything was
+// rewritten. Bodies over maxBytes, compressed or decoded, and ones in an
+// encoding it can't decode pass through as they are.
+func NewBodyRewriteModifier(paths publicPaths, balancer *Balancer, maxBytes int64) ResponseModifier {
+	patterns := &hostPatterns{}
+	return func(res *http.Response) error {
+		if res.StatusCode == http.StatusSwitchingProtocols || res.ContentLength > maxBytes {
+			return nil
+		}
+		encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+		if encoding == "identity" {
+			encoding = ""
+		}
+		mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		html := mediaType == "text/html" || mediaType == "application/xhtml+xml"
+		if !html && mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+			return nil
+		}
+
+		if encoding != "" && !decodableEncodings[encoding] {
+			log.WithFields(log.Fields{"upstream": res.Request.URL.Host, "encoding": encoding}).Debug("not rewriting body in an encoding it can't decode")
+			return nil
+		}
+
+		raw, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(raw)) > maxBytes {
+			res.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(raw), res.Body), res.Body}
+			return nil
+		}
+		res.Body.Close()
+		body := raw
+		if encoding != "" {
+			body, err = decodeBody(encoding, raw, maxBytes)
+			if err != nil || int64(len(body)) > maxBytes {
+				if err != nil {
+					log.WithFields(log.Fields{"upstream": res.Request.URL.Host, "encoding": encoding, "error": err}).Debug("not rewriting body that doesn't decode")
+				}
+				res.Body = ioutil.NopCloser(bytes.NewReader(raw))
+				return nil
+			}
+		}
+
+		rewritten := body
+		if html {
+			rewritten = replaceAllSubmatchFunc(htmlRootLink, rewritten, func(groups [][]byte) []byte {
+				return []byte(string(groups[1]) + paths.fix(string(groups[2])) + string(groups[3]))
+			})
+		}
+		rewritten = replaceAllSubmatchFunc(patterns.get(upstreamHosts(res, balancer)), rewritten, func(groups [][]byte) []byte {
+			return []byte(paths.fix(string(groups[1])) + string(groups[2]))
+		})
+
+		if !bytes.Equal(rewritten, body) {
+			// The body no longer matches the upstream's validators.
+			res.Header.Del("ETag")
+			res.Header.Del("Content-MD5")
+		} else if encoding != "" {
+			res.Body = ioutil.NopCloser(bytes.NewReader(raw))
+			return nil
+		}
+		res.Header.Del("Content-Encoding")
+		res.Body = ioutil.NopCloser(bytes.NewReader(rewritten))
+		res.ContentLength = int64(len(rewritten))
+		res.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+		res.TransferEncoding = nil
+		return nil
+	}
+}
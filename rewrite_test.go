@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestRewriteBodyDecodes(t *testing.T) {
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"":        nil,
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"br":      func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	}
+	var upstreamURL string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		page := `<a href="/about">about</a> <a href="` + upstreamURL + `/docs">docs</a>`
+		encoding := r.URL.Query().Get("encoding")
+		rw.Header().Set("Content-Type", "text/html")
+		if encoding == "zstd" {
+			// Not something it can decode.
+			rw.Header().Set("Content-Encoding", encoding)
+			io.WriteString(rw, page)
+			return
+		}
+		var buf bytes.Buffer
+		if encoder := encoders[encoding]; encoder != nil {
+			rw.Header().Set("Content-Encoding", encoding)
+			w := encoder(&buf)
+			io.WriteString(w, page)
+			w.Close()
+		} else {
+			buf.WriteString(page)
+		}
+		rw.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+	upstreamURL = upstream.URL
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    rewrite_body: true\n")
+
+	for encoding := range encoders {
+		name := encoding
+		if name == "" {
+			name = "identity"
+		}
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/?encoding="+encoding, nil))
+			if got := rec.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q after rewriting", got)
+			}
+			if want := `<a href="/app/about">about</a> <a href="/app/docs">docs</a>`; rec.Body.String() != want {
+				t.Errorf("body = %q, want %q", rec.Body.String(), want)
+			}
+		})
+	}
+	t.Run("undecodable", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/app/?encoding=zstd", nil))
+		if got := rec.Header().Get("Content-Encoding"); got != "zstd" {
+			t.Errorf("Content-Encoding = %q, want zstd", got)
+		}
+		if !strings.Contains(rec.Body.String(), `href="/about"`) {
+			t.Errorf("body %q was rewritten", rec.Body.String())
+		}
+	})
+}
+
+func TestHostPatterns(t *testing.T) {
+	var p hostPatterns
+	re := p.get(map[string]bool{"a.test": true, "b.test:8080": true})
+	if again := p.get(map[string]bool{"b.test:8080": true, "a.test": true}); again != re {
+		t.Error("pattern compiled again for the same hosts")
+	}
+	if other := p.get(map[string]bool{"a.test": true, "c.test": true}); other == re {
+		t.Error("pattern reused after the hosts changed")
+	}
+
+	got := replaceAllSubmatchFunc(re, []byte(`"//a.test/x" http://b.test:8080, //a.test.evil/ https://a.test`), func(groups [][]byte) []byte {
+		return []byte("[" + string(groups[1]) + "]" + string(groups[2]))
+	})
+	if want := `"[/x]" [], //a.test.evil/ []`; string(got) != want {
+		t.Errorf("replaced %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/netutil"
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+// NewServer builds a graceful server for one listener with the settings
+// shared by all of the frontend's listeners.
+func NewServer(addr string, handler http.Handler, config *Config) *graceful.Server {
+	server := &graceful.Server{
+		Timeout:      config.ShutdownTimeout,
+		TCPKeepAlive: 3 * time.Minute,
+		Server: &http.Server{
+			Addr:    addr,
+			Handler: handler,
+			// Zero falls back to http.DefaultMaxHeaderBytes (1MB). Oversized
+			// requests get a 431 from net/http.
+			MaxHeaderBytes:    config.MaxHeaderBytes,
+			ReadHeaderTimeout: config.ReadHeaderTimeout,
+			ReadTimeout:       config.ReadTimeout,
+			WriteTimeout:      config.WriteTimeout,
+			IdleTimeout:       config.IdleTimeout,
+		},
+	}
+	if config.ReadTimeout > 0 || config.WriteTimeout > 0 {
+		server.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if isStreamRequest(r) {
+				clearDeadlines(rw)
+			}
+			handler.ServeHTTP(rw, r)
+		})
+	}
+	server.SetKeepAlivesEnabled(!config.DisableKeepAlives)
+	return server
+}
+
+// clearDeadlines lifts the server's read and write timeouts off a request
+// that is meant to stay open, such as a websocket or event stream.
+func clearDeadlines(rw http.ResponseWriter) {
+	controller := http.NewResponseController(rw)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+}
+
+// serve runs the listener's server on ln until shutdown, applying its
+// connection limits and TLS settings. A positive MaxConnections caps the
+// number of simultaneously open connections; further connections wait in
+// the accept queue until a slot frees up. MaxConnectionsPerIP instead closes
+// a client's connections beyond its share straight away.
+func serve(l Listener, ln net.Listener) error {
+	if l.MaxConnectionsPerIP > 0 {
+		ln = &perIPListener{Listener: ln, limit: l.MaxConnectionsPerIP, exempt: l.TrustedProxies, open: make(map[string]int)}
+	}
+	if l.MaxConnections > 0 {
+		ln = netutil.LimitListener(&countingListener{Listener: ln, limit: int64(l.MaxConnections)}, l.MaxConnections)
+	}
+	if l.TLSConfig != nil {
+		l.Server.TLSConfig = l.TLSConfig
+		ln = tls.NewListener(ln, l.TLSConfig)
+	}
+	return l.Server.Serve(ln)
+}
+
+// countingListener tracks open connections so we can log when the limit
+// enforced by the wrapping netutil.LimitListener has been reached.
+type countingListener struct {
+	net.Listener
+	limit  int64
+	active int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if atomic.AddInt64(&l.active, 1) == l.limit {
+		log.WithFields(log.Fields{
+			"addr":            l.Addr().String(),
+			"max_connections": l.limit,
+		}).Warn("connection limit reached, new connections will wait")
+	}
+	return &countingConn{Conn: conn, listener: l}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	listener *countingListener
+	once     sync.Once
+}
+
+func (c *countingConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.listener.active, -1) })
+	return c.Conn.Close()
+}
+
+// perIPListener closes new connections from addresses that already have
+// limit open. Trusted proxies are exempt: their connections carry many
+// clients, and which one only becomes known once a request is read.
+type perIPListener struct {
+	net.Listener
+	limit  int
+	exempt CIDRList
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+func (l *perIPListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := stripPort(conn.RemoteAddr().String())
+		if l.exempt.Contains(net.ParseIP(ip)) {
+			return conn, nil
+		}
+
+		l.mu.Lock()
+		if l.open[ip] >= l.limit {
+			l.mu.Unlock()
+			// Only at debug: a flood would otherwise flood the logs too.
+			log.WithFields(log.Fields{
+				"remote":                 ip,
+				"max_connections_per_ip": l.limit,
+			}).Debug("rejecting connection over per-client limit")
+			conn.Close()
+			continue
+		}
+		l.open[ip]++
+		l.mu.Unlock()
+		return &perIPConn{Conn: conn, listener: l, ip: ip}, nil
+	}
+}
+
+type perIPConn struct {
+	net.Conn
+	listener *perIPListener
+	ip       string
+	once     sync.Once
+}
+
+func (c *perIPConn) Close() error {
+	c.once.Do(func() {
+		c.listener.mu.Lock()
+		defer c.listener.mu.Unlock()
+		if c.listener.open[c.ip]--; c.listener.open[c.ip] <= 0 {
+			delete(c.listener.open, c.ip)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// A Listener is one of the frontend's servers together with how its socket
+// should be set up.
+type Listener struct {
+	Name   string
+	Server *graceful.Server
+	// Serve TLS with this config; nil for plain HTTP.
+	TLSConfig      *tls.Config
+	MaxConnections int
+	// Per-client cap, not applied to connections from TrustedProxies.
+	MaxConnectionsPerIP int
+	TrustedProxies      CIDRList
+	// Keep going without this listener if its address can't be bound.
+	Optional bool
+	// How long after shutdown begins to stop this listener.
+	StopDelay time.Duration
+}
+
+// ServeAll opens every listener's socket (inheriting it from a previous
+// process when handed one), then serves them all and blocks until every one
+// has shut down after a SIGTERM or SIGINT.
+func ServeAll(listeners []Listener, upgrader *Upgrader, config *Config) {
+	var sockets []net.Listener
+	var serving []Listener
+	for _, l := range listeners {
+		ln, err := upgrader.Listen(l.Name, l.Server.Addr, l.Server.TCPKeepAlive)
+		if err != nil {
+			if l.Optional {
+				log.WithField("listener", l.Name).WithError(err).Error("not serving listener that failed to bind")
+				continue
+			}
+			log.WithField("listener", l.Name).Fatal(err)
+		}
+		sockets = append(sockets, ln)
+		serving = append(serving, l)
+	}
+	listeners = serving
+	upgrader.Ready()
+
+	// We handle the signals ourselves rather than letting each graceful
+	// server do it, so each signal can get its own grace period.
+	for _, l := range listeners {
+		l.Server.NoSignalHandling = true
+	}
+	go stopOnSignal(listeners, map[os.Signal]time.Duration{
+		syscall.SIGTERM: config.ShutdownTimeout,
+		os.Interrupt:    config.InterruptTimeout,
+	})
+
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Add(1)
+		go func(l Listener, ln net.Listener) {
+			defer wg.Done()
+			log.WithFields(log.Fields{
+				"listener": l.Name,
+				"addr":     ln.Addr().String(),
+			}).Info("listening")
+			if err := serve(l, ln); err != nil {
+				// graceful reports closing the listener on shutdown as an
+				// accept error.
+				if opErr, ok := err.(*net.OpError); !ok || opErr.Op != "accept" {
+					log.WithField("listener", l.Name).Fatal(err)
+				}
+			}
+		}(l, sockets[i])
+	}
+	wg.Wait()
+}
+
+// stopOnSignal stops every listener when one of the signals in grace
+// arrives, giving in-flight requests that signal's grace period to finish.
+// Listeners with a StopDelay keep accepting for that long first.
+// SIGTERM is how orchestrators (and a completed upgrade) stop us and gets the
+// full drain; SIGINT is usually someone at a terminal who wants out sooner.
+func stopOnSignal(listeners []Listener, grace map[os.Signal]time.Duration) {
+	signals := make(chan os.Signal, 1)
+	for sig := range grace {
+		signal.Notify(signals, sig)
+	}
+	sig := <-signals
+	log.WithFields(log.Fields{
+		"signal": sig.String(),
+		"grace":  grace[sig],
+	}).Info("shutting down")
+	for _, l := range listeners {
+		if l.StopDelay <= 0 {
+			l.Server.Stop(grace[sig])
+			continue
+		}
+		go func(l Listener) {
+			time.Sleep(l.StopDelay)
+			l.Server.Stop(grace[sig])
+		}(l)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long a single shutdown hook may run before we give up on it and move on.
+const shutdownHookTimeout = 5 * time.Second
+
+type shutdownHook struct {
+	name string
+	run  func() error
+}
+
+var (
+	shutdownHooksMu sync.Mutex
+	shutdownHooks   []shutdownHook
+)
+
+// RegisterShutdownHook adds a function to be run after the server has stopped
+// accepting connections and drained in-flight requests, but before the process
+// exits. This is where observability exporters (traces, metrics) flush their
+// last batch. Hooks run in the order they were registered.
+func RegisterShutdownHook(name string, run func() error) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, run})
+}
+
+func runShutdownHooks() {
+	shutdownHooksMu.Lock()
+	hooks := make([]shutdownHook, len(shutdownHooks))
+	copy(hooks, shutdownHooks)
+	shutdownHooksMu.Unlock()
+
+	for _, hook := range hooks {
+		done := make(chan error, 1)
+		go func(run func() error) {
+			done <- run()
+		}(hook.run)
+
+		select {
+		case err := <-done:
+			if err != nil {
+				log.WithField("hook", hook.name).WithError(err).Error("shutdown hook failed")
+			} else {
+				log.WithField("hook", hook.name).Debug("shutdown hook completed")
+			}
+		case <-time.After(shutdownHookTimeout):
+			log.WithField("hook", hook.name).Warn("shutdown hook timed out")
+		}
+	}
+}
+
+// LongLivedTracker keeps a handle on in-flight requests for routes marked
+// long_lived (websockets, SSE) so they can be cut off as soon as shutdown
+// begins. Without it graceful waits out its whole timeout on connections
+// that were never going to finish by themselves.
+type LongLivedTracker struct {
+	mu       sync.Mutex
+	nextID   uint64
+	cancels  map[uint64]context.CancelFunc
+	shutdown bool
+}
+
+func NewLongLivedTracker() *LongLivedTracker {
+	return &LongLivedTracker{cancels: make(map[uint64]context.CancelFunc)}
+}
+
+// Wrap runs handler with a request context that is cancelled on shutdown.
+// Cancelling the context makes the reverse proxy drop the upstream
+// connection, which in turn closes the client connection.
+func (t *LongLivedTracker) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		t.mu.Lock()
+		if t.shutdown {
+			t.mu.Unlock()
+			WriteError(rw, r, http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+		id := t.nextID
+		t.nextID++
+		t.cancels[id] = cancel
+		t.mu.Unlock()
+
+		defer func() {
+			t.mu.Lock()
+			delete(t.cancels, id)
+			t.mu.Unlock()
+		}()
+
+		clearDeadlines(rw)
+		handler.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// CloseAll cancels every tracked request and refuses new ones. It is meant to
+// be used as graceful.Server.ShutdownInitiated.
+func (t *LongLivedTracker) CloseAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.shutdown = true
+	if len(t.cancels) > 0 {
+		log.WithField("connections", len(t.cancels)).Info("closing long-lived connections for shutdown")
+	}
+	for id, cancel := range t.cancels {
+		cancel()
+		delete(t.cancels, id)
+	}
+}
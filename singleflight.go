@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// singleFlightMaxVaries bounds how many URLs' Vary headers are remembered;
+// past it they are forgotten and learned again.
+const singleFlightMaxVaries = 10000
+
+// A SingleFlight collapses concurrent identical GET and HEAD requests into
+// a single upstream call. The leader's response is buffered and replayed to
+// every waiting caller. Requests carrying credentials are never coalesced
+// since their responses may differ per caller.
+//
+// Requests are identical when they are for the same host and URL and agree
+// on Accept-Encoding and on the headers the URL's last response named in
+// Vary. Responses setting cookies aren't shared: waiting callers make their
+// own request instead.
+type SingleFlight struct {
+	route   string
+	metrics *Metrics
+
+	group  singleflight.Group
+	mu     sync.Mutex
+	varies map[string][]string
+
+	leaders   int64
+	coalesced int64
+}
+
+func NewSingleFlight(route string, metrics *Metrics) *SingleFlight {
+	return &SingleFlight{route: route, metrics: metrics, varies: make(map[string][]string)}
+}
+
+// SingleFlightStats counts the upstream calls made for coalescable requests
+// and the requests that shared one instead.
+type SingleFlightStats struct {
+	Leaders   int64 `json:"leaders"`
+	Coalesced int64 `json:"coalesced"`
+}
+
+func (f *SingleFlight) Stats() SingleFlightStats {
+	return SingleFlightStats{
+		Leaders:   atomic.LoadInt64(&f.leaders),
+		Coalesced: atomic.LoadInt64(&f.coalesced),
+	}
+}
+
+func (f *SingleFlight) count(result string, counter *int64) {
+	atomic.AddInt64(counter, 1)
+	if f.metrics != nil {
+		f.metrics.SingleFlightResult(f.route, result)
+	}
+}
+
+func (f *SingleFlight) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+			r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" ||
+			isStreamRequest(r) {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+
+		url := r.Method + " " + r.Host + " " + r.URL.RequestURI()
+		f.mu.Lock()
+		vary, ok := f.varies[url]
+		f.mu.Unlock()
+		if !ok {
+			vary = []string{"Accept-Encoding"}
+		}
+		key := url
+		for _, name := range vary {
+			if name == "*" {
+				handler.ServeHTTP(rw, r)
+				return
+			}
+			key += "\n" + name + ": " + strings.Join(r.Header.Values(name), ",")
+		}
+
+		leader := false
+		res, _, _ := f.group.Do(key, func() (interface{}, error) {
+			leader = true
+			buffered := NewBufferedResponse()
+			// Don't let the leader's client going away fail everyone else.
+			handler.ServeHTTP(buffered, r.WithContext(context.WithoutCancel(r.Context())))
+
+			vary := []string{"Accept-Encoding"}
+			for _, value := range buffered.Header().Values("Vary") {
+				for _, name := range strings.Split(value, ",") {
+					name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+					if name != "" && name != "Accept-Encoding" {
+						vary = append(vary, name)
+					}
+				}
+			}
+			f.mu.Lock()
+			if len(f.varies) >= singleFlightMaxVaries {
+				f.varies = make(map[string][]string)
+			}
+			f.varies[url] = vary
+			f.mu.Unlock()
+			return buffered, nil
+		})
+		buffered := res.(*BufferedResponse)
+		switch {
+		case leader:
+			f.count("leader", &f.leaders)
+		case buffered.Header().Get("Set-Cookie") != "":
+			handler.ServeHTTP(rw, r)
+			return
+		default:
+			f.count("coalesced", &f.coalesced)
+		}
+		buffered.WriteTo(rw)
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// load returns the content's body and type, reading the file if one is set.
+func (c *StaticContent) load(defaultType string) ([]byte, string, error) {
+	body := []byte(c.Content)
+	contentType := c.ContentType
+	if c.File != "" {
+		data, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return nil, "", fmt.Errorf("loading static content: %v", err)
+		}
+		body = data
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(c.File))
+		}
+	}
+	if contentType == "" {
+		contentType = defaultType
+	}
+	return body, contentType, nil
+}
+
+// NewStaticContentHandler serves a fixed body loaded once at startup, from
+// either inline content or a file.
+func NewStaticContentHandler(c *StaticContent, defaultType string) (http.Handler, error) {
+	body, contentType, err := c.load(defaultType)
+	if err != nil {
+		return nil, err
+	}
+	modified := time.Now()
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		http.ServeContent(rw, r, "", modified, bytes.NewReader(body))
+	}), nil
+}
+
+// NewFallbackHandler serves a route's fallback page with its configured
+// status, for when the upstream can't be reached.
+func NewFallbackHandler(c *FallbackContent) (http.Handler, error) {
+	body, contentType, err := c.load("text/html; charset=utf-8")
+	if err != nil {
+		return nil, err
+	}
+	status := c.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		header := rw.Header()
+		header.Set("Content-Type", contentType)
+		header.Set("Cache-Control", "no-store")
+		header.Set("X-Fallback", "true")
+		rw.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			rw.Write(body)
+		}
+	}), nil
+}
+
+// Index files looked for in directories when index isn't set.
+var defaultIndexFiles = []string{"index.html"}
+
+// NewFileServerHandler serves a static route's directory, with basePath
+// trimmed from request paths. Directories are answered with their first
+// index file, or a listing if list_directories is set. With spa_fallback,
+// paths that match nothing and have no file extension get the root index
+// file, so client-side routes load the app; a missing asset is still a 404.
+// Index files go out with Cache-Control: no-cache so a new deploy is picked
+// up right away, while everything else gets cache_control. Dotfiles are
+// never served.
+func NewFileServerHandler(basePath string, c *StaticRouteConfig) (http.Handler, error) {
+	if c == nil || c.Root == "" {
+		return nil, errors.New("static routes need static.root")
+	}
+	info, err := os.Stat(c.Root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("static root %s is not a directory", c.Root)
+	}
+	index := c.Index
+	if len(index) == 0 {
+		index = defaultIndexFiles
+	}
+	fs := &fileServer{
+		basePath:     basePath,
+		root:         http.Dir(c.Root),
+		index:        index,
+		spaFallback:  c.SPAFallback,
+		cacheControl: c.CacheControl,
+		listDirs:     c.ListDirectories,
+	}
+	return fs, nil
+}
+
+type fileServer struct {
+	basePath     string
+	root         http.FileSystem
+	index        []string
+	spaFallback  bool
+	cacheControl string
+	listDirs     bool
+}
+
+// staticMethods are the methods static routes answer.
+var staticMethods = []string{http.MethodGet, http.MethodHead}
+
+func (fs *fileServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", strings.Join(staticMethods, ", "))
+		WriteError(rw, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, fs.basePath))
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			WriteError(rw, r, http.StatusNotFound, "")
+			return
+		}
+	}
+
+	f, err := fs.root.Open(name)
+	if err != nil {
+		fs.notFound(rw, r, name)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fs.notFound(rw, r, name)
+		return
+	}
+	if !info.IsDir() {
+		fs.serveFile(rw, r, f, info, fs.cacheControl)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		// Relative links in the page only work from the slashed URL.
+		target := path.Base(r.URL.Path) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(rw, r, target, http.StatusMovedPermanently)
+		return
+	}
+	if fs.serveIndex(rw, r, name) {
+		return
+	}
+	if fs.listDirs {
+		fs.list(rw, r, f)
+		return
+	}
+	fs.notFound(rw, r, name)
+}
+
+// serveIndex serves dir's first index file, reporting whether there was one.
+func (fs *fileServer) serveIndex(rw http.ResponseWriter, r *http.Request, dir string) bool {
+	for _, index := range fs.index {
+		f, err := fs.root.Open(path.Join(dir, index))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		fs.serveFile(rw, r, f, info, "no-cache")
+		return true
+	}
+	return false
+}
+
+func (fs *fileServer) notFound(rw http.ResponseWriter, r *http.Request, name string) {
+	if fs.spaFallback && path.Ext(name) == "" && fs.serveIndex(rw, r, "/") {
+		return
+	}
+	WriteError(rw, r, http.StatusNotFound, "")
+}
+
+func (fs *fileServer) serveFile(rw http.ResponseWriter, r *http.Request, f http.File, info os.FileInfo, cacheControl string) {
+	if cacheControl != "" {
+		rw.Header().Set("Cache-Control", cacheControl)
+	}
+	http.ServeContent(rw, r, info.Name(), info.ModTime(), f)
+}
+
+func (fs *fileServer) list(rw http.ResponseWriter, r *http.Request, dir http.File) {
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		WriteError(rw, r, http.StatusInternalServerError, "")
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	var page bytes.Buffer
+	page.WriteString("<!doctype html>\n<pre>\n")
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			name += "/"
+		}
+		link := url.URL{Path: name}
+		fmt.Fprintf(&page, "<a href=\"%s\">%s</a>\n", html.EscapeString(link.String()), html.EscapeString(name))
+	}
+	page.WriteString("</pre>\n")
+	rw.Write(page.Bytes())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NewTimeoutHandler bounds how long the upstream call may take. Clients can
+// ask for a shorter (or, up to maxTimeout, longer) deadline through
+// deadlineHeader; otherwise the route's default timeout applies. When the
+// deadline passes the proxy's error handler answers with a 504. Websocket
+// handshakes are exempt.
+//
+// A non-nil override lets trusted clients go past maxTimeout, up to the
+// override's ceiling.
+func NewTimeoutHandler(deadlineHeader string, timeout, maxTimeout time.Duration, override *TimeoutOverride, handler http.Handler) http.Handler {
+	if maxTimeout <= 0 {
+		maxTimeout = timeout
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		deadline := timeout
+		if deadlineHeader != "" {
+			if requested, ok := parseDeadlineHeader(r.Header.Get(deadlineHeader)); ok {
+				deadline = requested
+			}
+		}
+		if maxTimeout > 0 && (deadline <= 0 || deadline > maxTimeout) {
+			deadline = maxTimeout
+		}
+		if override != nil && override.Clients.Contains(remoteIP(r)) {
+			if requested, ok := parseDeadlineHeader(r.Header.Get(override.Header)); ok {
+				deadline = requested
+				if deadline > override.Ceiling {
+					deadline = override.Ceiling
+				}
+			}
+		}
+		// A websocket lives on past its handshake; header_timeout still
+		// bounds the handshake itself.
+		if deadline <= 0 || isUpgradeRequest(r) {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+
+		if info := RequestInfoFromContext(r.Context()); info != nil {
+			info.SetDeadline(deadline)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), deadline)
+		defer cancel()
+		handler.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// TimeoutOverride is a deadline header honored only from Clients, which may
+// ask for up to Ceiling regardless of the route's max_timeout. It is for
+// internal callers with legitimately long requests.
+type TimeoutOverride struct {
+	Header  string
+	Clients CIDRList
+	Ceiling time.Duration
+}
+
+// parseDeadlineHeader accepts Go durations ("1.5s", "250ms") or a bare number
+// of seconds.
+func parseDeadlineHeader(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d, true
+	}
+	if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second)), true
+	}
+	return 0, false
+}
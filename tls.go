@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// NewTLSConfig builds the listener's tls.Config from the config file
+// settings. With a non-nil manager, certificates come from it rather than
+// from cert_file and key_file.
+func NewTLSConfig(c *TLSConfig, manager *autocert.Manager) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if manager != nil {
+		if c.CertFile != "" || c.KeyFile != "" {
+			return nil, errors.New("tls: set either autocert or cert_file and key_file, not both")
+		}
+		// Also answers TLS-ALPN-01 challenges when the listener is on 443.
+		tlsConfig = manager.TLSConfig()
+	} else {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls min_version %q (valid: %s)", c.MinVersion, strings.Join(sortedKeys(tlsVersions), ", "))
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(c.CipherSuites) > 0 {
+		suites, err := parseCipherSuites(c.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
+
+	// Offer HTTP/2 through ALPN. autocert's config already lists h2, along
+	// with its challenge protocol.
+	var protos []string
+	for _, proto := range tlsConfig.NextProtos {
+		if proto != "h2" && proto != "http/1.1" {
+			protos = append(protos, proto)
+		}
+	}
+	if !c.DisableHTTP2 {
+		protos = append(protos, "h2")
+	}
+	tlsConfig.NextProtos = append(protos, "http/1.1")
+
+	switch c.ClientAuth {
+	case "", "none":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown tls client_auth %q (valid: none, optional, require)", c.ClientAuth)
+	}
+
+	if tlsConfig.ClientAuth != tls.NoClientCert {
+		if c.ClientCAFile == "" {
+			return nil, fmt.Errorf("tls client_auth %q requires client_ca_file", c.ClientAuth)
+		}
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	tlsConfig.SessionTicketsDisabled = c.SessionTicketsDisabled
+	if c.SessionTicketKeysFile != "" && !c.SessionTicketsDisabled {
+		keys, err := loadSessionTicketKeys(c.SessionTicketKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.SetSessionTicketKeys(keys)
+		go reloadSessionTicketKeys(tlsConfig, c.SessionTicketKeysFile)
+	}
+	return tlsConfig, nil
+}
+
+// How often session_ticket_keys_file is checked for new keys.
+const sessionTicketKeysReload = time.Minute
+
+// reloadSessionTicketKeys picks up rotated keys. A file that has become
+// unreadable or invalid is logged and the keys in use are kept.
+func reloadSessionTicketKeys(tlsConfig *tls.Config, path string) {
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+	for range time.Tick(sessionTicketKeysReload) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modified) {
+			continue
+		}
+		keys, err := loadSessionTicketKeys(path)
+		if err != nil {
+			log.WithError(err).Error("keeping previous session ticket keys")
+			continue
+		}
+		modified = info.ModTime()
+		tlsConfig.SetSessionTicketKeys(keys)
+		log.WithField("keys", len(keys)).Info("reloaded session ticket keys")
+	}
+}
+
+func loadSessionTicketKeys(path string) ([][32]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading session ticket keys: %v", err)
+	}
+	var keys [][32]byte
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(line)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("%s:%d: session ticket keys must be 32 bytes, hex-encoded", path, i+1)
+		}
+		var key [32]byte
+		copy(key[:], raw)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session ticket keys in %s", path)
+	}
+	return keys, nil
+}
+
+// Where autocert keeps certificates unless cache_dir is set.
+const defaultAutocertCacheDir = "autocert-cache"
+
+// NewAutocertManager sets up ACME certificate management for c.Hosts. Its
+// HTTPHandler has to serve the plain HTTP listener for HTTP-01 challenges.
+func NewAutocertManager(c *AutocertConfig) (*autocert.Manager, error) {
+	if len(c.Hosts) == 0 {
+		return nil, errors.New("tls.autocert: hosts is required")
+	}
+	cacheDir := c.CacheDir
+	if cacheDir == "" {
+		cacheDir = defaultAutocertCacheDir
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      c.Email,
+	}
+	if c.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	return manager, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites maps IANA suite names (e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) onto their IDs. Go doesn't allow
+// configuring TLS 1.3 suites, so this only affects TLS 1.2 and below.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls cipher suite %q (valid: %s)", name, strings.Join(sortedKeys(known), ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func sortedKeys(m map[string]uint16) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewClientCertHandler rejects requests that didn't present a client
+// certificate which verified against the configured CA bundle.
+func NewClientCertHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			WriteError(rw, r, http.StatusForbidden, "a verified client certificate is required")
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// setClientCertHeaders tells the upstream about the client certificate
+// presented on this connection. Any client-supplied values are dropped first
+// so they can't be spoofed over plain HTTP.
+func setClientCertHeaders(req *http.Request) {
+	req.Header.Del("X-Client-Cert-Subject")
+	req.Header.Del("X-Client-Cert-Verified")
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		req.Header.Set("X-Client-Cert-Verified", "false")
+		return
+	}
+	req.Header.Set("X-Client-Cert-Subject", req.TLS.PeerCertificates[0].Subject.String())
+	req.Header.Set("X-Client-Cert-Verified", strconv.FormatBool(len(req.TLS.VerifiedChains) > 0))
+}
+
+// NewRequireTLSHandler keeps a route off plain HTTP: insecure requests are
+// either redirected to https or, in "reject" mode, refused with a 403.
+// httpsPort is appended to redirects when the TLS listener isn't on 443.
+func NewRequireTLSHandler(mode string, trusted CIDRList, httpsPort string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if isSecure(r, trusted) {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+		if mode == "reject" {
+			WriteError(rw, r, http.StatusForbidden, "this resource requires HTTPS")
+			return
+		}
+
+		host := stripPort(r.Host)
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			// 308 keeps the method and body.
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(rw, r, target, status)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Defaults for tracing settings left unset.
+const (
+	defaultTracingEndpoint    = "localhost:4318"
+	defaultTracingServiceName = "frontend"
+)
+
+// Tracing starts an OpenTelemetry server span for every request and exports
+// spans over OTLP/HTTP. Trace context is read from the request headers, and
+// the proxy's transport passes it on to upstreams under a client span of
+// its own.
+type Tracing struct {
+	tracer trace.Tracer
+	// Give requests without an X-Request-Id their trace ID as one.
+	requestIDs bool
+}
+
+// NewTracing sets up the exporter and makes it and the configured
+// propagators the process-wide defaults. Spans still buffered are flushed by
+// a shutdown hook.
+func NewTracing(c *TracingConfig, requestIDs bool) (*Tracing, error) {
+	var propagators []propagation.TextMapPropagator
+	names := c.Propagators
+	if len(names) == 0 {
+		names = []string{"tracecontext"}
+	}
+	for _, name := range names {
+		switch name {
+		case "tracecontext":
+			propagators = append(propagators, propagation.TraceContext{}, propagation.Baggage{})
+		case "b3":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader|b3.B3SingleHeader)))
+		default:
+			return nil, fmt.Errorf("tracing: unknown propagator %q (valid: tracecontext, b3)", name)
+		}
+	}
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = defaultTracingEndpoint
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if c.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if len(c.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(c.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %v", err)
+	}
+
+	serviceName := c.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	sampleRate := c.SampleRate
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagators...))
+	RegisterShutdownHook("tracing", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownHookTimeout)
+		defer cancel()
+		return provider.Shutdown(ctx)
+	})
+
+	return &Tracing{tracer: provider.Tracer("frontend"), requestIDs: requestIDs}, nil
+}
+
+// Wrap traces route's requests.
+func (t *Tracing) Wrap(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("server.address", r.Host),
+				attribute.String("client.address", stripPort(r.RemoteAddr)),
+				attribute.String("user_agent.original", r.UserAgent()),
+			))
+		defer span.End()
+		if t.requestIDs && r.Header.Get("X-Request-Id") == "" && span.SpanContext().HasTraceID() {
+			r.Header.Set("X-Request-Id", span.SpanContext().TraceID().String())
+		}
+
+		statusWriter := NewStatusLoggingResponseWriter(rw)
+		handler.ServeHTTP(statusWriter, r.WithContext(ctx))
+		statusWriter.noteUpgrade(r)
+
+		status := statusWriter.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if id := r.Header.Get("X-Request-Id"); id != "" {
+			span.SetAttributes(attribute.String("request_id", id))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// tracingTransport sends each upstream attempt under a client span, with the
+// trace context in the request headers. Requests that aren't being traced
+// pass straight through.
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	server := trace.SpanFromContext(req.Context())
+	if !server.SpanContext().IsValid() {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	ctx, span := server.TracerProvider().Tracer("frontend").Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.full", req.URL.String()),
+		))
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+	latency := float64(time.Since(start)) / float64(time.Millisecond)
+	server.SetAttributes(
+		attribute.String("upstream.address", req.URL.Host),
+		attribute.Float64("upstream.latency_ms", latency),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	if res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+	return res, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// NewRouteTransport builds the upstream transport for a route. Each route
+// gets its own transport (created once at startup) so per-route settings
+// don't leak into other routes' connection pools.
+func NewRouteTransport(route *Route, resolver *net.Resolver) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// How long to wait for the upstream's response headers once the request
+	// has been written. Slow bodies are governed by idle_read_timeout.
+	transport.ResponseHeaderTimeout = route.HeaderTimeout
+	transport.DisableKeepAlives = route.DisableUpstreamKeepAlives
+	transport.MaxConnsPerHost = route.MaxConnsPerHost
+	if route.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = route.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < route.MaxIdleConnsPerHost {
+			// MaxIdleConns caps idle connections across all backends.
+			transport.MaxIdleConns = 0
+		}
+	}
+	if route.UpstreamIdleTimeout > 0 {
+		transport.IdleConnTimeout = route.UpstreamIdleTimeout
+	}
+	// A forwarded Expect: 100-continue makes the transport hold the body
+	// back until the upstream sends its 100 (or this timeout passes), and
+	// the server only sends the client its 100 once we start reading.
+	if route.ExpectContinueTimeout > 0 {
+		transport.ExpectContinueTimeout = route.ExpectContinueTimeout
+	}
+	if route.DialTimeout > 0 || route.UpstreamKeepAlive != 0 || resolver != nil {
+		// Same as the default transport's dialer apart from the overrides.
+		dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: 30 * time.Second, Resolver: resolver}
+		if route.DialTimeout > 0 {
+			dialer.Timeout = route.DialTimeout
+		}
+		if route.UpstreamKeepAlive != 0 {
+			dialer.KeepAlive = route.UpstreamKeepAlive
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	switch {
+	case route.UpstreamH2C:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		transport.HTTP2 = &http.HTTP2Config{SendPingTimeout: upstreamHTTP2PingInterval}
+	case route.UpstreamHTTP2:
+		h2, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Ping connections that go quiet so a dead one is dropped before
+		// every stream multiplexed onto it times out.
+		h2.ReadIdleTimeout = upstreamHTTP2PingInterval
+	default:
+		// The cloned default transport would negotiate h2 with any TLS
+		// upstream that offers it; keep to HTTP/1.1 unless asked.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		if transport.TLSClientConfig != nil {
+			transport.TLSClientConfig.NextProtos = nil
+		}
+	}
+	return transport
+}
+
+// The default transport's dial timeout, used unless dial_timeout is set.
+const defaultDialTimeout = 30 * time.Second
+
+// How long an upstream HTTP/2 connection may be idle before we ping it.
+const upstreamHTTP2PingInterval = 30 * time.Second
+
+// NewResolver returns a resolver that sends every upstream lookup to the
+// configured DNS server, or nil to use the system resolver.
+func NewResolver(c *ResolverConfig) (*net.Resolver, error) {
+	if c == nil {
+		return nil, nil
+	}
+	switch c.Protocol {
+	case "", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unknown resolver protocol %q (valid: udp, tcp)", c.Protocol)
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return nil, fmt.Errorf("resolver address: %v", err)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			// network is what the Go resolver asked for; a configured
+			// protocol overrides it.
+			if c.Protocol != "" {
+				network = c.Protocol
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, c.Address)
+		},
+	}, nil
+}
+
+// NewIdleReadTimeoutModifier aborts a response body that goes quiet for
+// longer than timeout. A slow but steady download keeps going; a stalled one
+// is cut off rather than tying up the connection forever.
+func NewIdleReadTimeoutModifier(timeout time.Duration) ResponseModifier {
+	return func(res *http.Response) error {
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			// The body is the upgraded connection and has to stay
+			// writable; ws_idle_timeout covers these.
+			return nil
+		}
+		res.Body = newIdleTimeoutReader(res.Body, timeout, res.Request.URL.String())
+		return nil
+	}
+}
+
+type idleTimeoutReader struct {
+	body  io.ReadCloser
+	timer *time.Timer
+	dur   time.Duration
+
+	mu       sync.Mutex
+	timedOut bool
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration, upstream string) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, dur: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		r.timedOut = true
+		r.mu.Unlock()
+		log.WithFields(log.Fields{
+			"upstream":          upstream,
+			"idle_read_timeout": timeout,
+		}).Warn("upstream response body stalled, aborting")
+		// Closing the body unblocks the pending Read with an error.
+		body.Close()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.dur)
+	}
+	r.mu.Lock()
+	timedOut := r.timedOut
+	r.mu.Unlock()
+	if timedOut && err != nil {
+		return n, errIdleReadTimeout
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+type idleReadTimeoutError struct{}
+
+func (idleReadTimeoutError) Error() string   { return "upstream response body idle timeout" }
+func (idleReadTimeoutError) Timeout() bool   { return true }
+func (idleReadTimeoutError) Temporary() bool { return true }
+
+var errIdleReadTimeout error = idleReadTimeoutError{}
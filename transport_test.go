@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeaderTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(rw, "ok")
+	}))
+	defer upstream.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    header_timeout: 50ms\n")
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/app/fast", http.StatusOK},
+		{"/app/slow", http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.path, rec.Code, test.status)
+		}
+	}
+}
+
+func TestIdleReadTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gap := 20 * time.Millisecond
+		if r.URL.Path == "/stalled" {
+			gap = 200 * time.Millisecond
+		}
+		rw.WriteHeader(http.StatusOK)
+		for i := 0; i < 5; i++ {
+			io.WriteString(rw, "chunk\n")
+			rw.(http.Flusher).Flush()
+			time.Sleep(gap)
+		}
+	}))
+	defer upstream.Close()
+	router := newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    idle_read_timeout: 100ms\n")
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	tests := []struct {
+		path     string
+		complete bool
+	}{
+		{"/app/steady", true},
+		{"/app/stalled", false},
+	}
+	for _, test := range tests {
+		res, err := http.Get(proxy.URL + test.path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		complete := err == nil && len(body) == 5*len("chunk\n")
+		if complete != test.complete {
+			t.Errorf("%s: read %d bytes (err %v), complete = %v, want %v", test.path, len(body), err, complete, test.complete)
+		}
+	}
+}
+
+// sendExpectContinue sends a PUT for path with Expect: 100-continue and
+// holds its body back until the server answers 100 Continue. It returns
+// whether the body was sent and the final response.
+func sendExpectContinue(t *testing.T, addr, path, body string) (bool, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "PUT %s HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", path, len(body))
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := res.StatusCode == http.StatusContinue
+	if sent {
+		io.WriteString(conn, body)
+		if res, err = http.ReadResponse(br, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Buffered so the connection can be closed before the servers are.
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body = io.NopCloser(bytes.NewReader(buf))
+	return sent, res
+}
+
+func TestExpectContinue(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("reject") != "" {
+			// Refused without reading the body, which is then never sent.
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		rw.Header().Set("X-Upstream-Expect", r.Header.Get("Expect"))
+		rw.Header().Set("X-Upstream-Body", string(body))
+	}))
+	defer upstream.Close()
+
+	t.Run("forwarded", func(t *testing.T) {
+		proxy := httptest.NewServer(newTestRouter(t, "routes:\n  app: "+upstream.URL+"\n"))
+		defer proxy.Close()
+		sent, res := sendExpectContinue(t, proxy.Listener.Addr().String(), "/app/upload", "payload")
+		if !sent || res.StatusCode != http.StatusOK {
+			t.Fatalf("sent body = %v, status = %d; want the body sent after a 100 and 200", sent, res.StatusCode)
+		}
+		if got := res.Header.Get("X-Upstream-Expect"); got != "100-continue" {
+			t.Errorf("upstream saw Expect %q, want 100-continue", got)
+		}
+		if got := res.Header.Get("X-Upstream-Body"); got != "payload" {
+			t.Errorf("upstream got body %q, want payload", got)
+		}
+	})
+
+	t.Run("refused before the body", func(t *testing.T) {
+		proxy := httptest.NewServer(newTestRouter(t, "routes:\n  app: "+upstream.URL+"\n"))
+		defer proxy.Close()
+		sent, res := sendExpectContinue(t, proxy.Listener.Addr().String(), "/app/upload?reject=1", "payload")
+		if sent {
+			t.Error("proxy asked for the body the upstream refused")
+		}
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("status = %d, want %d", res.StatusCode, http.StatusForbidden)
+		}
+	})
+
+	t.Run("strip_expect_continue", func(t *testing.T) {
+		proxy := httptest.NewServer(newTestRouter(t, "routes:\n  app:\n    upstream: "+upstream.URL+"\n    strip_expect_continue: true\n"))
+		defer proxy.Close()
+		sent, res := sendExpectContinue(t, proxy.Listener.Addr().String(), "/app/upload", "payload")
+		if !sent || res.StatusCode != http.StatusOK {
+			t.Fatalf("sent body = %v, status = %d; want the body sent after a 100 and 200", sent, res.StatusCode)
+		}
+		if got := res.Header.Get("X-Upstream-Expect"); got != "" {
+			t.Errorf("upstream saw Expect %q, want none", got)
+		}
+		if got := res.Header.Get("X-Upstream-Body"); got != "payload" {
+			t.Errorf("upstream got body %q, want payload", got)
+		}
+	})
+}
+
+func TestExpectContinueTimeout(t *testing.T) {
+	// An upstream that never sends 100 Continue, just waits for the body.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				body, _ := io.ReadAll(req.Body)
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nX-Upstream-Body: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", body)
+			}()
+		}
+	}()
+
+	proxy := httptest.NewServer(newTestRouter(t, "routes:\n  app:\n    upstream: http://"+listener.Addr().String()+"\n    expect_continue_timeout: 100ms\n"))
+	defer proxy.Close()
+	start := time.Now()
+	sent, res := sendExpectContinue(t, proxy.Listener.Addr().String(), "/app/upload", "payload")
+	elapsed := time.Since(start)
+	if !sent || res.StatusCode != http.StatusOK {
+		t.Fatalf("sent body = %v, status = %d; want the body sent after a 100 and 200", sent, res.StatusCode)
+	}
+	if got := res.Header.Get("X-Upstream-Body"); got != "payload" {
+		t.Errorf("upstream got body %q, want payload", got)
+	}
+	// The body goes up once the timeout passes, not after the default 1s.
+	if elapsed < 100*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("took %v, want about expect_continue_timeout", elapsed)
+	}
+}
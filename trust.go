@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CIDRList is a list of networks given in config as CIDRs or bare IPs.
+type CIDRList []*net.IPNet
+
+func (list *CIDRList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entries []string
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	var parsed CIDRList
+	for _, entry := range entries {
+		network, err := ParseCIDRList([]string{entry})
+		if err != nil {
+			return &invalidEntryError{entry: entry, err: err}
+		}
+		parsed = append(parsed, network...)
+	}
+	*list = parsed
+	return nil
+}
+
+func ParseCIDRList(entries []string) (CIDRList, error) {
+	var list CIDRList
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", entry, err)
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+func (list CIDRList) Contains(ip net.IP) bool {
+	return list.Match(ip) != nil
+}
+
+// Match returns the first network in the list containing ip, or nil.
+func (list CIDRList) Match(ip net.IP) *net.IPNet {
+	if ip == nil {
+		return nil
+	}
+	for _, network := range list {
+		if network.Contains(ip) {
+			return network
+		}
+	}
+	return nil
+}
+
+// remoteIP is the address of the peer that connected to us, which may be a
+// proxy rather than the client.
+func remoteIP(r *http.Request) net.IP {
+	return net.ParseIP(stripPort(r.RemoteAddr))
+}
+
+// clientIP is the address of the client, looking through trusted proxies:
+// the rightmost X-Forwarded-For entry that isn't one of them. Entries
+// further left could have been made up by the client.
+func clientIP(r *http.Request, trusted CIDRList) string {
+	ip := stripPort(r.RemoteAddr)
+	if !fromTrustedProxy(r, trusted) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !trusted.Contains(net.ParseIP(hop)) {
+			break
+		}
+	}
+	return ip
+}
+
+// fromTrustedProxy reports whether forwarding headers on r can be believed.
+func fromTrustedProxy(r *http.Request, trusted CIDRList) bool {
+	return trusted.Contains(remoteIP(r))
+}
+
+// isSecure reports whether the client reached us over TLS, either directly
+// or through a trusted proxy that says so in X-Forwarded-Proto.
+func isSecure(r *http.Request, trusted CIDRList) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return fromTrustedProxy(r, trusted) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// setForwardedProtoHost tells the upstream how the client reached us, in
+// X-Forwarded-Proto and X-Forwarded-Host. A trusted proxy in front of us
+// knows better and its values are kept; anyone else's are overwritten.
+func setForwardedProtoHost(req *http.Request, trusted CIDRList) {
+	fromProxy := fromTrustedProxy(req, trusted)
+	if !fromProxy || req.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if !fromProxy || req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+}
+
+// passForwardedForHeader carries the inbound X-Forwarded-For from the
+// director to the transport in xff_mode trust. It can't travel under its own
+// name: ReverseProxy appends the client address to any X-Forwarded-For the
+// director leaves in place, and only skips that for a nil value.
+const passForwardedForHeader = "X-Frontend-Pass-Forwarded-For"
+
+// setForwardedFor prepares the outgoing X-Forwarded-For for ReverseProxy,
+// which appends the address of whoever connected to us:
+//
+//   - append keeps the inbound value, so the result is the full chain.
+//   - replace drops it, so only the connecting address goes upstream. Use
+//     this at the edge, where inbound values are client-controlled.
+//   - trust forwards the inbound value as is, without adding ours.
+func setForwardedFor(req *http.Request, mode string) {
+	switch mode {
+	case "replace":
+		req.Header.Del("X-Forwarded-For")
+	case "trust":
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			req.Header[passForwardedForHeader] = prior
+		}
+		req.Header["X-Forwarded-For"] = nil
+	}
+}
+
+// passForwardedForTransport restores what setForwardedFor set aside in
+// trust mode, after ReverseProxy is done with the header.
+type passForwardedForTransport struct {
+	http.RoundTripper
+}
+
+func (t passForwardedForTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if prior, ok := req.Header[passForwardedForHeader]; ok {
+		req = req.Clone(req.Context())
+		delete(req.Header, passForwardedForHeader)
+		req.Header["X-Forwarded-For"] = prior
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// setForwarded appends an RFC 7239 Forwarded element describing this hop:
+// who connected to us, over which protocol, for which host.
+func setForwarded(req *http.Request) {
+	element := "for=" + forwardedNode(stripPort(req.RemoteAddr))
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	element += ";proto=" + proto
+	if req.Host != "" {
+		element += ";host=" + forwardedValue(req.Host)
+	}
+	if prior := req.Header.Get("Forwarded"); prior != "" {
+		element = prior + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+// forwardedNode formats an address for a Forwarded for= parameter; IPv6
+// addresses have to be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes v unless it is a valid token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,194 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Names of the listening sockets handed to a new process, in the order of its
+// extra file descriptors (starting at fd 3), e.g. "http,https,admin".
+const inheritedListenersEnv = "FRONTEND_LISTENERS"
+
+// PID of the process that started an upgraded one, which it signals once it
+// is ready.
+const upgradeParentEnv = "FRONTEND_PARENT_PID"
+
+// Upgrader performs zero-downtime binary upgrades. The running process
+// passes its listening sockets to a freshly exec'd copy of the binary; once
+// the new process is serving it tells the old one to shut down, and the old
+// one drains its in-flight requests like any graceful shutdown. Sockets passed
+// by systemd socket activation are picked up the same way.
+type Upgrader struct {
+	pidFile string
+
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	// The previous frontend waiting for us to be ready, if it started us.
+	parent    int
+	names     []string
+	listeners map[string]*net.TCPListener
+	// Set while a new process we started hasn't taken over or exited.
+	upgrading bool
+}
+
+func NewUpgrader(pidFile string) *Upgrader {
+	u := &Upgrader{
+		pidFile:   pidFile,
+		inherited: make(map[string]*os.File),
+		listeners: make(map[string]*net.TCPListener),
+	}
+
+	u.parent, _ = strconv.Atoi(os.Getenv(upgradeParentEnv))
+	os.Unsetenv(upgradeParentEnv)
+	if names := os.Getenv(inheritedListenersEnv); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			u.inherited[name] = os.NewFile(uintptr(3+i), name)
+		}
+		os.Unsetenv(inheritedListenersEnv)
+	} else if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		// systemd socket activation; sockets are matched by FileDescriptorName.
+		count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < count && i < len(names); i++ {
+			u.inherited[names[i]] = os.NewFile(uintptr(3+i), names[i])
+		}
+		// Like sd_listen_fds, so processes we start don't take the sockets
+		// for theirs.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}
+	return u
+}
+
+// Listen returns the named listener, reusing an inherited socket when there
+// is one and opening addr otherwise.
+func (u *Upgrader) Listen(name, addr string, keepAlive time.Duration) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var ln net.Listener
+	var err error
+	if f, ok := u.inherited[name]; ok {
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting %s listener: %v", name, err)
+		}
+		log.WithField("listener", name).Info("inherited listening socket")
+	} else {
+		lc := net.ListenConfig{KeepAlive: keepAlive}
+		ln, err = lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tcp, ok := ln.(*net.TCPListener); ok {
+		u.names = append(u.names, name)
+		u.listeners[name] = tcp
+	}
+	return ln, nil
+}
+
+// Ready is called once every listener is open. It records our PID and, if
+// we were started by an upgrade, tells the old process to drain and exit.
+// If that process is gone (we have been reparented), nothing is signalled:
+// its PID may belong to something else by now.
+func (u *Upgrader) Ready() {
+	if u.pidFile != "" {
+		if err := ioutil.WriteFile(u.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			log.WithError(err).Error("writing pid file")
+		}
+	}
+	if u.parent == 0 {
+		return
+	}
+	if ppid := os.Getppid(); ppid != u.parent {
+		log.WithFields(log.Fields{"parent": u.parent, "ppid": ppid}).Warn("upgrade complete, but the previous process is gone")
+		return
+	}
+	log.WithField("parent", u.parent).Info("upgrade complete, asking previous process to drain")
+	syscall.Kill(u.parent, syscall.SIGTERM)
+}
+
+// HandleSignals upgrades the binary whenever the process receives SIGUSR2.
+func (u *Upgrader) HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			if err := u.Upgrade(); err != nil {
+				// Keep serving as we were; the old process is still healthy.
+				log.WithError(err).Error("binary upgrade failed")
+			}
+		}
+	}()
+}
+
+// Upgrade starts a new copy of the binary with our listening sockets. Only
+// one upgrade runs at a time: until the new process takes over, or exits
+// without doing so, further upgrades are refused.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.upgrading {
+		return errors.New("an upgrade is already in progress")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range u.names {
+		f, err := u.listeners[name].File()
+		if err != nil {
+			return fmt.Errorf("duplicating %s listener: %v", name, err)
+		}
+		files = append(files, f)
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		inheritedListenersEnv+"="+strings.Join(u.names, ","),
+		upgradeParentEnv+"="+strconv.Itoa(os.Getpid()))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	u.upgrading = true
+	log.WithField("pid", cmd.Process.Pid).Info("started upgraded process")
+	// The new process outlives us once it takes over. If it exits first,
+	// it never did (a bad config, say), and we carry on serving.
+	go func() {
+		err := cmd.Wait()
+		log.WithField("pid", cmd.Process.Pid).WithError(err).Error("upgraded process exited before taking over")
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+	return nil
+}
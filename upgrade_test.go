@@ -0,0 +1,71 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUpgraderReady(t *testing.T) {
+	if os.Getenv("FRONTEND_TEST_UPGRADED") != "" {
+		// Running as the upgraded process started below.
+		NewUpgrader("").Ready()
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	// The PID of a process that has exited, as if the previous frontend
+	// were gone.
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		parent   int
+		signaled bool
+	}{
+		{"parent", os.Getpid(), true},
+		{"parent gone", exited.Process.Pid, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestUpgraderReady$")
+			cmd.Env = append(os.Environ(), "FRONTEND_TEST_UPGRADED=1", upgradeParentEnv+"="+strconv.Itoa(test.parent))
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("upgraded process: %v\n%s", err, out)
+			}
+			select {
+			case <-signals:
+				if !test.signaled {
+					t.Error("signalled a process other than the parent")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if test.signaled {
+					t.Error("parent not signalled")
+				}
+			}
+		})
+	}
+}
+
+func TestUpgraderUnsetsInheritedEnvironment(t *testing.T) {
+	t.Setenv(upgradeParentEnv, "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "0")
+	t.Setenv("LISTEN_FDNAMES", "")
+	NewUpgrader("")
+	for _, name := range []string{upgradeParentEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if value, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s=%s still set", name, value)
+		}
+	}
+}
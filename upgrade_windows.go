@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Upgrader is a no-op on Windows, which can't pass sockets to a child
+// process; restarts fall back to a normal graceful shutdown.
+type Upgrader struct{}
+
+func NewUpgrader(pidFile string) *Upgrader {
+	return &Upgrader{}
+}
+
+func (u *Upgrader) Listen(name, addr string, keepAlive time.Duration) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func (u *Upgrader) Ready() {}
+
+func (u *Upgrader) HandleSignals() {
+	log.Warn("graceful_restart is not supported on this platform")
+}
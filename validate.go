@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// How long --validate waits for each upstream host to resolve.
+const validateLookupTimeout = 5 * time.Second
+
+// A ConfigError is a problem with one setting, found at Path in the config
+// file, e.g. routes.api.upstream.
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+// ConfigErrors are all the problems found in a config, in path order.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func (errs *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*errs = append(*errs, &ConfigError{Path: path, Err: fmt.Errorf(format, args...)})
+}
+
+// orNil returns errs as an error, sorted, or nil if there are none.
+func (errs ConfigErrors) orNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	return errs
+}
+
+// An invalidEntryError is a config value that doesn't parse. loadConfig
+// finds where in the file it is, since yaml doesn't say.
+type invalidEntryError struct {
+	entry string
+	err   error
+}
+
+func (e *invalidEntryError) Error() string {
+	return e.err.Error()
+}
+
+// locateEntryError turns an unmarshal error about an invalid entry into a
+// ConfigError at the entry's path, when data has it.
+func locateEntryError(data []byte, err error) error {
+	var entryErr *invalidEntryError
+	if !errors.As(err, &entryErr) {
+		return err
+	}
+	var tree interface{}
+	if yaml.Unmarshal(data, &tree) != nil {
+		return err
+	}
+	if path := findYAMLPath(tree, "", entryErr.entry); path != "" {
+		return ConfigErrors{{Path: path, Err: entryErr.err}}
+	}
+	return err
+}
+
+// findYAMLPath returns the path to the first scalar in tree equal to value.
+func findYAMLPath(tree interface{}, path, value string) string {
+	switch node := tree.(type) {
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(node))
+		byKey := make(map[string]interface{}, len(node))
+		for key, child := range node {
+			keys = append(keys, fmt.Sprint(key))
+			byKey[fmt.Sprint(key)] = child
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			if found := findYAMLPath(byKey[key], childPath, value); found != "" {
+				return found
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			if found := findYAMLPath(child, fmt.Sprintf("%s[%d]", path, i), value); found != "" {
+				return found
+			}
+		}
+	default:
+		if node != nil && fmt.Sprint(node) == value {
+			return path
+		}
+	}
+	return ""
+}
+
+// validateConfig checks what can be checked without building anything:
+// upstream URLs, route paths and routes that would shadow each other. The
+// rest (conflicting options, mostly) is caught building the router. It
+// returns ConfigErrors.
+func validateConfig(config *Config) error {
+	var errs ConfigErrors
+	names := make([]string, 0, len(config.Routes))
+	for name := range config.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matchers := make(map[string]string)
+	for _, name := range names {
+		route := config.Routes[name]
+		path := "routes." + name
+		if !route.IsEnabled() {
+			continue
+		}
+		if route.Type == "" || route.Type == "proxy" {
+			for field, upstream := range routeUpstreams(route) {
+				if err := checkUpstreamURL(upstream); err != nil {
+					errs.add(path+"."+field, "%v", err)
+				}
+			}
+		}
+		if route.Match == "regex" {
+			if _, err := regexp.Compile(route.Path); err != nil {
+				errs.add(path+".path", "%v", err)
+			}
+		}
+
+		// mux takes the first route matching, so of two routes matching
+		// the same requests, one never gets any.
+		matcher := "prefix " + route.Prefix
+		if route.Match == "exact" || route.Match == "regex" {
+			matcher = route.Match + " " + route.Path
+		}
+		queries := make([]string, 0, len(route.Queries))
+		for key, value := range route.Queries {
+			queries = append(queries, key+"="+value)
+		}
+		sort.Strings(queries)
+		matcher += " host=" + route.Host + " " + strings.Join(queries, "&")
+		if other, ok := matchers[matcher]; ok {
+			errs.add(path, "matches the same requests as route %s, so only one of them is used", other)
+		} else {
+			matchers[matcher] = name
+		}
+	}
+	return errs.orNil()
+}
+
+// routeUpstreams returns the upstream URLs of route by their path under
+// it.
+func routeUpstreams(route *Route) map[string]string {
+	upstreams := make(map[string]string)
+	if route.Upstream != "" {
+		upstreams["upstream"] = route.Upstream
+	}
+	for i, upstream := range route.Upstreams {
+		upstreams[fmt.Sprintf("upstreams[%d]", i)] = upstream
+	}
+	if route.Canary != nil {
+		for i, version := range route.Canary.Versions {
+			if version.Upstream != "" {
+				upstreams[fmt.Sprintf("canary.versions[%d].upstream", i)] = version.Upstream
+			}
+		}
+	}
+	if route.Mirror != nil {
+		upstreams["mirror.upstream"] = route.Mirror.Upstream
+	}
+	for status, action := range route.StatusActions {
+		if action.Upstream != "" {
+			upstreams[fmt.Sprintf("status_actions.%d.upstream", status)] = action.Upstream
+		}
+	}
+	return upstreams
+}
+
+func checkUpstreamURL(upstream string) error {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("%q: scheme must be http or https", upstream)
+	}
+	if target.Host == "" {
+		return fmt.Errorf("%q: no host", upstream)
+	}
+	return nil
+}
+
+// checkUpstreamHosts looks up the host of every upstream URL, for
+// --validate: a typo in a name otherwise only shows once requests fail.
+func checkUpstreamHosts(config *Config, resolver *net.Resolver) error {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var errs ConfigErrors
+	for name, route := range config.Routes {
+		if !route.IsEnabled() || (route.Type != "" && route.Type != "proxy") {
+			continue
+		}
+		for field, upstream := range routeUpstreams(route) {
+			// validateConfig reports the ones that don't parse.
+			target, err := url.Parse(upstream)
+			if err != nil || checkUpstreamURL(upstream) != nil || net.ParseIP(target.Hostname()) != nil {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), validateLookupTimeout)
+			_, err = resolver.LookupHost(ctx, target.Hostname())
+			cancel()
+			if err != nil {
+				errs.add("routes."+name+"."+field, "%v", err)
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+// checkConfig is the --validate and --print-config mode: it checks the
+// config as thoroughly as it can, building the routes but serving nothing,
+// and prints it with defaults and overrides applied. It returns the exit
+// status.
+func checkConfig(options *Options) int {
+	config, err := loadConfig(options)
+	if err != nil {
+		printConfigError(options.ConfigPath, err)
+		return 1
+	}
+	if options.Validate {
+		if err := validateFully(&config); err != nil {
+			printConfigError(options.ConfigPath, err)
+			return 1
+		}
+	}
+	if options.PrintConfig {
+		out, err := yaml.Marshal(effectiveConfig(reflect.ValueOf(config)))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		os.Stdout.Write(out)
+	} else {
+		fmt.Printf("%s: OK\n", options.ConfigPath)
+	}
+	return 0
+}
+
+// validateFully reports every problem validateConfig and the upstream
+// lookups find together; building the routes only shows the first one, so
+// it only runs once those are fixed.
+func validateFully(config *Config) error {
+	resolver, err := NewResolver(config.Resolver)
+	if err != nil {
+		return &ConfigError{Path: "resolver", Err: err}
+	}
+	var errs ConfigErrors
+	for _, err := range []error{validateConfig(config), checkUpstreamHosts(config, resolver)} {
+		if found, ok := err.(ConfigErrors); ok {
+			errs = append(errs, found...)
+		}
+	}
+	if err := errs.orNil(); err != nil {
+		return err
+	}
+	if err := validateLogFields(config); err != nil {
+		return err
+	}
+	middleware, err := NewMiddlewareSet(config, NewLongLivedTracker(), NewInFlightTracker())
+	if err != nil {
+		return err
+	}
+	router, err := buildRouter(config, middleware, resolver)
+	if err != nil {
+		return err
+	}
+	router.Close()
+	return nil
+}
+
+// printConfigError prints one problem per line, each prefixed with the
+// config file.
+func printConfigError(configPath string, err error) {
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		return
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+	}
+}
+
+// logConfigErrors logs the problems in err, one entry per problem, and
+// exits.
+func logConfigErrors(err error) {
+	var errs ConfigErrors
+	if errors.As(err, &errs) {
+		for _, err := range errs {
+			log.WithField("path", err.Path).Error(err.Err)
+		}
+		log.Fatal("invalid config")
+	}
+	log.Fatal(err)
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	cidrListType = reflect.TypeOf(CIDRList(nil))
+)
+
+// effectiveConfig turns v, a config struct, into what yaml prints as the
+// config file it amounts to: settings left unset are left out and
+// durations and networks are written the way they're given.
+func effectiveConfig(v reflect.Value) interface{} {
+	value, _ := plainYAML(v)
+	return value
+}
+
+// plainYAML returns v for printing, and whether it is set at all. Pointers
+// that are set always are, so an empty section still shows.
+func plainYAML(v reflect.Value) (interface{}, bool) {
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+		value, _ := plainYAML(v.Elem())
+		if value == nil {
+			value = yaml.MapSlice{}
+		}
+		return value, true
+	}
+	switch v.Type() {
+	case durationType:
+		return v.Interface().(time.Duration).String(), v.Int() != 0
+	case cidrListType:
+		var entries []string
+		for _, network := range v.Interface().(CIDRList) {
+			entries = append(entries, network.String())
+		}
+		return entries, len(entries) > 0
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		var fields yaml.MapSlice
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name, flags, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			value, set := plainYAML(v.Field(i))
+			if flags == "inline" {
+				if inlined, ok := value.(yaml.MapSlice); ok {
+					fields = append(fields, inlined...)
+				}
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if set {
+				fields = append(fields, yaml.MapItem{Key: name, Value: value})
+			}
+		}
+		return fields, len(fields) > 0
+	case reflect.Map:
+		entries := make(map[interface{}]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value, _ := plainYAML(iter.Value())
+			entries[iter.Key().Interface()] = value
+		}
+		return entries, v.Len() > 0
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), v.Len() > 0
+		}
+		entries := make([]interface{}, v.Len())
+		for i := range entries {
+			entries[i], _ = plainYAML(v.Index(i))
+		}
+		return entries, v.Len() > 0
+	case reflect.String:
+		return v.String(), v.Len() > 0
+	case reflect.Bool:
+		return v.Bool(), v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), v.Int() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), v.Uint() != 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), v.Float() != 0
+	default:
+		return v.Interface(), !v.IsZero()
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// isUpgradeRequest reports whether r asks to switch protocols, as
+// websocket handshakes do. ReverseProxy tunnels those itself once the
+// upstream agrees; handlers in front of it mustn't buffer or time them out
+// like a normal request.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isStreamRequest reports whether r is a websocket handshake or asks for an
+// SSE stream, either of which may stay open indefinitely.
+func isStreamRequest(r *http.Request) bool {
+	return isUpgradeRequest(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// NewWebsocketIdleTimeoutHandler closes upgraded (websocket) connections
+// once no data has flowed in either direction for timeout, so abandoned
+// clients don't hold file descriptors forever. ReverseProxy hijacks the
+// client connection through http.ResponseController, which finds the
+// Hijack here; closing that connection ends both of its copy loops and
+// with them the upstream connection.
+func NewWebsocketIdleTimeoutHandler(timeout time.Duration, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&idleHijackWriter{ResponseWriter: rw, timeout: timeout, path: r.URL.Path}, r)
+	})
+}
+
+type idleHijackWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+	path    string
+}
+
+func (w *idleHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newIdleConn(conn, w.timeout, w.path), brw, nil
+}
+
+func (w *idleHijackWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idleConn closes itself after timeout without a successful read or write.
+type idleConn struct {
+	net.Conn
+	timer   *time.Timer
+	timeout time.Duration
+
+	closeOnce sync.Once
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration, path string) *idleConn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, func() {
+		log.WithFields(log.Fields{
+			"path":    path,
+			"remote":  conn.RemoteAddr().String(),
+			"timeout": timeout,
+		}).Info("closing idle websocket connection")
+		c.Close()
+	})
+	return c
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.timer.Stop()
+		err = c.Conn.Close()
+	})
+	return err
+}